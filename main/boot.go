@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	vmextension "github.com/Azure/azure-extension-platform/vmextension"
+	"github.com/Azure/custom-script-extension-linux/pkg/atomicfile"
+	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// With runOnBoot, a systemd unit in systemdUnitDir runs the run-on-boot
+// command of the handler, through its shim, on each boot for the sequence
+// number which installed it.
+
+var (
+	// systemdUnitDir is where the boot unit of each extension instance is
+	// installed.
+	systemdUnitDir = "/etc/systemd/system"
+
+	// systemctl runs systemctl with args.
+	systemctl = func(args ...string) error {
+		out, err := exec.Command("systemctl", args...).CombinedOutput()
+		return errors.Wrapf(err, "systemctl %v: %s", args, out)
+	}
+)
+
+// bootUnitName returns the name of the boot unit of the handled extension
+// instance.
+func bootUnitName() string {
+	if extensionName == "" {
+		return "custom-script-boot.service"
+	}
+	return "custom-script-" + extensionName + "-boot.service"
+}
+
+// applyRunOnBoot installs the boot unit for seqNum if cfg runs on boot, or
+// removes the installed one if not.
+func applyRunOnBoot(ctx log.Logger, cfg handlerSettings, seqNum int) *vmextension.ErrorWithClarification {
+	if !cfg.publicSettings.RunOnBoot {
+		if err := removeBootUnit(); err != nil {
+			ctx.Log("event", "could not remove boot unit", "error", err)
+		}
+		return nil
+	}
+	if err := installBootUnit(seqNum); err != nil {
+		return vmextension.NewErrorWithClarificationPtr(errorutil.SystemError, errors.Wrap(err, "failed to install boot unit"))
+	}
+	ctx.Log("event", "installed boot unit", "unit", bootUnitName())
+	return nil
+}
+
+// installBootUnit writes and enables the unit which runs run-on-boot for
+// seqNum on each boot, from the current directory where the agent runs the
+// handler.
+func installBootUnit(seqNum int) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "failed to find handler binary")
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return errors.Wrap(err, "failed to find working directory")
+	}
+	env := fmt.Sprintf("Environment=%s=%d\n", configSequenceNumber, seqNum)
+	if extensionName != "" {
+		env += fmt.Sprintf("Environment=%s=%s\n", configExtensionName, extensionName)
+	}
+	unit := fmt.Sprintf(`# installed by the Custom Script extension for sequence number %d, do not edit
+[Unit]
+Description=Custom Script extension: run the command on boot
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=oneshot
+TimeoutStartSec=infinity
+WorkingDirectory=%s
+%sExecStart=%s run-on-boot
+
+[Install]
+WantedBy=multi-user.target
+`, seqNum, wd, env, strconv.Quote(filepath.Join(filepath.Dir(exe), shimName)))
+
+	if err := os.MkdirAll(systemdUnitDir, 0755); err != nil {
+		return errors.Wrap(err, "failed to create unit directory")
+	}
+	if err := atomicfile.WriteFile(filepath.Join(systemdUnitDir, bootUnitName()), []byte(unit), 0644); err != nil {
+		return err
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	return systemctl("enable", bootUnitName())
+}
+
+// removeBootUnit disables and removes the boot unit of the handled extension
+// instance, if any.
+func removeBootUnit() error {
+	path := filepath.Join(systemdUnitDir, bootUnitName())
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	if err := systemctl("disable", bootUnitName()); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return errors.Wrap(err, "failed to remove boot unit")
+	}
+	return systemctl("daemon-reload")
+}
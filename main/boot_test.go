@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
+	"github.com/Azure/custom-script-extension-linux/pkg/seqnum"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_bootUnitName(t *testing.T) {
+	require.Equal(t, "custom-script-boot.service", bootUnitName())
+	setTestExtensionName(t, "my-ext.v2")
+	require.Equal(t, "custom-script-my-ext.v2-boot.service", bootUnitName())
+}
+
+func Test_applyRunOnBoot(t *testing.T) {
+	calls := setTestSystemctl(t)
+	setTestExtensionName(t, "a")
+	nop := log.NewNopLogger()
+
+	require.Nil(t, applyRunOnBoot(nop, handlerSettings{publicSettings: publicSettings{RunOnBoot: true}}, 3))
+	b, err := ioutil.ReadFile(filepath.Join(systemdUnitDir, "custom-script-a-boot.service"))
+	require.Nil(t, err)
+	unit := string(b)
+	require.Contains(t, unit, "\nType=oneshot\n")
+	require.Contains(t, unit, "\nEnvironment=ConfigSequenceNumber=3\nEnvironment=ConfigExtensionName=a\n")
+	require.Contains(t, unit, "/custom-script-shim\" run-on-boot\n")
+	require.Contains(t, unit, "\nWantedBy=multi-user.target\n")
+	require.Equal(t, []string{"daemon-reload", "enable custom-script-a-boot.service"}, *calls)
+
+	*calls = nil
+	require.Nil(t, applyRunOnBoot(nop, handlerSettings{}, 4))
+	require.False(t, fileExists(t, filepath.Join(systemdUnitDir, "custom-script-a-boot.service")))
+	require.Equal(t, []string{"disable custom-script-a-boot.service", "daemon-reload"}, *calls)
+
+	*calls = nil
+	require.Nil(t, applyRunOnBoot(nop, handlerSettings{}, 4))
+	require.Empty(t, *calls, "nothing to remove")
+}
+
+func Test_applyRunOnBoot_systemctlFails(t *testing.T) {
+	setTestSystemctl(t)
+	systemctl = func(args ...string) error { return errors.New("no systemd") }
+
+	ewc := applyRunOnBoot(log.NewNopLogger(), handlerSettings{publicSettings: publicSettings{RunOnBoot: true}}, 0)
+	require.NotNil(t, ewc)
+	require.Equal(t, errorutil.SystemError, ewc.ErrorCode)
+	require.Contains(t, ewc.Err.Error(), "no systemd")
+}
+
+func Test_runOnBoot_afterUpdate(t *testing.T) {
+	setTestDataDir(t)
+	setTestMostRecentSequence(t)
+	setTestCronDir(t)
+	calls := setTestSystemctl(t)
+	ctx := log.NewContext(log.NewNopLogger())
+	hEnv := HandlerEnvironment{}
+	hEnv.HandlerEnvironment.ConfigFolder = tempDir(t)
+	hEnv.HandlerEnvironment.StatusFolder = tempDir(t)
+	require.Nil(t, writeToFile(filepath.Join(hEnv.HandlerEnvironment.ConfigFolder, "0.settings"), `{"runtimeSettings": [{"handlerSettings": {
+		"publicSettings": {"commandToExecute": "cat a.txt", "runOnBoot": true, "inlineFiles": {"a.txt": "aGkK"}}}}]}`))
+	unit := filepath.Join(systemdUnitDir, bootUnitName())
+
+	// the enable of the previous version ran sequence number 0
+	require.Nil(t, seqnum.Set(instanceMostRecentSequence(), 0))
+	_, _, ewc := enable(ctx, hEnv, 0)
+	require.Nil(t, ewc)
+	require.True(t, fileExists(t, unit))
+
+	// the update disables and uninstalls the previous version, then installs
+	// and enables this one with the same sequence number
+	_, _, ewc = disable(ctx, hEnv, 0)
+	require.Nil(t, ewc)
+	_, _, ewc = uninstall(ctx, hEnv, 0)
+	require.Nil(t, ewc)
+	require.False(t, fileExists(t, unit))
+	_, _, ewc = install(ctx, hEnv, 0)
+	require.Nil(t, ewc)
+	shouldExit, _, err := checkAndSaveSettings(ctx, 0, rerunOnSeqNumChange, "", instanceMostRecentSequence(), instanceMostRecentSettingsHash())
+	require.Nil(t, err)
+	require.True(t, shouldExit, "already processed")
+	enableProcessed(ctx, hEnv, 0)
+
+	b, err := ioutil.ReadFile(unit)
+	require.Nil(t, err)
+	wd, err := os.Getwd()
+	require.Nil(t, err)
+	require.Contains(t, string(b), "\nWorkingDirectory="+wd+"\n", "the unit runs this version")
+	require.Equal(t, "enable "+bootUnitName(), (*calls)[len(*calls)-1])
+
+	// the boot run downloads the files the uninstall removed again
+	msg, _, ewc := runTriggered(triggerBoot)(ctx, hEnv, 0)
+	require.Nil(t, ewc)
+	require.Contains(t, msg, "[stdout]\nhi\n")
+}
+
+// setTestSystemctl points systemdUnitDir to a new temporary directory and
+// records the systemctl invocations instead of running them.
+func setTestSystemctl(t *testing.T) *[]string {
+	origDir, origCtl := systemdUnitDir, systemctl
+	systemdUnitDir = tempDir(t)
+	var calls []string
+	systemctl = func(args ...string) error {
+		calls = append(calls, strings.Join(args, " "))
+		return nil
+	}
+	t.Cleanup(func() { systemdUnitDir, systemctl = origDir, origCtl })
+	return &calls
+}
@@ -1,15 +1,15 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
-	"compress/gzip"
 	"encoding/base64"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/Azure/azure-extension-platform/pkg/extensionpolicysettings"
@@ -17,23 +17,34 @@ import (
 	vmextension "github.com/Azure/azure-extension-platform/vmextension"
 	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
 	"github.com/Azure/custom-script-extension-linux/pkg/seqnum"
+	"github.com/Azure/custom-script-extension-linux/pkg/state"
 	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
 )
 
 const (
 	maxScriptSize = 256 * 1024
+
+	// maxDecompressedScriptSize caps the size of a compressed script once
+	// decompressed.
+	maxDecompressedScriptSize = 4 * 1024 * 1024
 )
 
-type cmdFunc func(ctx *log.Context, hEnv HandlerEnvironment, seqNum int) (msg string, ewc *vmextension.ErrorWithClarification)
+type cmdFunc func(ctx *log.Context, hEnv HandlerEnvironment, seqNum int) (msg string, substatus []SubstatusItem, ewc *vmextension.ErrorWithClarification)
 type preFunc func(ctx *log.Context, hEnv HandlerEnvironment, seqNum int) error
 
+// standaloneFunc runs a tooling command which does not need the
+// HandlerEnvironment, with the remaining command line arguments. It returns the
+// exit code of the process.
+type standaloneFunc func(args []string) int
+
 type cmd struct {
-	f                  cmdFunc // associated function
-	name               string  // human readable string
-	shouldReportStatus bool    // determines if running this should log to a .status file
-	pre                preFunc // executed before any status is reported
-	failExitCode       int     // exitCode to use when commands fail
+	f                  cmdFunc        // associated function
+	name               string         // human readable string
+	shouldReportStatus bool           // determines if running this should log to a .status file
+	pre                preFunc        // executed before any status is reported
+	failExitCode       int            // exitCode to use when commands fail
+	standalone         standaloneFunc // if set, executed instead of f without HandlerEnvironment or status
 }
 
 const (
@@ -46,27 +57,32 @@ const (
 var (
 	telemetry = sendTelemetry(newTelemetryEventSender(), fullName, Version)
 
-	cmdInstall   = cmd{install, "Install", false, nil, 52}
-	cmdEnable    = cmd{enable, "Enable", true, enablePre, 3}
-	cmdUninstall = cmd{uninstall, "Uninstall", false, nil, 3}
+	cmdInstall        = cmd{install, "Install", false, nil, 52, nil}
+	cmdEnable         = cmd{enable, "Enable", true, enablePre, 3, nil}
+	cmdUninstall      = cmd{uninstall, "Uninstall", false, nil, 3, nil}
+	cmdDisable        = cmd{disable, "Disable", true, nil, 3, nil}
+	cmdUpdate         = cmd{update, "Update", true, nil, 3, nil}
+	cmdRunScheduled   = cmd{runTriggered(triggerScheduled), "RunScheduled", true, triggeredPre(0), 3, nil}
+	cmdRunOnBoot      = cmd{runTriggered(triggerBoot), "RunOnBoot", true, triggeredPre(defaultLockTimeout), 3, nil}
+	cmdValidatePolicy = cmd{nil, "ValidatePolicy", false, nil, 1, validatePolicy}
+	cmdPrintSchema    = cmd{nil, "PrintSchema", false, nil, 1, printSchema}
 
 	cmds = map[string]cmd{
-		"install":   cmdInstall,
-		"uninstall": cmdUninstall,
-		"enable":    cmdEnable,
-		"update":    {noop, "Update", true, nil, 3},
-		"disable":   {noop, "Disable", true, nil, 3},
+		"install":         cmdInstall,
+		"uninstall":       cmdUninstall,
+		"enable":          cmdEnable,
+		"update":          cmdUpdate,
+		"run-scheduled":   cmdRunScheduled,
+		"run-on-boot":     cmdRunOnBoot,
+		"disable":         cmdDisable,
+		"validate-policy": cmdValidatePolicy,
+		"print-schema":    cmdPrintSchema,
 	}
 )
 
-func noop(ctx *log.Context, h HandlerEnvironment, seqNum int) (string, *vmextension.ErrorWithClarification) {
-	ctx.Log("event", "noop")
-	return "", nil
-}
-
-func install(ctx *log.Context, h HandlerEnvironment, seqNum int) (string, *vmextension.ErrorWithClarification) {
+func install(ctx *log.Context, h HandlerEnvironment, seqNum int) (string, []SubstatusItem, *vmextension.ErrorWithClarification) {
 	if err := os.MkdirAll(dataDir, 0755); err != nil {
-		return "", vmextension.NewErrorWithClarificationPtr(errorutil.SystemError, errors.Wrap(err, "failed to create data dir"))
+		return "", nil, vmextension.NewErrorWithClarificationPtr(errorutil.SystemError, errors.Wrap(err, "failed to create data dir"))
 	}
 
 	// If the file mrseq does not exists it is for two possible reasons.
@@ -77,36 +93,130 @@ func install(ctx *log.Context, h HandlerEnvironment, seqNum int) (string, *vmext
 	// To ensure that scripts run, we will not set mrseq during install, only during enable.
 
 	ctx.Log("event", "created data dir", "path", dataDir)
+
+	// install doesn't report status, a failed migration is logged and runs
+	// again on the next update or install
+	if err := migrate(ctx); err != nil {
+		ctx.Log("event", "state migration failed", "error", err)
+	}
 	ctx.Log("event", "installed")
-	return "", nil
+	return "", nil, nil
+}
+
+func update(ctx *log.Context, h HandlerEnvironment, seqNum int) (string, []SubstatusItem, *vmextension.ErrorWithClarification) {
+	if err := migrate(ctx); err != nil {
+		return "", nil, vmextension.NewErrorWithClarificationPtr(errorutil.Os_FailedToMigrateState, err)
+	}
+	ctx.Log("event", "updated")
+	return "", nil, nil
 }
 
-func uninstall(ctx *log.Context, h HandlerEnvironment, seqNum int) (string, *vmextension.ErrorWithClarification) {
+func uninstall(ctx *log.Context, h HandlerEnvironment, seqNum int) (string, []SubstatusItem, *vmextension.ErrorWithClarification) {
 	{ // a new context scope with path
 		ctx = ctx.With("path", dataDir)
 		ctx.Log("event", "removing data dir", "path", dataDir)
 		if err := os.RemoveAll(dataDir); err != nil {
-			return "", vmextension.NewErrorWithClarificationPtr(errorutil.Os_FailedToDeleteDataDir, errors.Wrap(err, "failed to delete data directory"))
+			return "", nil, vmextension.NewErrorWithClarificationPtr(errorutil.Os_FailedToDeleteDataDir, errors.Wrap(err, "failed to delete data directory"))
 		}
 		ctx.Log("event", "removed data dir")
 	}
+	removeTriggers(ctx)
 	ctx.Log("event", "uninstalled")
-	return "", nil
+	return "", nil, nil
 }
 
 func enablePre(ctx *log.Context, hEnv HandlerEnvironment, seqNum int) error {
+	// the settings are read before enable validates them, to decide whether
+	// and how they run
+	pub, prot, err := readSettings(hEnv.HandlerEnvironment.ConfigFolder, seqNum)
+	if err != nil {
+		ctx.Log("event", "could not read settings, enable reports it", "error", err)
+		pub, prot = nil, nil
+	}
+
+	// the command of an older sequence number which still runs is terminated
+	// first, unless this one is queued behind it
+	wait := lockSettingsOf(pub)
+	superseded, sig := supersededExecution(ctx, pub, seqNum)
+	if superseded != nil {
+		ctx.Log("event", "superseding", "seq", superseded.SeqNum, "pid", superseded.Pid)
+		markSuperseding(ctx, superseded, seqNum)
+		if err := terminateProcessGroup(ctx, superseded.Pid, sig); err != nil {
+			return errors.Wrap(err, "failed to supersede the running command")
+		}
+		// its enable invocation reports and releases the lock right away
+		if wait < terminateGracePeriod {
+			wait = terminateGracePeriod
+		}
+	}
+
+	// only one enable invocation at a time goes past this point, the lock is
+	// held until the process exits
+	switch waited, holder, err := acquireEnableLockBehind(ctx, seqNum, wait, queuedExecution(ctx, pub, seqNum)); {
+	case err == errLockBusy && holder != nil && holder.SeqNum == seqNum:
+		ctx.Log("event", "exit", "message", "another enable invocation is handling this sequence number", "pid", holder.Pid)
+		os.Exit(0)
+	case err == errLockBusy:
+		skipEnable = &skipResult{ewc: concurrentEnableError(holder, waited)}
+		return nil
+	case err != nil:
+		return errors.Wrap(err, "failed to take the enable lock")
+	case holder != nil && superseded == nil:
+		lockWaitMsg = fmt.Sprintf("waited %v for another enable invocation (pid %d, sequence number %d) to complete", waited.Round(time.Second), holder.Pid, holder.SeqNum)
+		ctx.Log("event", "serialized", "message", lockWaitMsg)
+	}
+	// enable resumes the runs disable paused
+	wasDisabled := os.Remove(instanceDisabledPath()) == nil
+	if wasDisabled {
+		ctx.Log("event", "removed disabled marker")
+	}
+	if superseded != nil {
+		markTerminated(ctx, hEnv, superseded, supersededError(superseded, seqNum))
+		lockWaitMsg = fmt.Sprintf("superseded sequence number %d", superseded.SeqNum)
+	}
+
+	policy, hash := rerunSettingsOf(ctx, pub, prot)
+
+	// a sequence number which an earlier run didn't complete, e.g. because of
+	// a crash, is resumed, left alone or reported according to its state
+	switch action, st := checkState(ctx, seqNum); {
+	case action == stateRunning:
+		ctx.Log("event", "exit", "message", "the command of this sequence number is still running", "pid", st.Pid)
+		os.Exit(0)
+	case action == stateResume:
+		ctx.Log("event", "resuming", "message", "an earlier run stopped before executing the command", "phase", st.Phase)
+		return nil
+	case action == stateInterrupted && policy != rerunAlways:
+		skipEnable = &skipResult{ewc: interruptedError(st)}
+		return nil
+	}
+
 	// exit if this sequence number (a snapshot of the configuration) is already
-	// processed. if not, save this sequence number before proceeding.
-	if shouldExit, err := checkAndSaveSeqNum(ctx, seqNum, mostRecentSequence); err != nil {
+	// processed, or must not run again according to the rerun policy. if not,
+	// save this sequence number and the settings hash before proceeding.
+	shouldExit, skipMsg, err := checkAndSaveSettings(ctx, seqNum, policy, hash, instanceMostRecentSequence(), instanceMostRecentSettingsHash())
+	if err != nil {
 		return errors.Wrap(err, "failed to process sequence number")
 	} else if shouldExit {
 		ctx.Log("event", "exit", "message", "the script configuration has already been processed, will not run again")
-		clearSettingsAndScriptExceptMostRecent(seqNum, ctx, hEnv)
+		enableProcessed(ctx, hEnv, seqNum)
 		os.Exit(0)
 	}
+	if skipMsg != "" {
+		skipEnable = &skipResult{msg: skipMsg}
+	}
+	newStateTracker(ctx, seqNum).set(state.Received)
 	return nil
 }
 
+// enableProcessed is what enable does instead of running seqNum, which was
+// already processed: its triggers are installed again, for this version of
+// the handler, and the files of older sequence numbers are cleared.
+func enableProcessed(ctx *log.Context, hEnv HandlerEnvironment, seqNum int) {
+	restoreTriggers(ctx, hEnv, seqNum)
+	clearSettingsAndScriptExceptMostRecent(seqNum, ctx, hEnv)
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -114,75 +224,130 @@ func min(a, b int) int {
 	return b
 }
 
-type CSEExtensionPolicySettings struct {
-	RequireSigning bool     `json:"requireSigning"`
-	FileRootCertCA string   `json:"fileRootCertCA,omitempty"` // optional field for customer that want to specify a root cert for script signature verification. This is a path to a cert file on the VM that the extension can use to verify script signatures. The customer is responsible for ensuring the cert is there and updated as needed (e.g. if the cert expires). The customer can choose to use this field or not based on their needs.
-	AllowedScripts []string `json:"allowedScripts"`
-}
+func enable(ctx *log.Context, h HandlerEnvironment, seqNum int) (msg string, _ []SubstatusItem, ewc *vmextension.ErrorWithClarification) {
+	st := newStateTracker(ctx, seqNum)
+	defer func() {
+		st.completed(ewc)
+		if lockWaitMsg != "" {
+			msg = lockWaitMsg + "\n" + msg
+		}
+	}()
 
-func (cseps CSEExtensionPolicySettings) ValidateFormat() error {
-	if cseps.RequireSigning && len(cseps.FileRootCertCA) == 0 {
-		return errors.New("invalid policy settings: if RequireSigning is true, fileRootCertCA must be provided")
+	if skipEnable != nil {
+		if skipEnable.ewc != nil {
+			ctx.Log("event", "not run", "error", skipEnable.ewc.Err)
+			return "", nil, skipEnable.ewc
+		}
+		ctx.Log("event", "skipped", "message", skipEnable.msg)
+		telemetry("scenario", "rerun-skipped;policy="+rerunOnContentChange, true, 0*time.Millisecond)
+		return skipEnable.msg, nil, nil
 	}
-	return nil
-}
 
-func enable(ctx *log.Context, h HandlerEnvironment, seqNum int) (string, *vmextension.ErrorWithClarification) {
 	// parse the extension handler settings (not available prior to 'enable')
-	cfg, ewc := parseAndValidateSettings(ctx, h.HandlerEnvironment.ConfigFolder, seqNum)
+	cfgs, ewc := parseAndValidateSettings(ctx, h.HandlerEnvironment.ConfigFolder, seqNum)
 
 	if ewc != nil {
 		ewc.Err = errors.Wrap(ewc.Err, "failed to get configuration")
-		return "", ewc
+		return "", nil, ewc
 	}
 
 	// If policy file exists, load the policy.
 	// If the policy is invalid, we log error and exit.
 	// If the policy file does not exist, proceed as normal.
-	var ExtensionPolicyManagerPtr *extensionpolicysettings.ExtensionPolicySettingsManager[CSEExtensionPolicySettings]
 	policyPath := filepath.Join(h.HandlerEnvironment.ConfigFolder, policyFileName)
+	ExtensionPolicyManagerPtr, policy, ewc := loadExtensionPolicy(ctx, policyPath)
+	if ewc != nil {
+		return "", nil, ewc
+	}
+	st.set(state.PolicyChecked)
+	if ewc := applyTriggers(ctx, cfgs[0], seqNum); ewc != nil {
+		return "", nil, ewc
+	}
 
-	if _, err := os.Stat(policyPath); err == nil {
-		ExtensionPolicyManagerPtr, err = extensionpolicysettings.NewExtensionPolicySettingsManager[CSEExtensionPolicySettings](policyPath)
-		if err != nil {
-			return "", vmextension.NewErrorWithClarificationPtr(errorutil.ExtensionPolicySettings_policyLoadFailed, errors.Wrap(err, "failed to create extension policy settings manager"))
+	dir := filepath.Join(instanceDownloadDir(), fmt.Sprintf("%d", seqNum))
+	if len(cfgs) == 1 {
+		msg, runErr := enableBlock(ctx, dir, cfgs[0], ExtensionPolicyManagerPtr, policy, st)
+		clearSettingsAndScriptExceptMostRecent(seqNum, ctx, h)
+		return msg, nil, runErr
+	}
+
+	// each runtime settings block runs in its own subdirectory, even if an
+	// earlier one failed, and reports its own substatus
+	msg, substatus, runErr := enableBlocks(ctx, dir, cfgs, ExtensionPolicyManagerPtr, policy, st)
+	clearSettingsAndScriptExceptMostRecent(seqNum, ctx, h)
+	return msg, substatus, runErr
+}
+
+// enableBlocks runs each of cfgs with enableBlock, see runBlocks. Once the
+// command of a block was terminated by the enable of a new sequence number,
+// the next blocks don't run.
+func enableBlocks(ctx *log.Context, dir string, cfgs []handlerSettings, eps *extensionpolicysettings.ExtensionPolicySettingsManager[CSEExtensionPolicySettings], policy *CSEExtensionPolicySettings, st *stateTracker) (string, []SubstatusItem, *vmextension.ErrorWithClarification) {
+	return runBlocks(ctx, dir, cfgs, func(ctx *log.Context, dir string, cfg handlerSettings) (string, *vmextension.ErrorWithClarification) {
+		if by := st.supersededBy(); by != 0 {
+			return "", supersededBlockError(st.state.SeqNum, by)
 		}
-		err = ExtensionPolicyManagerPtr.LoadExtensionPolicySettings()
-		if err != nil {
-			return "", vmextension.NewErrorWithClarificationPtr(errorutil.ExtensionPolicySettings_policyLoadFailed, errors.Wrap(err, "failed to load extension policy settings"))
-		} else {
-			settings, err := ExtensionPolicyManagerPtr.GetSettings()
-			if err != nil {
-				return "", vmextension.NewErrorWithClarificationPtr(errorutil.ExtensionPolicySettings_policyLoadFailed, errors.Wrap(err, "failed to get extension policy settings"))
+		return enableBlock(ctx, dir, cfg, eps, policy, st)
+	})
+}
+
+// blockFunc runs a runtime settings block in dir and returns its message.
+type blockFunc func(ctx *log.Context, dir string, cfg handlerSettings) (string, *vmextension.ErrorWithClarification)
+
+// runBlocks runs each of cfgs with run in the subdirectory of dir named after
+// its index and returns the substatus of each. If any of them failed, the
+// returned error has the code of the first failure.
+func runBlocks(ctx *log.Context, dir string, cfgs []handlerSettings, run blockFunc) (string, []SubstatusItem, *vmextension.ErrorWithClarification) {
+	var substatus []SubstatusItem
+	var firstErr *vmextension.ErrorWithClarification
+	var failed []string
+	for i, cfg := range cfgs {
+		name := fmt.Sprintf("runtimeSettings[%d]", i)
+		msg, ewc := run(ctx.With("block", i), filepath.Join(dir, strconv.Itoa(i)), cfg)
+		if ewc != nil {
+			substatus = append(substatus, NewSubstatus(name, StatusError, ewc.ErrorCode, ewc.Error()+msg))
+			if firstErr == nil {
+				firstErr = ewc
 			}
-			ctx.Log("message", "successfully loaded extension policy settings", "settings", fmt.Sprintf("%+v", settings))
+			failed = append(failed, name)
+			continue
 		}
-	} else if os.IsNotExist(err) {
-		ctx.Log("message", "extension policy settings file does not exist, proceeding with default extension behavior.", "path", policyPath)
-		ExtensionPolicyManagerPtr = nil
-	} else {
-		return "", vmextension.NewErrorWithClarificationPtr(errorutil.ExtensionPolicySettings_policyLoadFailed, errors.Wrap(err, "error while checking for extension policy settings file. Stat failed with an error other than file not existing"))
+		substatus = append(substatus, NewSubstatus(name, StatusSuccess, 0, msg))
+	}
+
+	if firstErr != nil {
+		return "", substatus, vmextension.NewErrorWithClarificationPtr(firstErr.ErrorCode,
+			errors.Errorf("%d of %d runtime settings failed: %s", len(failed), len(cfgs), strings.Join(failed, ", ")))
 	}
+	return fmt.Sprintf("%d runtime settings succeeded", len(cfgs)), substatus, nil
+}
 
-	dir := filepath.Join(dataDir, downloadDir, fmt.Sprintf("%d", seqNum))
-	if ewc := downloadFiles(ctx, dir, cfg, ExtensionPolicyManagerPtr); ewc != nil {
+// prepareFiles downloads the files of cfg into dir and writes its inline files
+// there. It returns the messages about the signatures of the files.
+func prepareFiles(ctx *log.Context, dir string, cfg handlerSettings, eps *extensionpolicysettings.ExtensionPolicySettingsManager[CSEExtensionPolicySettings], policy *CSEExtensionPolicySettings) (string, *vmextension.ErrorWithClarification) {
+	signatures, ewc := downloadFiles(ctx, dir, cfg, eps)
+	if ewc != nil {
 		ewc.Err = errors.Wrap(ewc.Err, "processing file downloads failed")
 		return "", ewc
 	}
-
-	// execute the command, save its error
-	runErr := runCmd(ctx, dir, cfg)
-
-	// collect the logs if available
-	stdoutF, stderrF := logPaths(dir)
-	stdoutTail, err := tailFile(stdoutF, maxTailLen)
-	if err != nil {
-		ctx.Log("message", "error tailing stdout logs", "error", err)
+	if ewc := writeInlineFiles(ctx, dir, cfg, policy); ewc != nil {
+		ewc.Err = errors.Wrap(ewc.Err, "writing inline files failed")
+		return "", ewc
 	}
-	stderrTail, err := tailFile(stderrF, maxTailLen)
-	if err != nil {
-		ctx.Log("message", "error tailing stderr logs", "error", err)
+	return signatures, nil
+}
+
+// enableBlock downloads the files of cfg into dir and runs its command there.
+// The returned message holds the tails of the command's stdout and stderr.
+// Its progress is recorded by st, which can be nil.
+func enableBlock(ctx *log.Context, dir string, cfg handlerSettings, eps *extensionpolicysettings.ExtensionPolicySettingsManager[CSEExtensionPolicySettings], policy *CSEExtensionPolicySettings, st *stateTracker) (string, *vmextension.ErrorWithClarification) {
+	signatures, ewc := prepareFiles(ctx, dir, cfg, eps, policy)
+	if ewc != nil {
+		return "", ewc
 	}
+	st.set(state.Downloaded)
+
+	// execute the command, save its error
+	runErr := runCmd(ctx, dir, cfg, policy, st)
 
 	isSuccess := runErr == nil
 	telemetry("Output", "-- stdout/stderr omitted from telemetry pipeline --", isSuccess, 0)
@@ -193,11 +358,23 @@ func enable(ctx *log.Context, h HandlerEnvironment, seqNum int) (string, *vmexte
 		ctx.Log("event", "enable failed")
 	}
 
-	msg := fmt.Sprintf("\n[stdout]\n%s\n[stderr]\n%s", string(stdoutTail), string(stderrTail))
-
-	clearSettingsAndScriptExceptMostRecent(seqNum, ctx, h)
+	return signatures + outputTails(ctx, dir), runErr
+}
 
-	return msg, runErr
+// outputTails returns the tails of the stdout and stderr files of the command
+// which ran in dir, as reported in the status message.
+func outputTails(ctx log.Logger, dir string) string {
+	// collect the logs if available
+	stdoutF, stderrF := logPaths(dir)
+	stdoutTail, err := tailFile(stdoutF, maxTailLen)
+	if err != nil {
+		ctx.Log("message", "error tailing stdout logs", "error", err)
+	}
+	stderrTail, err := tailFile(stderrF, maxTailLen)
+	if err != nil {
+		ctx.Log("message", "error tailing stderr logs", "error", err)
+	}
+	return fmt.Sprintf("\n[stdout]\n%s\n[stderr]\n%s", string(stdoutTail), string(stderrTail))
 }
 
 // checkAndSaveSeqNum checks if the given seqNum is already processed
@@ -224,15 +401,28 @@ func checkAndSaveSeqNum(ctx log.Logger, seq int, mrseqPath string) (shouldExit b
 // downloadFiles downloads the files specified in cfg into dir (creates if does
 // not exist) and takes storage credentials specified in cfg into account.
 // If extension policy settings is provided, they are passed on to downloadAndProcessURL for file validation.
-func downloadFiles(ctx *log.Context, dir string, cfg handlerSettings, eps *extensionpolicysettings.ExtensionPolicySettingsManager[CSEExtensionPolicySettings]) *vmextension.ErrorWithClarification {
+// If the files must be signed, the returned message lists how each file was verified.
+func downloadFiles(ctx *log.Context, dir string, cfg handlerSettings, eps *extensionpolicysettings.ExtensionPolicySettingsManager[CSEExtensionPolicySettings]) (string, *vmextension.ErrorWithClarification) {
 	// - prepare the output directory for files and the command output
 	// - create the directory if missing
 	ctx.Log("event", "creating output directory", "path", dir)
 	if err := os.MkdirAll(dir, 0700); err != nil {
-		return vmextension.NewErrorWithClarificationPtr(errorutil.FileDownload_unableToCreateDownloadDirectory, errors.Wrap(err, "failed to prepare output directory"))
+		return "", vmextension.NewErrorWithClarificationPtr(errorutil.FileDownload_unableToCreateDownloadDirectory, errors.Wrap(err, "failed to prepare output directory"))
 	}
 	ctx.Log("event", "created output directory")
 
+	var policy *CSEExtensionPolicySettings
+	if eps != nil {
+		var err error
+		if policy, err = eps.GetSettings(); err != nil {
+			return "", vmextension.NewErrorWithClarificationPtr(errorutil.SystemError, errors.Wrap(err, "failed to get extension policy settings"))
+		}
+	}
+	verifier, ewc := scriptVerifier(cfg, policy)
+	if ewc != nil {
+		return "", ewc
+	}
+
 	dos2unix := 1
 	if cfg.publicSettings.SkipDos2Unix {
 		dos2unix = 0
@@ -246,21 +436,39 @@ func downloadFiles(ctx *log.Context, dir string, cfg handlerSettings, eps *exten
 		telemetry("scenario", fmt.Sprintf("protected-fileUrls;dos2unix=%d", dos2unix), true, 0*time.Millisecond)
 	}
 
+	var msg string
+	if verifier != nil && len(cfg.fileUrls()) > 0 {
+		msg = "\n[signatures]"
+	}
 	for i, f := range cfg.fileUrls() {
 		ctx := ctx.With("file", i)
 		ctx.Log("event", "download start")
-		if ewc := downloadAndProcessURL(ctx, f, dir, &cfg, eps); ewc != nil {
+		verified, ewc := downloadAndProcessURL(ctx, f, dir, &cfg, eps, verifier)
+		if ewc != nil {
 			ctx.Log("event", "download failed", "error", ewc.Err)
-			return vmextension.NewErrorWithClarificationPtr(ewc.ErrorCode, errors.Wrapf(ewc.Err, "failed to download file[%d]", i))
+			return "", vmextension.NewErrorWithClarificationPtr(ewc.ErrorCode, errors.Wrapf(ewc.Err, "failed to download file[%d]", i))
+		}
+		if verifier != nil {
+			fn, _ := urlToFileName(f)
+			msg += fmt.Sprintf("\nfile[%d] %s: verified %s", i, fn, verified)
 		}
 		ctx.Log("event", "download complete", "output", dir)
 	}
-	return nil
+	return msg, nil
 }
 
-// runCmd runs the command (extracted from cfg) in the given dir (assumed to exist).
-func runCmd(ctx log.Logger, dir string, cfg handlerSettings) (ewc *vmextension.ErrorWithClarification) {
+// runCmd runs the command (extracted from cfg) in the given dir (assumed to exist)
+// within the execution limits of cfg and policy (which can be nil). The pid and
+// exit code of the command are recorded by st, which can be nil.
+func runCmd(ctx log.Logger, dir string, cfg handlerSettings, policy *CSEExtensionPolicySettings, st *stateTracker) (ewc *vmextension.ErrorWithClarification) {
 	ctx.Log("event", "executing command", "output", dir)
+	if disabled() {
+		return vmextension.NewErrorWithClarificationPtr(errorutil.CommandExecution_disabled, errors.New("the extension was disabled before the command started"))
+	}
+	opts, ewc := resolveExecOptions(cfg, policy)
+	if ewc != nil {
+		return ewc
+	}
 	var cmd string
 	var scenario string
 	var scenarioInfo string
@@ -278,20 +486,47 @@ func runCmd(ctx log.Logger, dir string, cfg handlerSettings) (ewc *vmextension.E
 	} else if cfg.publicSettings.Script != "" {
 		ctx.Log("event", "executing public script", "output", dir)
 		if cmd, scenarioInfo, err = writeTempScript(cfg.publicSettings.Script, dir, cfg.publicSettings.SkipDos2Unix); err != nil {
-			return nil
+			return vmextension.NewErrorWithClarificationPtr(errorutil.CustomerInput_invalidScript, err)
 		}
 		scenario = fmt.Sprintf("public-script;%s", scenarioInfo)
 	} else if cfg.protectedSettings.Script != "" {
 		ctx.Log("event", "executing protected script", "output", dir)
 		if cmd, scenarioInfo, err = writeTempScript(cfg.protectedSettings.Script, dir, cfg.publicSettings.SkipDos2Unix); err != nil {
-			return nil
+			return vmextension.NewErrorWithClarificationPtr(errorutil.CustomerInput_invalidScript, err)
 		}
 		scenario = fmt.Sprintf("protected-script;%s", scenarioInfo)
+	} else if cfg.publicSettings.FileToExecute != "" {
+		ctx.Log("event", "executing fileToExecute", "output", dir)
+		if cmd, err = resolveFileToExecute(dir, cfg.publicSettings.FileToExecute); err != nil {
+			return vmextension.NewErrorWithClarificationPtr(errorutil.CustomerInput_invalidFileToExecute, err)
+		}
+		scenario = fmt.Sprintf("public-fileToExecute;args=%d;protectedArgs=%d", len(cfg.publicSettings.Arguments), len(cfg.protectedSettings.ProtectedArguments))
+	}
+
+	if cmd, opts.env, ewc = resolveSecrets(ctx, cmd, cfg); ewc != nil {
+		return ewc
+	}
+	// after the script is written, which the run-as user runs too
+	if opts.credential != nil {
+		if err := shareTree(dir, int(opts.credential.Gid)); err != nil {
+			return vmextension.NewErrorWithClarificationPtr(errorutil.SystemError, errors.Wrap(err, "failed to share output directory with the run-as user"))
+		}
 	}
 
+	if st != nil {
+		opts.started = st.executing
+	}
 	begin := time.Now()
-	ewc = ExecCmdInDir(cmd, dir)
+	var exitCode int
+	if cfg.publicSettings.FileToExecute != "" {
+		exitCode, ewc = ExecFileInDir(cmd, cfg.arguments(), dir, opts)
+	} else {
+		exitCode, ewc = ExecCmdInDir(cmd, dir, opts)
+	}
 	elapsed := time.Now().Sub(begin)
+	if ewc == nil || ewc.ErrorCode == errorutil.CommandExecution_failureExitCode {
+		st.exited(exitCode)
+	}
 	isSuccess := ewc == nil
 
 	telemetry("scenario", scenario, isSuccess, elapsed)
@@ -314,8 +549,8 @@ func writeTempScript(script, dir string, skipDosToUnix bool) (string, string, er
 		return "", "", err
 	}
 
-	cmd := fmt.Sprintf("%s/script.sh", dir)
-	f, err := os.OpenFile(cmd, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0500)
+	path := filepath.Join(dir, "script.sh")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC|os.O_CREATE|syscall.O_NOFOLLOW, 0500)
 	if err != nil {
 		return "", "", errors.Wrap(err, "failed to write script.sh")
 	}
@@ -325,16 +560,20 @@ func writeTempScript(script, dir string, skipDosToUnix bool) (string, string, er
 
 	dos2unix := 1
 	if skipDosToUnix == false {
-		err = postProcessFile(cmd)
+		err = postProcessFile(path)
 		if err != nil {
 			return "", "", errors.Wrap(err, "failed to post-process script.sh")
 		}
 		dos2unix = 0
 	}
-	return cmd, fmt.Sprintf("%s;dos2unix=%d", info, dos2unix), nil
+	// relative to the directory the command runs in, which the run-as user
+	// may not be able to reach by its absolute path
+	return "./script.sh", fmt.Sprintf("%s;dos2unix=%d", info, dos2unix), nil
 }
 
-// base64 decode and optionally GZip decompress a script
+// decodeScript base64 decodes a script and decompresses it if it is gzip,
+// zstd, xz or bzip2 compressed. The returned telemetry info holds the encoded
+// and decoded lengths and the codec.
 func decodeScript(script string) (string, string, error) {
 	// scripts must be base64 encoded
 	s, err := base64.StdEncoding.DecodeString(script)
@@ -342,26 +581,27 @@ func decodeScript(script string) (string, string, error) {
 		return "", "", errors.Wrap(err, "failed to decode script")
 	}
 
-	// scripts may be gzip'ed
-	r, err := gzip.NewReader(bytes.NewReader(s))
-	if err != nil {
-		return string(s), fmt.Sprintf("%d;%d;gzip=0", len(script), len(s)), nil
-	}
-
-	var buf bytes.Buffer
-	w := bufio.NewWriter(&buf)
-
-	n, err := io.Copy(w, r)
+	// scripts may be compressed
+	b, codec, err := decompress(s, maxDecompressedScriptSize)
 	if err != nil {
 		return "", "", errors.Wrap(err, "failed to decompress script")
 	}
 
-	w.Flush()
-	return buf.String(), fmt.Sprintf("%d;%d;gzip=1", len(script), n), nil
+	gzip := 0
+	if codec == "gzip" {
+		gzip = 1
+	}
+	return string(b), fmt.Sprintf("%d;%d;gzip=%d;codec=%s", len(script), len(b), gzip, codec), nil
 }
 
 func clearSettingsAndScriptExceptMostRecent(seqNum int, ctx *log.Context, hEnv HandlerEnvironment) {
-	downloadsParent := filepath.Join(dataDir, downloadDir)
+	if newerSettingsExist(hEnv.HandlerEnvironment.ConfigFolder, seqNum) {
+		// a newer sequence number waits for the enable lock, it clears the
+		// files once it ran
+		ctx.Log("event", "not clearing settings and script files, newer settings are waiting")
+		return
+	}
+	downloadsParent := instanceDownloadDir()
 	seqNumString := strconv.Itoa(seqNum)
 
 	ctx.Log("event", "clearing settings and script files except most recent seq num")
@@ -369,12 +609,45 @@ func clearSettingsAndScriptExceptMostRecent(seqNum int, ctx *log.Context, hEnv H
 	if err != nil {
 		ctx.Log("event", "could not clear scripts")
 	}
-	mostRecentRuntimeSetting := fmt.Sprintf("%d.settings", uint(seqNum))
+	mostRecentRuntimeSetting := instanceFileName(seqNum, settingsFileSuffix)
 	err = utils.TryClearRegexMatchingFilesExcept(hEnv.HandlerEnvironment.ConfigFolder,
-		"\\d+.settings",
+		instanceFileRegex(settingsFileSuffix),
 		mostRecentRuntimeSetting,
 		false)
 	if err != nil {
 		ctx.Log("event", "could not clear settings")
 	}
+	if _, err := os.Stat(instanceHistoryDir()); err == nil {
+		if err := utils.TryDeleteDirectoriesExcept(instanceHistoryDir(), seqNumString); err != nil {
+			ctx.Log("event", "could not clear run history")
+		}
+	}
+	err = utils.TryClearRegexMatchingFilesExcept(filepath.Join(dataDir, stateDir),
+		instanceFileRegex(stateFileSuffix),
+		instanceFileName(seqNum, stateFileSuffix),
+		false)
+	if err != nil {
+		ctx.Log("event", "could not clear states")
+	}
+}
+
+// newerSettingsExist returns whether the settings of a sequence number of the
+// handled extension instance greater than seqNum exist and were not cleared
+// yet.
+func newerSettingsExist(configFolder string, seqNum int) bool {
+	re := regexp.MustCompile(instanceFileRegex(settingsFileSuffix))
+	files, err := ioutil.ReadDir(configFolder)
+	if err != nil {
+		return false
+	}
+	for _, f := range files {
+		m := re.FindStringSubmatch(f.Name())
+		if m == nil || f.Size() == 0 {
+			continue
+		}
+		if n, err := strconv.Atoi(m[1]); err == nil && n > seqNum {
+			return true
+		}
+	}
+	return false
 }
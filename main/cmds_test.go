@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strconv"
 	"testing"
 
 	"github.com/Azure/azure-extension-platform/pkg/extensionpolicysettings"
@@ -18,7 +22,7 @@ import (
 
 func Test_commandsExist(t *testing.T) {
 	// we expect these subcommands to be handled
-	expect := []string{"install", "enable", "disable", "uninstall", "update"}
+	expect := []string{"install", "enable", "disable", "uninstall", "update", "run-scheduled", "run-on-boot", "validate-policy", "print-schema"}
 	for _, c := range expect {
 		_, ok := cmds[c]
 		if !ok {
@@ -38,6 +42,12 @@ func Test_commands_shouldReportStatus(t *testing.T) {
 	require.True(t, cmds["enable"].shouldReportStatus, "enable should report status")
 	require.True(t, cmds["disable"].shouldReportStatus, "disable should report status")
 	require.True(t, cmds["update"].shouldReportStatus, "update should report status")
+	require.True(t, cmds["run-scheduled"].shouldReportStatus, "run-scheduled should report status")
+	require.True(t, cmds["run-on-boot"].shouldReportStatus, "run-on-boot should report status")
+
+	// tooling subcommands run without HandlerEnvironment and never report status
+	require.False(t, cmds["validate-policy"].shouldReportStatus, "validate-policy should not report status")
+	require.NotNil(t, cmds["validate-policy"].standalone, "validate-policy should be standalone")
 }
 
 func Test_checkAndSaveSeqNum_fails(t *testing.T) {
@@ -159,7 +169,7 @@ func Test_runCmd_success(t *testing.T) {
 
 	require.Nil(t, runCmd(log.NewNopLogger(), dir, handlerSettings{
 		publicSettings: publicSettings{CommandToExecute: "date"},
-	}), "command should run successfully")
+	}, nil, nil), "command should run successfully")
 }
 
 func Test_runCmd_fail(t *testing.T) {
@@ -169,12 +179,146 @@ func Test_runCmd_fail(t *testing.T) {
 
 	ewc := runCmd(log.NewNopLogger(), dir, handlerSettings{
 		publicSettings: publicSettings{CommandToExecute: "non-existing-cmd"},
-	})
+	}, nil, nil)
 	require.Equal(t, errorutil.CommandExecution_failureExitCode, ewc.ErrorCode)
 	require.NotNil(t, ewc.Err, "command terminated with exit status")
 	require.Contains(t, ewc.Err.Error(), "failed to execute command")
 }
 
+func Test_runCmd_fileToExecute(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "args.sh"), []byte("#!/bin/sh\necho \"$# $1|$2|$ENV_VAR\"\n"), 0500))
+
+	require.Nil(t, runCmd(log.NewNopLogger(), dir, handlerSettings{
+		publicSettings:    publicSettings{FileToExecute: "args.sh", Arguments: []string{"a; date"}},
+		protectedSettings: protectedSettings{ProtectedArguments: []string{"$HOME"}, EnvironmentVariables: map[string]secretValue{"ENV_VAR": {Value: "v"}}},
+	}, nil, nil))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "stdout"))
+	require.Nil(t, err)
+	require.Equal(t, "2 a; date|$HOME|v\n", string(b))
+
+	ewc := runCmd(log.NewNopLogger(), dir, handlerSettings{
+		publicSettings: publicSettings{FileToExecute: "missing.sh"},
+	}, nil, nil)
+	require.NotNil(t, ewc)
+	require.Equal(t, errorutil.CustomerInput_invalidFileToExecute, ewc.ErrorCode)
+}
+
+func Test_runCmd_runAsUser(t *testing.T) {
+	dir := runAsUserDir(t)
+
+	require.Nil(t, runCmd(log.NewNopLogger(), dir, handlerSettings{
+		publicSettings: publicSettings{CommandToExecute: "id -un && touch created", RunAsUser: "nobody"},
+	}, nil, nil), "command should run successfully")
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "stdout"))
+	require.Nil(t, err)
+	require.Equal(t, "nobody\n", string(b))
+	require.True(t, fileExists(t, filepath.Join(dir, "created")), "the command can write in its directory")
+
+	// the command can't replace the output files of the handler
+	require.NotNil(t, runCmd(log.NewNopLogger(), dir, handlerSettings{
+		publicSettings: publicSettings{CommandToExecute: "rm -f stdout stderr", RunAsUser: "nobody"},
+	}, nil, nil))
+	require.True(t, fileExists(t, filepath.Join(dir, "stdout")))
+}
+
+func Test_runCmd_runAsUser_script(t *testing.T) {
+	dir := runAsUserDir(t)
+
+	require.Nil(t, runCmd(log.NewNopLogger(), dir, handlerSettings{
+		publicSettings: publicSettings{
+			Script:    base64.StdEncoding.EncodeToString([]byte("#!/bin/sh\nid -un")),
+			RunAsUser: "nobody",
+		},
+	}, nil, nil), "script should run successfully")
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "stdout"))
+	require.Nil(t, err)
+	require.Equal(t, "nobody\n", string(b))
+}
+
+func Test_runCmd_runAsUser_fileToExecute(t *testing.T) {
+	dir := runAsUserDir(t)
+	require.Nil(t, os.Mkdir(filepath.Join(dir, "sub"), 0700))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "sub", "whoami.sh"), []byte("#!/bin/sh\necho \"$(id -un) $1\"\n"), 0500))
+
+	require.Nil(t, runCmd(log.NewNopLogger(), dir, handlerSettings{
+		publicSettings: publicSettings{FileToExecute: "sub/whoami.sh", Arguments: []string{"a"}, RunAsUser: "nobody"},
+	}, nil, nil), "file should run successfully")
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "stdout"))
+	require.Nil(t, err)
+	require.Equal(t, "nobody a\n", string(b))
+}
+
+// runAsUserDir returns a new output directory under a temporary directory
+// which, like /var/lib/waagent, others can't traverse. It skips the test if
+// it can't switch users.
+func runAsUserDir(t *testing.T) string {
+	if os.Getuid() != 0 {
+		t.Skip("switching users requires root")
+	}
+	parent, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(parent) })
+	require.Nil(t, os.Chmod(parent, 0700))
+	dir := filepath.Join(parent, "0")
+	require.Nil(t, os.Mkdir(dir, 0700))
+	return dir
+}
+
+func Test_runCmd_policyDeniesRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ewc := runCmd(log.NewNopLogger(), dir, handlerSettings{
+		publicSettings: publicSettings{CommandToExecute: "date", RunAsUser: "root"},
+	}, &CSEExtensionPolicySettings{DenyRoot: true}, nil)
+	require.NotNil(t, ewc)
+	require.Equal(t, errorutil.ExtensionPolicySettings_executionNotAllowed, ewc.ErrorCode)
+	require.False(t, fileExists(t, filepath.Join(dir, "stdout")), "command should not have started")
+}
+
+func Test_enableBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	msg, substatus, ewc := enableBlocks(log.NewContext(log.NewNopLogger()), dir, []handlerSettings{
+		{publicSettings: publicSettings{CommandToExecute: "echo zero"}},
+		{publicSettings: publicSettings{CommandToExecute: "echo one >&2; exit 1"}},
+		{publicSettings: publicSettings{CommandToExecute: "echo two"}},
+	}, nil, nil, nil)
+	require.Equal(t, "", msg)
+	require.NotNil(t, ewc)
+	require.Equal(t, errorutil.CommandExecution_failureExitCode, ewc.ErrorCode)
+	require.Equal(t, "1 of 3 runtime settings failed: runtimeSettings[1]", ewc.Err.Error())
+
+	// every block ran in its own directory, despite the failure before the last
+	require.Len(t, substatus, 3)
+	for i, want := range []string{"zero", "one", "two"} {
+		require.Equal(t, fmt.Sprintf("runtimeSettings[%d]", i), substatus[i].Name)
+		require.Contains(t, substatus[i].FormattedMessage.Message, want)
+		require.True(t, fileExists(t, filepath.Join(dir, strconv.Itoa(i), "stdout")))
+	}
+	require.Equal(t, StatusSuccess, substatus[0].Status)
+	require.Equal(t, StatusError, substatus[1].Status)
+	require.Equal(t, errorutil.CommandExecution_failureExitCode, substatus[1].Code)
+	require.Equal(t, StatusSuccess, substatus[2].Status)
+
+	msg, substatus, ewc = enableBlocks(log.NewContext(log.NewNopLogger()), dir, []handlerSettings{
+		{publicSettings: publicSettings{CommandToExecute: "true"}},
+		{publicSettings: publicSettings{CommandToExecute: "true"}},
+	}, nil, nil, nil)
+	require.Nil(t, ewc)
+	require.Equal(t, "2 runtime settings succeeded", msg)
+	require.Len(t, substatus, 2)
+}
+
 func Test_downloadFiles(t *testing.T) {
 	dir, err := ioutil.TempDir("", "")
 	require.Nil(t, err)
@@ -183,7 +327,7 @@ func Test_downloadFiles(t *testing.T) {
 	srv := httptest.NewServer(httpbin.GetMux())
 	defer srv.Close()
 
-	ewc := downloadFiles(log.NewContext(log.NewNopLogger()),
+	_, ewc := downloadFiles(log.NewContext(log.NewNopLogger()),
 		dir,
 		handlerSettings{
 			publicSettings: publicSettings{
@@ -244,7 +388,7 @@ func Test_downloadFiles_allowlistStopsOnFirstDisallowedFile(t *testing.T) {
 	require.NoError(t, err)
 	require.NoError(t, ExtensionPolicyManagerPtr.LoadExtensionPolicySettings())
 
-	ewc := downloadFiles(log.NewContext(log.NewNopLogger()),
+	_, ewc := downloadFiles(log.NewContext(log.NewNopLogger()),
 		dir,
 		handlerSettings{
 			publicSettings: publicSettings{
@@ -318,7 +462,7 @@ func Test_downloadFiles_goodAllowlist_SHA256(t *testing.T) {
 	err = ExtensionPolicyManagerPtr.LoadExtensionPolicySettings()
 	require.NoError(t, err, "should be able to load extension policy settings")
 
-	ewc := downloadFiles(log.NewContext(log.NewNopLogger()),
+	_, ewc := downloadFiles(log.NewContext(log.NewNopLogger()),
 		dir,
 		handlerSettings{
 			publicSettings: publicSettings{
@@ -390,7 +534,7 @@ func Test_downloadFiles_badAllowlist(t *testing.T) {
 	err = ExtensionPolicyManagerPtr.LoadExtensionPolicySettings()
 	require.NoError(t, err, "should be able to load extension policy settings")
 
-	ewc := downloadFiles(log.NewContext(log.NewNopLogger()),
+	_, ewc := downloadFiles(log.NewContext(log.NewNopLogger()),
 		dir,
 		handlerSettings{
 			publicSettings: publicSettings{
@@ -444,7 +588,7 @@ func Test_downloadFiles_emptyAllowlist(t *testing.T) {
 	err = ExtensionPolicyManagerPtr.LoadExtensionPolicySettings()
 	require.NoError(t, err, "should be able to load extension policy settings")
 
-	ewc := downloadFiles(log.NewContext(log.NewNopLogger()),
+	_, ewc := downloadFiles(log.NewContext(log.NewNopLogger()),
 		dir,
 		handlerSettings{
 			publicSettings: publicSettings{
@@ -470,7 +614,7 @@ func Test_decodeScript(t *testing.T) {
 	s, info, err := decodeScript(testSubject)
 
 	require.NoError(t, err)
-	require.Equal(t, info, "4;3;gzip=0")
+	require.Equal(t, info, "4;3;gzip=0;codec=none")
 	require.Equal(t, s, "ls\n")
 }
 
@@ -479,10 +623,43 @@ func Test_decodeScriptGzip(t *testing.T) {
 	s, info, err := decodeScript(testSubject)
 
 	require.NoError(t, err)
-	require.Equal(t, info, "32;3;gzip=1")
+	require.Equal(t, info, "32;3;gzip=1;codec=gzip")
 	require.Equal(t, s, "ls\n")
 }
 
+func Test_decodeScript_codecs(t *testing.T) {
+	for codec, script := range map[string]string{
+		"zstd":  "KLUv/QRYGQAAbHMKGM4iew==",
+		"xz":    "/Td6WFoAAATm1rRGBMAHAyEBFgAAAAAAAAAAAOLzWwwBAAJscwoAAOTSXiwWaNgqAAEjA/CTJgcftvN9AQAAAAAEWVo=",
+		"bzip2": "QlpoOTFBWSZTWSDXrYcAAADBgAAQAAQIACAAIZgZhGF3JFOFCQINethw",
+	} {
+		s, info, err := decodeScript(script)
+		require.NoError(t, err, codec)
+		require.Equal(t, fmt.Sprintf("%d;3;gzip=0;codec=%s", len(script), codec), info)
+		require.Equal(t, "ls\n", s)
+	}
+}
+
+func Test_decodeScript_compressionBomb(t *testing.T) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(make([]byte, maxDecompressedScriptSize+1))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	_, _, err = decodeScript(base64.StdEncoding.EncodeToString(buf.Bytes()))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to decompress script")
+}
+
+func Test_runCmd_invalidScript(t *testing.T) {
+	ewc := runCmd(log.NewNopLogger(), tempDir(t), handlerSettings{
+		publicSettings: publicSettings{Script: base64.StdEncoding.EncodeToString(append(append([]byte{}, gzipMagic...), 0, 0))},
+	}, nil, nil)
+	require.NotNil(t, ewc)
+	require.Equal(t, errorutil.CustomerInput_invalidScript, ewc.ErrorCode)
+}
+
 // Helper Methods
 func writeToFile(filePath, content string) error {
 	err := os.WriteFile(filePath, []byte(content), 0644)
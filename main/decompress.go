@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/ulikunitz/xz"
+)
+
+// codecNone is the codec of data which isn't compressed.
+const codecNone = "none"
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	bzip2Magic = []byte{'B', 'Z', 'h'}
+
+	// bzip2 streams start with the magic, the block size digit and then the
+	// magic of a block or of the end of the stream.
+	bzip2BlockMagic = []byte{0x31, 0x41, 0x59, 0x26, 0x53, 0x59}
+	bzip2EndMagic   = []byte{0x17, 0x72, 0x45, 0x38, 0x50, 0x90}
+)
+
+// decompress detects by its magic bytes whether b is gzip, zstd, xz or bzip2
+// compressed and returns it decompressed along with the name of the codec.
+// Data in no known format is returned as is. Decompressing to more than
+// maxSize bytes is an error, which defends against compression bombs.
+func decompress(b []byte, maxSize int64) ([]byte, string, error) {
+	var r io.Reader
+	var codec string
+	switch {
+	case bytes.HasPrefix(b, gzipMagic):
+		gr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, "", errors.Wrap(err, "invalid gzip data")
+		}
+		defer gr.Close()
+		r, codec = gr, "gzip"
+	case bytes.HasPrefix(b, zstdMagic):
+		zr, err := zstd.NewReader(bytes.NewReader(b), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, "", errors.Wrap(err, "invalid zstd data")
+		}
+		defer zr.Close()
+		r, codec = zr, "zstd"
+	case bytes.HasPrefix(b, xzMagic):
+		xr, err := xz.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, "", errors.Wrap(err, "invalid xz data")
+		}
+		r, codec = xr, "xz"
+	case isBzip2(b):
+		r, codec = bzip2.NewReader(bytes.NewReader(b)), "bzip2"
+	default:
+		if int64(len(b)) > maxSize {
+			return nil, "", errors.Errorf("size exceeds the maximum of %d bytes", maxSize)
+		}
+		return b, codecNone, nil
+	}
+
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "failed to decompress %s data", codec)
+	}
+	if n > maxSize {
+		return nil, "", errors.Errorf("decompressed size exceeds the maximum of %d bytes", maxSize)
+	}
+	return buf.Bytes(), codec, nil
+}
+
+// isBzip2 returns true if b starts like a bzip2 stream. Its magic is made of
+// printable characters, so more than the magic is checked to not mistake a
+// script for it.
+func isBzip2(b []byte) bool {
+	if !bytes.HasPrefix(b, bzip2Magic) || len(b) < 10 || b[3] < '1' || b[3] > '9' {
+		return false
+	}
+	return bytes.HasPrefix(b[4:], bzip2BlockMagic) || bytes.HasPrefix(b[4:], bzip2EndMagic)
+}
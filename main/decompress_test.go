@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_decompress(t *testing.T) {
+	data := []byte("echo hello\n")
+
+	b, codec, err := decompress(data, 100)
+	require.Nil(t, err)
+	require.Equal(t, codecNone, codec)
+	require.Equal(t, data, b)
+
+	b, codec, err = decompress(gzipBytes(t, data), 100)
+	require.Nil(t, err)
+	require.Equal(t, "gzip", codec)
+	require.Equal(t, data, b)
+
+	b, codec, err = decompress(zstdBytes(t, data), 100)
+	require.Nil(t, err)
+	require.Equal(t, "zstd", codec)
+	require.Equal(t, data, b)
+
+	b, codec, err = decompress(xzBytes(t), 100)
+	require.Nil(t, err)
+	require.Equal(t, "xz", codec)
+	require.Equal(t, data, b)
+
+	b, codec, err = decompress(bzip2Bytes(t), 100)
+	require.Nil(t, err)
+	require.Equal(t, "bzip2", codec)
+	require.Equal(t, data, b)
+}
+
+func Test_decompress_bzip2MagicInText(t *testing.T) {
+	data := []byte("BZh9 is not a command\n")
+	b, codec, err := decompress(data, 100)
+	require.Nil(t, err)
+	require.Equal(t, codecNone, codec)
+	require.Equal(t, data, b)
+}
+
+func Test_decompress_maxSize(t *testing.T) {
+	data := bytes.Repeat([]byte("a"), 1000)
+	for _, b := range [][]byte{data, gzipBytes(t, data), zstdBytes(t, data)} {
+		_, _, err := decompress(b, 999)
+		require.NotNil(t, err)
+		require.Contains(t, err.Error(), "exceeds the maximum of 999 bytes")
+		_, _, err = decompress(b, 1000)
+		require.Nil(t, err)
+	}
+}
+
+func Test_decompress_invalid(t *testing.T) {
+	_, _, err := decompress(append(append([]byte{}, gzipMagic...), 0, 0), 100)
+	require.NotNil(t, err)
+	_, _, err = decompress(append(append([]byte{}, zstdMagic...), 0, 0, 0, 0), 100)
+	require.NotNil(t, err)
+	_, _, err = decompress(append(append([]byte{}, xzMagic...), 0, 0, 0, 0), 100)
+	require.NotNil(t, err)
+	_, _, err = decompress(append(append(append([]byte{}, bzip2Magic...), '9'), bzip2BlockMagic...), 100)
+	require.NotNil(t, err)
+}
+
+func gzipBytes(t *testing.T, b []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(b)
+	require.Nil(t, err)
+	require.Nil(t, w.Close())
+	return buf.Bytes()
+}
+
+func zstdBytes(t *testing.T, b []byte) []byte {
+	w, err := zstd.NewWriter(nil)
+	require.Nil(t, err)
+	defer w.Close()
+	return w.EncodeAll(b, nil)
+}
+
+// xzBytes returns "echo hello\n" compressed by xz.
+func xzBytes(t *testing.T) []byte {
+	b, err := base64.StdEncoding.DecodeString("/Td6WFoAAATm1rRGBMAPCyEBFgAAAAAAAAAAALk+AWUBAAplY2hvIGhlbGxvCgAAjHFHKGMm4u8AASsLypEkwR+2830BAAAAAARZWg==")
+	require.Nil(t, err)
+	return b
+}
+
+// bzip2Bytes returns "echo hello\n" compressed by bzip2.
+func bzip2Bytes(t *testing.T) []byte {
+	b, err := base64.StdEncoding.DecodeString("QlpoOTFBWSZTWSD4PccAAAHRAAAQQAAKRKAAMQwA00eiVGwhUeLuSKcKEgQfB7jg")
+	require.Nil(t, err)
+	return b
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	vmextension "github.com/Azure/azure-extension-platform/vmextension"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// With enable --detach, the invocation of the agent runs the checks of
+// enablePre, writes a placeholder status and starts the enable invocation
+// which runs the command in a new session, so that it outlives the invocation
+// and the timeout the agent puts on it.
+
+const (
+	// detachFlag is the argument of enable which detaches the command.
+	detachFlag = "--detach"
+
+	// detachedEnv is the environment variable through which the detaching
+	// invocation hands its handoff over to the detached one.
+	detachedEnv = "CUSTOM_SCRIPT_DETACHED"
+
+	// handoffLockFd is the file descriptor of the enable lock in the detached
+	// invocation, the first one after stdin, stdout and stderr.
+	handoffLockFd = 3
+)
+
+var (
+	// startRetries is how many more times the detached invocation is started
+	// while the handler binary is being written, e.g. by an update.
+	startRetries = 10
+
+	// startRetryInterval is the wait between these attempts.
+	startRetryInterval = 3 * time.Second
+)
+
+// handoff is what enablePre left for enable in the detaching invocation.
+type handoff struct {
+	// PreDone is false if the enable lock was busy: the detached invocation
+	// runs enablePre and waits for the lock itself, rather than the
+	// invocation of the agent.
+	PreDone bool `json:"preDone"`
+	// Locked is whether the detached invocation inherits the enable lock on
+	// handoffLockFd.
+	Locked      bool   `json:"locked,omitempty"`
+	LockWaitMsg string `json:"lockWaitMsg,omitempty"`
+	SkipMsg     string `json:"skipMsg,omitempty"`
+	SkipCode    int    `json:"skipCode,omitempty"`
+	SkipError   string `json:"skipError,omitempty"`
+}
+
+// detachEnable runs the pre-checks of c and starts the detached enable
+// invocation for seqNum, logging to out. It returns the pid of the detached
+// invocation.
+func detachEnable(ctx *log.Context, hEnv HandlerEnvironment, seqNum int, c cmd, out *os.File) (int, error) {
+	var h handoff
+	var lock *os.File
+	// the lock is tried once, the invocation of the agent never waits for
+	// another one; enablePre goes on with the lock it holds
+	switch _, holder, err := acquireEnableLock(instanceLockPath(), seqNum, 0); {
+	case err == errLockBusy:
+		ctx.Log("event", "another enable invocation runs, the detached invocation waits for it", "holder", fmt.Sprintf("%+v", holder))
+	case err != nil:
+		return 0, errors.Wrap(err, "failed to take the enable lock")
+	default:
+		ctx.Log("event", "pre-check")
+		if err := c.pre(ctx, hEnv, seqNum); err != nil {
+			return 0, errors.Wrap(err, "pre-check failed")
+		}
+		h = newHandoff()
+		lock = heldLock
+		h.Locked = lock != nil
+	}
+	writePlaceholderStatus(ctx, hEnv, seqNum, c)
+	return startDetached(ctx, h, lock, out)
+}
+
+// newHandoff returns the handoff of what enablePre left.
+func newHandoff() handoff {
+	h := handoff{PreDone: true, LockWaitMsg: lockWaitMsg}
+	if skipEnable != nil {
+		h.SkipMsg = skipEnable.msg
+		if skipEnable.ewc != nil {
+			h.SkipCode, h.SkipError = skipEnable.ewc.ErrorCode, skipEnable.ewc.Err.Error()
+		}
+	}
+	return h
+}
+
+// restore sets what enablePre would have left in the detached invocation of
+// seqNum.
+func (h handoff) restore(seqNum int) {
+	lockWaitMsg = h.LockWaitMsg
+	if h.SkipError != "" {
+		skipEnable = &skipResult{ewc: vmextension.NewErrorWithClarificationPtr(h.SkipCode, errors.New(h.SkipError))}
+	} else if h.SkipMsg != "" {
+		skipEnable = &skipResult{msg: h.SkipMsg}
+	}
+	if h.Locked {
+		// held until the process exits, but not by the command it runs
+		syscall.CloseOnExec(handoffLockFd)
+		heldLock = os.NewFile(handoffLockFd, instanceLockPath())
+		writeLockHolder(heldLock, seqNum)
+	}
+}
+
+// readHandoff returns the handoff of the detaching invocation if this is the
+// detached one, and removes it from the environment the command inherits.
+func readHandoff() (*handoff, error) {
+	v, ok := os.LookupEnv(detachedEnv)
+	if !ok {
+		return nil, nil
+	}
+	os.Unsetenv(detachedEnv)
+	var h handoff
+	if err := json.Unmarshal([]byte(v), &h); err != nil {
+		return nil, errors.Wrap(err, "failed to parse "+detachedEnv)
+	}
+	return &h, nil
+}
+
+// writePlaceholderStatus reports the transitioning status of c for seqNum,
+// unless a status is already there, so that the agent doesn't find the status
+// missing until the detached invocation reports it.
+func writePlaceholderStatus(ctx *log.Context, hEnv HandlerEnvironment, seqNum int, c cmd) {
+	path := filepath.Join(hEnv.HandlerEnvironment.StatusFolder, instanceFileName(seqNum, ".status"))
+	if _, err := os.Stat(path); err == nil {
+		ctx.Log("event", "not writing a placeholder status, already exists", "path", path)
+		return
+	}
+	ctx.Log("event", "writing a placeholder status", "path", path)
+	reportStatus(ctx, hEnv, seqNum, StatusTransitioning, c, "")
+}
+
+// startDetached starts the handler binary with enable in a new session, with
+// the handoff h and the enable lock, if any, logging to out. It retries while
+// the binary is being written.
+func startDetached(ctx *log.Context, h handoff, lock *os.File, out *os.File) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to find handler binary")
+	}
+	b, err := json.Marshal(h)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to marshal handoff")
+	}
+	for attempt := 0; ; attempt++ {
+		cmd := exec.Command(exe, "enable")
+		cmd.Env = append(os.Environ(), detachedEnv+"="+string(b))
+		cmd.Stdout, cmd.Stderr = out, out
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+		if lock != nil {
+			cmd.ExtraFiles = []*os.File{lock}
+		}
+		err := cmd.Start()
+		if err == nil {
+			pid := cmd.Process.Pid
+			cmd.Process.Release()
+			return pid, nil
+		}
+		if !errors.Is(err, syscall.ETXTBSY) || attempt >= startRetries {
+			return 0, errors.Wrap(err, "failed to start detached enable")
+		}
+		ctx.Log("event", "handler binary is being written, retrying", "attempt", attempt+1)
+		time.Sleep(startRetryInterval)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	vmextension "github.com/Azure/azure-extension-platform/vmextension"
+	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_handoff(t *testing.T) {
+	defer func() { lockWaitMsg, skipEnable = "", nil }()
+	lockWaitMsg = "waited 3s for another enable invocation"
+	skipEnable = &skipResult{ewc: vmextension.NewErrorWithClarificationPtr(errorutil.CommandExecution_concurrentEnable, errors.New("busy"))}
+
+	h := newHandoff()
+	require.True(t, h.PreDone)
+	b, err := json.Marshal(h)
+	require.Nil(t, err)
+	t.Setenv(detachedEnv, string(b))
+
+	lockWaitMsg, skipEnable = "", nil
+	got, err := readHandoff()
+	require.Nil(t, err)
+	require.NotNil(t, got)
+	_, ok := os.LookupEnv(detachedEnv)
+	require.False(t, ok, "the command doesn't inherit it")
+
+	got.restore(1)
+	require.Equal(t, "waited 3s for another enable invocation", lockWaitMsg)
+	require.NotNil(t, skipEnable)
+	require.Equal(t, errorutil.CommandExecution_concurrentEnable, skipEnable.ewc.ErrorCode)
+	require.EqualError(t, skipEnable.ewc.Err, "busy")
+}
+
+func Test_handoff_skipMsg(t *testing.T) {
+	defer func() { skipEnable = nil }()
+	handoff{PreDone: true, SkipMsg: "already ran"}.restore(1)
+	require.Equal(t, &skipResult{msg: "already ran"}, skipEnable)
+}
+
+func Test_readHandoff(t *testing.T) {
+	h, err := readHandoff()
+	require.Nil(t, err)
+	require.Nil(t, h, "not detached")
+
+	t.Setenv(detachedEnv, "{")
+	_, err = readHandoff()
+	require.NotNil(t, err)
+}
+
+func Test_writePlaceholderStatus(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	hEnv := HandlerEnvironment{}
+	hEnv.HandlerEnvironment.StatusFolder = tempDir(t)
+
+	writePlaceholderStatus(ctx, hEnv, 1, cmdEnable)
+	status, err := readStatus(ctx, hEnv, 1)
+	require.Nil(t, err)
+	require.Equal(t, StatusTransitioning, status)
+
+	require.Nil(t, NewStatus(StatusSuccess, "Enable", "done").Save(hEnv.HandlerEnvironment.StatusFolder, 2))
+	writePlaceholderStatus(ctx, hEnv, 2, cmdEnable)
+	status, err = readStatus(ctx, hEnv, 2)
+	require.Nil(t, err)
+	require.Equal(t, StatusSuccess, status, "an existing status is left alone")
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	vmextension "github.com/Azure/azure-extension-platform/vmextension"
+	"github.com/Azure/custom-script-extension-linux/pkg/atomicfile"
+	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
+	"github.com/Azure/custom-script-extension-linux/pkg/state"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// disabledMarker is the file under dataDir left by disable. While it exists,
+// no command of the extension instance starts; the next enable removes it.
+var disabledMarker = "disabled"
+
+// disable stops the commands of the handled extension instance which still
+// run, removes its triggers and leaves the disabled marker, which pauses the
+// runs of the extension until the next enable.
+func disable(ctx *log.Context, h HandlerEnvironment, seqNum int) (string, []SubstatusItem, *vmextension.ErrorWithClarification) {
+	// the marker comes first, so that an enable which didn't start its
+	// command yet doesn't start it
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return "", nil, vmextension.NewErrorWithClarificationPtr(errorutil.SystemError, errors.Wrap(err, "failed to create data dir"))
+	}
+	if err := atomicfile.WriteFile(instanceDisabledPath(), []byte(time.Now().UTC().Format(time.RFC3339)), 0600); err != nil {
+		return "", nil, vmextension.NewErrorWithClarificationPtr(errorutil.SystemError, errors.Wrap(err, "failed to write disabled marker"))
+	}
+	ctx.Log("event", "wrote disabled marker", "path", instanceDisabledPath())
+	// the next enable installs them again
+	removeTriggers(ctx)
+
+	var stopped []*state.State
+	for _, st := range runningExecutions(ctx) {
+		ctx.Log("event", "stopping command", "seq", st.SeqNum, "pid", st.Pid)
+		if err := terminateProcessGroup(ctx, st.Pid, syscall.SIGTERM); err != nil {
+			return "", nil, vmextension.NewErrorWithClarificationPtr(errorutil.SystemError, errors.Wrapf(err, "failed to stop the command of sequence number %d", st.SeqNum))
+		}
+		stopped = append(stopped, st)
+	}
+	if len(stopped) == 0 {
+		return "", nil, nil
+	}
+
+	// the enable invocations of the stopped commands report their result and
+	// exit, they hold the enable lock until then
+	if _, _, err := acquireEnableLock(instanceLockPath(), seqNum, terminateGracePeriod); err != nil {
+		ctx.Log("event", "enable still runs after its command was stopped", "error", err)
+	}
+	var msgs []string
+	for _, st := range stopped {
+		ewc := disabledError(st)
+		if st.SeqNum == seqNum {
+			// the status of seqNum reports this disable
+			completeTerminated(ctx, st, ewc)
+		} else {
+			markTerminated(ctx, h, st, ewc)
+		}
+		msgs = append(msgs, fmt.Sprintf("stopped the command of sequence number %d (pid %d)", st.SeqNum, st.Pid))
+	}
+	return strings.Join(msgs, "\n"), nil, nil
+}
+
+// disabledError returns the error reported for the sequence number of st
+// whose command was stopped by disable.
+func disabledError(st *state.State) *vmextension.ErrorWithClarification {
+	return vmextension.NewErrorWithClarificationPtr(errorutil.CommandExecution_disabled,
+		fmt.Errorf("the command (pid %d) was stopped since the extension was disabled", st.Pid))
+}
+
+// disabled returns whether the handled extension instance was disabled and
+// not enabled since.
+func disabled() bool {
+	_, err := os.Stat(instanceDisabledPath())
+	return err == nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
+	"github.com/Azure/custom-script-extension-linux/pkg/state"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_disable_nothingRunning(t *testing.T) {
+	setTestDataDir(t)
+	setTestCronDir(t)
+	setTestSystemctl(t)
+	require.Nil(t, applySchedule(log.NewNopLogger(), handlerSettings{publicSettings: publicSettings{Schedule: "@daily"}}, 0))
+	require.False(t, disabled())
+
+	msg, _, ewc := disable(log.NewContext(log.NewNopLogger()), HandlerEnvironment{}, 0)
+	require.Nil(t, ewc)
+	require.Empty(t, msg)
+	require.True(t, disabled())
+	require.False(t, fileExists(t, cronFilePath()), "the schedule is removed")
+}
+
+func Test_disable_stopsCommands(t *testing.T) {
+	setTestDataDir(t)
+	setTestCronDir(t)
+	setTestSystemctl(t)
+	defer func(d time.Duration) { terminateGracePeriod = d }(terminateGracePeriod)
+	terminateGracePeriod = 200 * time.Millisecond
+	ctx := log.NewContext(log.NewNopLogger())
+	hEnv := HandlerEnvironment{}
+	hEnv.HandlerEnvironment.StatusFolder = tempDir(t)
+
+	old := startProcessGroup(t, "sleep 30")
+	newStateTracker(ctx, 1).executing(old.Process.Pid)
+	current := startProcessGroup(t, "sleep 30")
+	newStateTracker(ctx, 2).executing(current.Process.Pid)
+
+	msg, _, ewc := disable(ctx, hEnv, 2)
+	require.Nil(t, ewc)
+	require.Contains(t, msg, "stopped the command of sequence number 1")
+	require.Contains(t, msg, "stopped the command of sequence number 2")
+	require.False(t, processGroupAlive(old.Process.Pid))
+	require.False(t, processGroupAlive(current.Process.Pid))
+
+	for _, seq := range []int{1, 2} {
+		s := requireState(t, seq, state.Completed)
+		require.Contains(t, s.Error, "the extension was disabled")
+	}
+	status, err := readStatus(ctx, hEnv, 1)
+	require.Nil(t, err)
+	require.Equal(t, StatusError, status)
+	_, err = readStatus(ctx, hEnv, 2)
+	require.NotNil(t, err, "the status of the current sequence number is the one of disable")
+}
+
+func Test_runCmd_disabled(t *testing.T) {
+	setTestDataDir(t)
+	setTestCronDir(t)
+	setTestSystemctl(t)
+	_, _, ewc := disable(log.NewContext(log.NewNopLogger()), HandlerEnvironment{}, 0)
+	require.Nil(t, ewc)
+
+	ewc = runCmd(log.NewNopLogger(), tempDir(t), handlerSettings{
+		publicSettings: publicSettings{CommandToExecute: "date"},
+	}, nil, nil)
+	require.NotNil(t, ewc)
+	require.Equal(t, errorutil.CommandExecution_disabled, ewc.ErrorCode)
+}
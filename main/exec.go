@@ -6,31 +6,81 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	vmextension "github.com/Azure/azure-extension-platform/vmextension"
 	errorutil "github.com/Azure/custom-script-extension-linux/pkg/errorutil"
 	"github.com/pkg/errors"
 )
 
+// execOptions controls the limits under which Exec runs a command. The zero
+// value runs the command as the current user without a time limit.
+type execOptions struct {
+	timeout    time.Duration       // terminate the command after this long, if non-zero
+	credential *syscall.Credential // run the command as this user, if set
+	env        []string            // additional environment variables, as "name=value"
+	started    func(pid int)       // called with the pid of the command once it started, if set
+}
+
 // Exec runs the given cmd in /bin/sh, saves its stdout/stderr streams to
 // the specified files. It waits until the execution terminates.
 //
+// The command runs in its own process group, so that the whole group can be
+// killed if opts.timeout is exceeded.
+//
 // On error, an exit code may be returned if it is an exit code error.
 // Given stdout and stderr will be closed upon returning.
-func Exec(cmd, workdir string, stdout, stderr io.WriteCloser) (int, *vmextension.ErrorWithClarification) {
+func Exec(cmd, workdir string, stdout, stderr io.WriteCloser, opts execOptions) (int, *vmextension.ErrorWithClarification) {
+	return run(exec.Command("/bin/sh", "-c", cmd), workdir, stdout, stderr, opts)
+}
+
+// ExecFile runs the executable file at path with args as its arguments, without
+// a shell, like Exec.
+func ExecFile(path string, args []string, workdir string, stdout, stderr io.WriteCloser, opts execOptions) (int, *vmextension.ErrorWithClarification) {
+	return run(exec.Command(path, args...), workdir, stdout, stderr, opts)
+}
+
+// run runs c in workdir for Exec and ExecFile.
+func run(c *exec.Cmd, workdir string, stdout, stderr io.WriteCloser, opts execOptions) (int, *vmextension.ErrorWithClarification) {
 	defer stdout.Close()
 	defer stderr.Close()
 
-	c := exec.Command("/bin/sh", "-c", cmd)
 	c.Dir = workdir
+	if len(opts.env) > 0 {
+		c.Env = append(os.Environ(), opts.env...)
+	}
 	c.Stdout = stdout
 	c.Stderr = stderr
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Credential: opts.credential}
 
-	err := c.Run()
+	if err := start(c); err != nil {
+		return 0, vmextension.NewErrorWithClarificationPtr(errorutil.CommandExecution_failedUnknownError, errors.Wrapf(err, "failed to execute command"))
+	}
+	if opts.started != nil {
+		opts.started(c.Process.Pid)
+	}
+	var killed int32
+	if opts.timeout > 0 {
+		timer := time.AfterFunc(opts.timeout, func() {
+			if syscall.Kill(-c.Process.Pid, syscall.SIGKILL) == nil { // negative pid: whole process group
+				atomic.StoreInt32(&killed, 1)
+			}
+		})
+		defer timer.Stop()
+	}
+
+	err := c.Wait()
 	exitErr, ok := err.(*exec.ExitError)
 	if ok {
 		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			// a command which exited on its own as the timeout fired isn't
+			// reported as timed out
+			if status.Signaled() && atomic.LoadInt32(&killed) == 1 {
+				return 0, vmextension.NewErrorWithClarificationPtr(errorutil.CommandExecution_timedOut, fmt.Errorf("command did not complete within %v and was terminated", opts.timeout))
+			}
 			code := status.ExitStatus()
 			return code, vmextension.NewErrorWithClarificationPtr(errorutil.CommandExecution_failureExitCode, fmt.Errorf("command terminated with exit status=%d", code))
 		}
@@ -42,26 +92,102 @@ func Exec(cmd, workdir string, stdout, stderr io.WriteCloser) (int, *vmextension
 	return 0, vmextension.NewErrorWithClarificationPtr(errorutil.CommandExecution_failedUnknownError, errors.Wrapf(err, "failed to execute command"))
 }
 
+// start starts c. If the command runs as another user, that user may not be
+// able to traverse the parents of c.Dir (/var/lib/waagent is root-only), and
+// the child changes into c.Dir after its credentials are dropped. It changes
+// into the directory opened by the handler instead, through /proc/self/fd:
+// the descriptor is inherited and, unlike a path, needs no access to the
+// parents. The files of the handler in c.Dir must then be passed relative to
+// it, e.g. ./script.sh.
+func start(c *exec.Cmd) error {
+	if c.SysProcAttr.Credential == nil || c.Dir == "" {
+		return c.Start()
+	}
+	d, err := os.Open(c.Dir)
+	if err != nil {
+		return errors.Wrap(err, "failed to open working directory")
+	}
+	defer d.Close()
+	if c.Env == nil {
+		c.Env = os.Environ()
+	}
+	c.Env = append(c.Env, "PWD="+c.Dir)
+	c.Dir = fmt.Sprintf("/proc/self/fd/%d", d.Fd())
+	return c.Start()
+}
+
 // ExecCmdInDir executes the given command in given directory and saves output
 // to ./stdout and ./stderr files (truncates files if exists, creates them if not
-// with 0600/-rw------- permissions).
+// with 0600/-rw------- permissions). It returns the exit code like Exec.
 //
 // Ideally, we execute commands only once per sequence number in custom-script-extension,
 // and save their output under /var/lib/waagent/<dir>/download/<seqnum>/*.
-func ExecCmdInDir(cmd, workdir string) *vmextension.ErrorWithClarification {
+func ExecCmdInDir(cmd, workdir string, opts execOptions) (int, *vmextension.ErrorWithClarification) {
+	outF, errF, ewc := openLogs(workdir)
+	if ewc != nil {
+		return 0, ewc
+	}
+	return Exec(cmd, workdir, outF, errF, opts)
+}
+
+// ExecFileInDir executes the file at path with the given arguments in the given
+// directory and saves its output like ExecCmdInDir.
+func ExecFileInDir(path string, args []string, workdir string, opts execOptions) (int, *vmextension.ErrorWithClarification) {
+	outF, errF, ewc := openLogs(workdir)
+	if ewc != nil {
+		return 0, ewc
+	}
+	return ExecFile(path, args, workdir, outF, errF, opts)
+}
+
+// openLogs opens the stdout and stderr files in workdir for writing (truncates
+// files if exists, creates them if not with 0600/-rw------- permissions). They
+// are opened by the handler, before the command starts as another user, and
+// never through symbolic links, which a command may have left in workdir.
+func openLogs(workdir string) (stdout, stderr *os.File, _ *vmextension.ErrorWithClarification) {
 	outFn, errFn := logPaths(workdir)
 
-	outF, err := os.OpenFile(outFn, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	outF, err := os.OpenFile(outFn, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|syscall.O_NOFOLLOW, 0600)
 	if err != nil {
-		return vmextension.NewErrorWithClarificationPtr(errorutil.Os_FailedToOpenStdOut, errors.Wrapf(err, "failed to open stdout file"))
+		return nil, nil, vmextension.NewErrorWithClarificationPtr(errorutil.Os_FailedToOpenStdOut, errors.Wrapf(err, "failed to open stdout file"))
 	}
-	errF, err := os.OpenFile(errFn, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	errF, err := os.OpenFile(errFn, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|syscall.O_NOFOLLOW, 0600)
 	if err != nil {
-		return vmextension.NewErrorWithClarificationPtr(errorutil.Os_FailedToOpenStdErr, errors.Wrapf(err, "failed to open stderr file"))
+		outF.Close()
+		return nil, nil, vmextension.NewErrorWithClarificationPtr(errorutil.Os_FailedToOpenStdErr, errors.Wrapf(err, "failed to open stderr file"))
 	}
+	return outF, errF, nil
+}
 
-	_, ewc := Exec(cmd, workdir, outF, errF)
-	return ewc
+// resolveFileToExecute returns the path of the file name in dir, relative to
+// dir as "./{path}", making sure that it is a regular file downloaded into dir
+// rather than anything outside of it, also through symbolic links, or the
+// command output. The command runs in dir, whose absolute path the run-as user
+// may not be able to reach.
+func resolveFileToExecute(dir, name string) (string, error) {
+	absDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to resolve the download directory")
+	}
+	path, err := filepath.EvalSymlinks(filepath.Join(absDir, name))
+	if err != nil {
+		return "", errors.Wrapf(err, "fileToExecute %q was not downloaded", name)
+	}
+	rel, err := filepath.Rel(absDir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", errors.Wrapf(errFileToExecuteNotInDir, "%q is outside of the download directory", name)
+	}
+	if stdout, stderr := logPaths(absDir); path == stdout || path == stderr {
+		return "", errors.Wrapf(errFileToExecuteNotInDir, "%q is the output of the command", name)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to access fileToExecute %q", name)
+	}
+	if !fi.Mode().IsRegular() {
+		return "", errors.Wrapf(errFileToExecuteNotInDir, "%q is not a regular file", name)
+	}
+	return "./" + rel, nil
 }
 
 // logPaths returns stdout and stderr file paths for the specified output
@@ -6,7 +6,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
 	"github.com/stretchr/testify/require"
@@ -14,7 +16,7 @@ import (
 
 func TestExec_success(t *testing.T) {
 	v := new(mockFile)
-	ec, err := Exec("date", "/", v, v)
+	ec, err := Exec("date", "/", v, v, execOptions{})
 	require.Nil(t, err, "err: %v -- out: %s", err, v.b.Bytes())
 	require.EqualValues(t, 0, ec)
 }
@@ -24,7 +26,7 @@ func TestExec_success_redirectsStdStreams_closesFds(t *testing.T) {
 	require.False(t, o.closed, "stdout open")
 	require.False(t, e.closed, "stderr open")
 
-	_, err := Exec("/bin/echo 'I am stdout!'>&1; /bin/echo 'I am stderr!'>&2", "/", o, e)
+	_, err := Exec("/bin/echo 'I am stdout!'>&1; /bin/echo 'I am stderr!'>&2", "/", o, e, execOptions{})
 	require.Nil(t, err, "err: %v -- stderr: %s", err, e.b.Bytes())
 	require.Equal(t, "I am stdout!\n", string(o.b.Bytes()))
 	require.Equal(t, "I am stderr!\n", string(e.b.Bytes()))
@@ -33,7 +35,7 @@ func TestExec_success_redirectsStdStreams_closesFds(t *testing.T) {
 }
 
 func TestExec_failure_exitError(t *testing.T) {
-	ec, err := Exec("exit 12", "/", new(mockFile), new(mockFile))
+	ec, err := Exec("exit 12", "/", new(mockFile), new(mockFile), execOptions{})
 	require.Equal(t, err.ErrorCode, errorutil.CommandExecution_failureExitCode)
 	require.NotNil(t, err.Err)
 	require.EqualError(t, err.Err, "command terminated with exit status=12") // error is customized
@@ -41,7 +43,7 @@ func TestExec_failure_exitError(t *testing.T) {
 }
 
 func TestExec_failure_genericError(t *testing.T) {
-	_, err := Exec("date", "/non-existing-path", new(mockFile), new(mockFile))
+	_, err := Exec("date", "/non-existing-path", new(mockFile), new(mockFile), execOptions{})
 	require.Equal(t, err.ErrorCode, errorutil.CommandExecution_failedUnknownError)
 	require.NotNil(t, err.Err)
 	require.Contains(t, err.Err.Error(), "failed to execute command:") // error is wrapped
@@ -51,7 +53,7 @@ func TestExec_failure_fdClosed(t *testing.T) {
 	out := new(mockFile)
 	require.Nil(t, out.Close())
 
-	_, err := Exec("date", "/", out, out)
+	_, err := Exec("date", "/", out, out, execOptions{})
 	require.Equal(t, err.ErrorCode, errorutil.CommandExecution_failedUnknownError)
 	require.NotNil(t, err.Err)
 	require.Contains(t, err.Err.Error(), "file closed") // error is wrapped
@@ -62,7 +64,7 @@ func TestExec_failure_redirectsStdStreams_closesFds(t *testing.T) {
 	require.False(t, o.closed, "stdout open")
 	require.False(t, e.closed, "stderr open")
 
-	_, err := Exec(`/bin/echo 'I am stdout!'>&1; /bin/echo 'I am stderr!'>&2; exit 12`, "/", o, e)
+	_, err := Exec(`/bin/echo 'I am stdout!'>&1; /bin/echo 'I am stderr!'>&2; exit 12`, "/", o, e, execOptions{})
 	require.Equal(t, err.ErrorCode, errorutil.CommandExecution_failureExitCode)
 	require.NotNil(t, err.Err)
 	require.Equal(t, "I am stdout!\n", string(o.b.Bytes()))
@@ -71,12 +73,43 @@ func TestExec_failure_redirectsStdStreams_closesFds(t *testing.T) {
 	require.True(t, e.closed, "stderr closed")
 }
 
+func TestExec_failure_timeout(t *testing.T) {
+	begin := time.Now()
+	_, err := Exec("sleep 30", "/", new(mockFile), new(mockFile), execOptions{timeout: 100 * time.Millisecond})
+	require.NotNil(t, err)
+	require.Equal(t, errorutil.CommandExecution_timedOut, err.ErrorCode)
+	require.Contains(t, err.Err.Error(), "did not complete within 100ms")
+	require.True(t, time.Since(begin) < 10*time.Second, "command should be killed on timeout")
+}
+
+func TestExec_failure_killedBeforeTimeout(t *testing.T) {
+	_, err := Exec("kill -9 $$", "/", new(mockFile), new(mockFile), execOptions{timeout: time.Minute})
+	require.NotNil(t, err)
+	require.NotEqual(t, errorutil.CommandExecution_timedOut, err.ErrorCode, "the timeout didn't kill it")
+}
+
+func TestExecCmdInDir_runAsUser(t *testing.T) {
+	dir := runAsUserDir(t)
+	require.Nil(t, os.Chmod(dir, 0755))
+	wd, err := os.Getwd()
+	require.Nil(t, err)
+
+	_, ewc := ExecCmdInDir("pwd; echo $PWD; id -un", dir, execOptions{credential: &syscall.Credential{Uid: 65534, Gid: 65534}})
+	require.Nil(t, ewc, "runs in dir although its parent is root-only")
+	b, err := ioutil.ReadFile(filepath.Join(dir, "stdout"))
+	require.Nil(t, err)
+	require.Equal(t, dir+"\n"+dir+"\nnobody\n", string(b))
+	after, err := os.Getwd()
+	require.Nil(t, err)
+	require.Equal(t, wd, after, "the working directory of the handler doesn't change")
+}
+
 func TestExecCmdInDir(t *testing.T) {
 	dir, err := ioutil.TempDir("", "")
 	require.Nil(t, err)
 	defer os.RemoveAll(dir)
 
-	ewc := ExecCmdInDir("/bin/echo 'Hello world'", dir)
+	_, ewc := ExecCmdInDir("/bin/echo 'Hello world'", dir, execOptions{})
 	require.Nil(t, ewc)
 	require.True(t, fileExists(t, filepath.Join(dir, "stdout")), "stdout file should be created")
 	require.True(t, fileExists(t, filepath.Join(dir, "stderr")), "stderr file should be created")
@@ -91,20 +124,38 @@ func TestExecCmdInDir(t *testing.T) {
 }
 
 func TestExecCmdInDir_cantOpenStdOut(t *testing.T) {
-	err := ExecCmdInDir("/bin/echo 'Hello world'", "/non-existing-dir")
+	_, err := ExecCmdInDir("/bin/echo 'Hello world'", "/non-existing-dir", execOptions{})
 	require.NotNil(t, err)
 	require.Equal(t, err.ErrorCode, errorutil.Os_FailedToOpenStdOut)
 	require.NotNil(t, err.Err)
 	require.Contains(t, err.Err.Error(), "failed to open stdout file")
 }
 
+func TestExecCmdInDir_stdoutSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	target := filepath.Join(dir, "target")
+	require.Nil(t, ioutil.WriteFile(target, []byte("keep"), 0600))
+	require.Nil(t, os.Symlink(target, filepath.Join(dir, "stdout")))
+
+	_, ewc := ExecCmdInDir("/bin/echo 'Hello world'", dir, execOptions{})
+	require.NotNil(t, ewc)
+	require.Equal(t, errorutil.Os_FailedToOpenStdOut, ewc.ErrorCode)
+	b, err := ioutil.ReadFile(target)
+	require.Nil(t, err)
+	require.Equal(t, "keep", string(b), "the link was followed")
+}
+
 func TestExecCmdInDir_truncates(t *testing.T) {
 	dir, err := ioutil.TempDir("", "")
 	require.Nil(t, err)
 	defer os.RemoveAll(dir)
 
-	require.Nil(t, ExecCmdInDir("/bin/echo '1:out'; /bin/echo '1:err'>&2", dir))
-	require.Nil(t, ExecCmdInDir("/bin/echo '2:out'; /bin/echo '2:err'>&2", dir))
+	_, ewc := ExecCmdInDir("/bin/echo '1:out'; /bin/echo '1:err'>&2", dir, execOptions{})
+	require.Nil(t, ewc)
+	_, ewc = ExecCmdInDir("/bin/echo '2:out'; /bin/echo '2:err'>&2", dir, execOptions{})
+	require.Nil(t, ewc)
 
 	b, err := ioutil.ReadFile(filepath.Join(dir, "stdout"))
 	require.Nil(t, err)
@@ -115,6 +166,62 @@ func TestExecCmdInDir_truncates(t *testing.T) {
 	require.Equal(t, "2:err\n", string(b), "stderr did not truncate")
 }
 
+func TestExecFile_passesArgumentsVerbatim(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "args.sh")
+	require.Nil(t, ioutil.WriteFile(script, []byte("#!/bin/sh\nfor a in \"$@\"; do echo \"[$a]\"; done\n"), 0500))
+
+	o, e := new(mockFile), new(mockFile)
+	_, ewc := ExecFile(script, []string{"a b", "'quoted'", "$(id); rm -rf /", ""}, dir, o, e, execOptions{})
+	require.Nil(t, ewc, "stderr: %s", e.b.Bytes())
+	require.Equal(t, "[a b]\n['quoted']\n[$(id); rm -rf /]\n[]\n", string(o.b.Bytes()))
+	require.True(t, o.closed, "stdout closed")
+}
+
+func TestExecFileInDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "exit.sh")
+	require.Nil(t, ioutil.WriteFile(script, []byte("#!/bin/sh\necho out; echo err >&2; exit $1\n"), 0500))
+
+	_, ewc := ExecFileInDir(script, []string{"0"}, dir, execOptions{})
+	require.Nil(t, ewc)
+	code, ewc := ExecFileInDir(script, []string{"3"}, dir, execOptions{})
+	require.Equal(t, 3, code)
+	require.NotNil(t, ewc)
+	require.Equal(t, errorutil.CommandExecution_failureExitCode, ewc.ErrorCode)
+	b, err := ioutil.ReadFile(filepath.Join(dir, "stderr"))
+	require.Nil(t, err)
+	require.Equal(t, "err\n", string(b))
+}
+
+func Test_resolveFileToExecute(t *testing.T) {
+	parent, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(parent)
+	dir := filepath.Join(parent, "0")
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "sub"), 0700))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a.sh"), nil, 0500))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "sub", "b.sh"), nil, 0500))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "stdout"), nil, 0600))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(parent, "outside.sh"), nil, 0500))
+	require.Nil(t, os.Symlink(filepath.Join(parent, "outside.sh"), filepath.Join(dir, "link.sh")))
+	require.Nil(t, os.Symlink("a.sh", filepath.Join(dir, "inside.sh")))
+
+	for name, want := range map[string]string{"a.sh": "./a.sh", "sub/b.sh": "./sub/b.sh", "./a.sh": "./a.sh", "inside.sh": "./a.sh"} {
+		p, err := resolveFileToExecute(dir, name)
+		require.Nil(t, err, name)
+		require.Equal(t, want, p, name)
+	}
+	for _, name := range []string{"missing.sh", "../outside.sh", "link.sh", "stdout", "sub", "."} {
+		_, err := resolveFileToExecute(dir, name)
+		require.NotNil(t, err, name)
+	}
+}
+
 func Test_logPaths(t *testing.T) {
 	stdout, stderr := logPaths("/tmp")
 	require.Equal(t, "/tmp/stdout", stdout)
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/Azure/azure-extension-platform/vmextension"
+	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
+	"github.com/pkg/errors"
+)
+
+// resolveExecOptions combines the execution limits requested in the handler
+// settings with the ones imposed by the extension policy, which can be nil.
+// Policy values win wherever they are stricter than the customer's settings.
+func resolveExecOptions(cfg handlerSettings, policy *CSEExtensionPolicySettings) (opts execOptions, _ *vmextension.ErrorWithClarification) {
+	timeout := cfg.publicSettings.TimeoutInSeconds
+	if policy != nil && policy.MaxExecutionSeconds > 0 && (timeout == 0 || policy.MaxExecutionSeconds < timeout) {
+		timeout = policy.MaxExecutionSeconds
+	}
+	opts.timeout = time.Duration(timeout) * time.Second
+
+	current, err := user.Current()
+	if err != nil {
+		return opts, vmextension.NewErrorWithClarificationPtr(errorutil.SystemError, errors.Wrap(err, "failed to look up current user"))
+	}
+	runAs := current
+	if name := cfg.publicSettings.RunAsUser; name != "" && name != current.Username {
+		if runAs, err = user.Lookup(name); err != nil {
+			return opts, vmextension.NewErrorWithClarificationPtr(errorutil.CustomerInput_invalidRunAsUser, errors.Wrapf(err, "failed to look up runAsUser %q", name))
+		}
+	}
+
+	if policy != nil {
+		if policy.DenyRoot && runAs.Uid == "0" {
+			return opts, vmextension.NewErrorWithClarificationPtr(errorutil.ExtensionPolicySettings_executionNotAllowed,
+				errors.New("extension policy does not allow running the command as root, please specify a runAsUser"))
+		}
+		if len(policy.AllowedRunAsUsers) > 0 && !containsString(policy.AllowedRunAsUsers, runAs.Username) {
+			return opts, vmextension.NewErrorWithClarificationPtr(errorutil.ExtensionPolicySettings_executionNotAllowed,
+				fmt.Errorf("extension policy does not allow running the command as user %q", runAs.Username))
+		}
+	}
+
+	if runAs.Uid != current.Uid {
+		if opts.credential, err = credentialFor(runAs); err != nil {
+			return opts, vmextension.NewErrorWithClarificationPtr(errorutil.CustomerInput_invalidRunAsUser, err)
+		}
+	}
+	return opts, nil
+}
+
+// credentialFor returns the process credential to run commands as u, including
+// its supplementary groups.
+func credentialFor(u *user.User) (*syscall.Credential, error) {
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid uid for user %q", u.Username)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid gid for user %q", u.Username)
+	}
+	c := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	groups, err := u.GroupIds()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to look up groups of user %q", u.Username)
+	}
+	for _, g := range groups {
+		if id, err := strconv.ParseUint(g, 10, 32); err == nil {
+			c.Groups = append(c.Groups, uint32(id))
+		}
+	}
+	return c, nil
+}
+
+// shareTree gives the group gid access to dir and to everything the handler
+// created under it, so that a command running as another user can read and
+// run the downloaded files and create its own in dir. The tree stays owned by
+// the handler and its directories are sticky: the command can neither change
+// nor replace the files of the handler, e.g. its output files with symbolic
+// links. What the command created in an earlier run is left alone.
+func shareTree(dir string, gid int) error {
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); !ok || int(st.Uid) != os.Geteuid() || fi.Mode()&os.ModeSymlink != 0 {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if err := os.Lchown(path, -1, gid); err != nil {
+			return err
+		}
+		mode := fi.Mode().Perm()
+		if fi.IsDir() {
+			return os.Chmod(path, mode|0070|os.ModeSticky)
+		}
+		// the group may read and run what the owner can, not write to it
+		return os.Chmod(path, mode|(mode&0500)>>3)
+	})
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_resolveExecOptions_noLimits(t *testing.T) {
+	opts, ewc := resolveExecOptions(handlerSettings{}, nil)
+	require.Nil(t, ewc)
+	require.Equal(t, time.Duration(0), opts.timeout)
+	require.Nil(t, opts.credential)
+}
+
+func Test_resolveExecOptions_timeout(t *testing.T) {
+	cfg := handlerSettings{publicSettings: publicSettings{TimeoutInSeconds: 60}}
+
+	opts, ewc := resolveExecOptions(cfg, nil)
+	require.Nil(t, ewc)
+	require.Equal(t, 60*time.Second, opts.timeout)
+
+	// policy is stricter
+	opts, ewc = resolveExecOptions(cfg, &CSEExtensionPolicySettings{MaxExecutionSeconds: 30})
+	require.Nil(t, ewc)
+	require.Equal(t, 30*time.Second, opts.timeout)
+
+	// customer is stricter
+	opts, ewc = resolveExecOptions(cfg, &CSEExtensionPolicySettings{MaxExecutionSeconds: 120})
+	require.Nil(t, ewc)
+	require.Equal(t, 60*time.Second, opts.timeout)
+
+	// only policy has a limit
+	opts, ewc = resolveExecOptions(handlerSettings{}, &CSEExtensionPolicySettings{MaxExecutionSeconds: 120})
+	require.Nil(t, ewc)
+	require.Equal(t, 120*time.Second, opts.timeout)
+}
+
+func Test_resolveExecOptions_unknownUser(t *testing.T) {
+	_, ewc := resolveExecOptions(handlerSettings{publicSettings: publicSettings{RunAsUser: "no-such-user-0xdeadbeef"}}, nil)
+	require.NotNil(t, ewc)
+	require.Equal(t, errorutil.CustomerInput_invalidRunAsUser, ewc.ErrorCode)
+}
+
+func Test_resolveExecOptions_runAsUser(t *testing.T) {
+	opts, ewc := resolveExecOptions(handlerSettings{publicSettings: publicSettings{RunAsUser: "nobody"}}, nil)
+	require.Nil(t, ewc)
+	require.NotNil(t, opts.credential)
+	require.NotEqual(t, uint32(0), opts.credential.Uid)
+}
+
+func Test_resolveExecOptions_allowedRunAsUsers(t *testing.T) {
+	policy := &CSEExtensionPolicySettings{AllowedRunAsUsers: []string{"nobody"}}
+
+	_, ewc := resolveExecOptions(handlerSettings{publicSettings: publicSettings{RunAsUser: "nobody"}}, policy)
+	require.Nil(t, ewc)
+
+	_, ewc = resolveExecOptions(handlerSettings{publicSettings: publicSettings{RunAsUser: "root"}}, policy)
+	require.NotNil(t, ewc)
+	require.Equal(t, errorutil.ExtensionPolicySettings_executionNotAllowed, ewc.ErrorCode)
+	require.Contains(t, ewc.Err.Error(), `"root"`)
+}
+
+func Test_resolveExecOptions_denyRoot(t *testing.T) {
+	policy := &CSEExtensionPolicySettings{DenyRoot: true}
+
+	_, ewc := resolveExecOptions(handlerSettings{publicSettings: publicSettings{RunAsUser: "root"}}, policy)
+	require.NotNil(t, ewc)
+	require.Equal(t, errorutil.ExtensionPolicySettings_executionNotAllowed, ewc.ErrorCode)
+
+	_, ewc = resolveExecOptions(handlerSettings{publicSettings: publicSettings{RunAsUser: "nobody"}}, policy)
+	require.Nil(t, ewc)
+}
+
+func Test_CSEExtensionPolicySettings_ValidateFormat_execution(t *testing.T) {
+	require.Error(t, CSEExtensionPolicySettings{MaxExecutionSeconds: -1}.ValidateFormat())
+	require.Error(t, CSEExtensionPolicySettings{DenyRoot: true, AllowedRunAsUsers: []string{"root"}}.ValidateFormat())
+	require.NoError(t, CSEExtensionPolicySettings{DenyRoot: true, AllowedRunAsUsers: []string{"nobody"}, MaxExecutionSeconds: 10}.ValidateFormat())
+}
+
+func Test_shareTree(t *testing.T) {
+	dir := runAsUserDir(t)
+	outside := filepath.Join(filepath.Dir(dir), "outside")
+	require.Nil(t, ioutil.WriteFile(outside, nil, 0600))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "run.sh"), nil, 0500))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "data"), nil, 0600))
+	require.Nil(t, os.Mkdir(filepath.Join(dir, "sub"), 0700))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "sub", "f"), nil, 0600))
+	require.Nil(t, os.Symlink(outside, filepath.Join(dir, "link")))
+	// left by the command in an earlier run
+	require.Nil(t, os.Mkdir(filepath.Join(dir, "theirs"), 0700))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "theirs", "f"), nil, 0600))
+	require.Nil(t, os.Lchown(filepath.Join(dir, "theirs"), 65534, 65534))
+
+	require.Nil(t, shareTree(dir, 65534))
+	for path, mode := range map[string]os.FileMode{
+		dir:                               0770 | os.ModeDir | os.ModeSticky,
+		filepath.Join(dir, "run.sh"):      0550,
+		filepath.Join(dir, "data"):        0640,
+		filepath.Join(dir, "sub"):         0770 | os.ModeDir | os.ModeSticky,
+		filepath.Join(dir, "sub", "f"):    0640,
+		filepath.Join(dir, "theirs", "f"): 0600,
+		outside:                           0600,
+	} {
+		fi, err := os.Lstat(path)
+		require.Nil(t, err)
+		require.Equal(t, mode, fi.Mode(), path)
+		st := fi.Sys().(*syscall.Stat_t)
+		if path == outside || filepath.Base(filepath.Dir(path)) == "theirs" {
+			require.EqualValues(t, 0, st.Gid, path)
+			continue
+		}
+		require.EqualValues(t, 0, st.Uid, "%s stays owned by the handler", path)
+		require.EqualValues(t, 65534, st.Gid, path)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	vmextension "github.com/Azure/azure-extension-platform/vmextension"
+	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
+	"github.com/Azure/custom-script-extension-linux/pkg/state"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// bootIDPath holds an id which changes on every boot, so that the pid of a
+// command started before a reboot isn't mistaken for a running process.
+var bootIDPath = "/proc/sys/kernel/random/boot_id"
+
+// stateAction is what enablePre decides to do with a sequence number from
+// the state an earlier run left.
+type stateAction int
+
+const (
+	// stateNone leaves the decision to the rerun policy: there is no state,
+	// or the sequence number completed.
+	stateNone stateAction = iota
+	// stateResume runs the sequence number again, an earlier run stopped
+	// before starting the command.
+	stateResume
+	// stateRunning leaves the sequence number alone, its command is still
+	// running.
+	stateRunning
+	// stateInterrupted reports that the command of the sequence number was
+	// interrupted, e.g. by a reboot, instead of running it again.
+	stateInterrupted
+)
+
+// skipResult is the result enable reports for a sequence number without
+// running it.
+type skipResult struct {
+	msg string
+	ewc *vmextension.ErrorWithClarification
+}
+
+// skipEnable is set by enablePre when enable must report a result for the
+// sequence number instead of running it, since the sequence number has no
+// status yet.
+var skipEnable *skipResult
+
+// stateTracker records the phases of a sequence number in its state file.
+// Failing to record a phase is logged and doesn't fail the sequence number.
+// The methods of a nil *stateTracker do nothing.
+type stateTracker struct {
+	ctx   log.Logger
+	path  string
+	state state.State
+}
+
+// newStateTracker returns the tracker of seqNum, which is in the Received
+// phase.
+func newStateTracker(ctx log.Logger, seqNum int) *stateTracker {
+	return &stateTracker{
+		ctx:   ctx,
+		path:  instanceStatePath(seqNum),
+		state: state.State{SeqNum: seqNum, Phase: state.Received},
+	}
+}
+
+// set moves the sequence number to phase.
+func (t *stateTracker) set(phase state.Phase) {
+	if t == nil {
+		return
+	}
+	t.state.Phase = phase
+	t.state.Pid, t.state.BootID = 0, ""
+	t.save()
+}
+
+// executing records that the command started as pid.
+func (t *stateTracker) executing(pid int) {
+	if t == nil {
+		return
+	}
+	t.state.Phase = state.Executing
+	t.state.Pid, t.state.BootID = pid, bootID()
+	t.state.ExitCode = nil
+	t.save()
+}
+
+// exited records the exit code of the command. An enable which terminated
+// the command recorded itself in the state file before, it is kept.
+func (t *stateTracker) exited(code int) {
+	if t == nil {
+		return
+	}
+	if cur, err := state.Read(t.path); err == nil && cur != nil && cur.SupersededBy != 0 {
+		t.state.SupersededBy = cur.SupersededBy
+	}
+	t.state.ExitCode = &code
+	t.save()
+}
+
+// supersededBy returns the sequence number whose enable terminated the
+// command, or 0.
+func (t *stateTracker) supersededBy() int {
+	if t == nil {
+		return 0
+	}
+	return t.state.SupersededBy
+}
+
+// completed records that the result of the sequence number, the error if it
+// failed, is reported.
+func (t *stateTracker) completed(ewc *vmextension.ErrorWithClarification) {
+	if t == nil {
+		return
+	}
+	if ewc != nil {
+		t.state.Error = ewc.Error()
+	}
+	t.set(state.Completed)
+}
+
+func (t *stateTracker) save() {
+	setHeartbeatPhase(t.state.Phase)
+	if err := os.MkdirAll(filepath.Dir(t.path), 0700); err != nil {
+		t.ctx.Log("event", "failed to save state", "error", err)
+		return
+	}
+	if err := state.Write(t.path, t.state); err != nil {
+		t.ctx.Log("event", "failed to save state", "error", err)
+		return
+	}
+	t.ctx.Log("event", "state saved", "phase", t.state.Phase)
+}
+
+// checkState decides from the state an earlier run left for seqNum whether it
+// must resume, skip or report it. It returns the state, if any.
+func checkState(ctx log.Logger, seqNum int) (stateAction, *state.State) {
+	st, err := state.Read(instanceStatePath(seqNum))
+	if err != nil {
+		ctx.Log("event", "could not read state", "error", err)
+		return stateNone, nil
+	}
+	if st == nil || st.Phase == state.Completed {
+		return stateNone, st
+	}
+	ctx.Log("event", "found state of an earlier run", "phase", st.Phase, "pid", st.Pid)
+	if st.Phase != state.Executing {
+		return stateResume, st
+	}
+	if st.Pid != 0 && st.BootID == bootID() && processGroupAlive(st.Pid) {
+		return stateRunning, st
+	}
+	return stateInterrupted, st
+}
+
+// interruptedError returns the error reported for a sequence number whose
+// command was interrupted.
+func interruptedError(st *state.State) *vmextension.ErrorWithClarification {
+	return vmextension.NewErrorWithClarificationPtr(errorutil.CommandExecution_interruptedByVmShutdown,
+		errors.Errorf("the command (pid %d) was interrupted before it completed, e.g. by a reboot, and was not run again", st.Pid))
+}
+
+// processGroupAlive returns true if the process group led by pid, as the
+// commands are started, still has processes.
+func processGroupAlive(pid int) bool {
+	err := syscall.Kill(-pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// bootID returns the id of the current boot, or an empty string if unknown.
+func bootID() string {
+	b, err := ioutil.ReadFile(bootIDPath)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
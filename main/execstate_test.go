@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
+	"github.com/Azure/custom-script-extension-linux/pkg/state"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_stateTracker(t *testing.T) {
+	setTestDataDir(t)
+	st := newStateTracker(log.NewNopLogger(), 3)
+	require.Equal(t, filepath.Join(dataDir, "state", "3.state"), st.path)
+
+	st.set(state.Downloaded)
+	requireState(t, 3, state.Downloaded)
+
+	st.executing(42)
+	s := requireState(t, 3, state.Executing)
+	require.Equal(t, 42, s.Pid)
+	require.Equal(t, bootID(), s.BootID)
+
+	st.exited(2)
+	st.completed(nil)
+	s = requireState(t, 3, state.Completed)
+	require.Equal(t, 0, s.Pid)
+	require.Equal(t, 2, *s.ExitCode)
+	require.Empty(t, s.Error)
+
+	var nilTracker *stateTracker
+	nilTracker.set(state.Received) // does nothing
+}
+
+func Test_checkState(t *testing.T) {
+	setTestDataDir(t)
+	nop := log.NewNopLogger()
+
+	action, _ := checkState(nop, 0)
+	require.Equal(t, stateNone, action, "no state")
+
+	st := newStateTracker(nop, 0)
+	for _, phase := range []state.Phase{state.Received, state.PolicyChecked, state.Downloaded} {
+		st.set(phase)
+		action, _ = checkState(nop, 0)
+		require.Equal(t, stateResume, action, phase)
+	}
+
+	// the command still runs in its process group
+	c := exec.Command("sleep", "30")
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	require.Nil(t, c.Start())
+	st.executing(c.Process.Pid)
+	action, _ = checkState(nop, 0)
+	require.Equal(t, stateRunning, action)
+
+	// the same pid before a reboot
+	st.state.BootID = "another boot"
+	st.save()
+	action, _ = checkState(nop, 0)
+	require.Equal(t, stateInterrupted, action)
+
+	c.Process.Kill()
+	c.Wait()
+	st.executing(c.Process.Pid)
+	action, s := checkState(nop, 0)
+	require.Equal(t, stateInterrupted, action)
+	ewc := interruptedError(s)
+	require.Equal(t, errorutil.CommandExecution_interruptedByVmShutdown, ewc.ErrorCode)
+	require.Contains(t, ewc.Err.Error(), "was interrupted")
+
+	st.completed(ewc)
+	action, s = checkState(nop, 0)
+	require.Equal(t, stateNone, action)
+	require.Contains(t, s.Error, "was interrupted")
+}
+
+func Test_checkState_invalid(t *testing.T) {
+	setTestDataDir(t)
+	path := instanceStatePath(0)
+	newStateTracker(log.NewNopLogger(), 0).set(state.Received)
+	require.Nil(t, ioutil.WriteFile(path, []byte("{"), 0600))
+
+	action, _ := checkState(log.NewNopLogger(), 0)
+	require.Equal(t, stateNone, action, "a broken state leaves the decision to the rerun policy")
+}
+
+func Test_runCmd_recordsState(t *testing.T) {
+	setTestDataDir(t)
+	st := newStateTracker(log.NewNopLogger(), 1)
+
+	ewc := runCmd(log.NewNopLogger(), tempDir(t), handlerSettings{
+		publicSettings: publicSettings{CommandToExecute: "exit 7"},
+	}, nil, st)
+	require.NotNil(t, ewc)
+	s := requireState(t, 1, state.Executing)
+	require.NotZero(t, s.Pid)
+	require.Equal(t, 7, *s.ExitCode)
+}
+
+// setTestDataDir points dataDir to a new temporary directory.
+func setTestDataDir(t *testing.T) {
+	orig := dataDir
+	dataDir = tempDir(t)
+	t.Cleanup(func() { dataDir = orig })
+}
+
+func requireState(t *testing.T, seqNum int, phase state.Phase) *state.State {
+	s, err := state.Read(instanceStatePath(seqNum))
+	require.Nil(t, err)
+	require.NotNil(t, s)
+	require.Equal(t, seqNum, s.SeqNum)
+	require.Equal(t, phase, s.Phase)
+	return s
+}
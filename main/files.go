@@ -14,6 +14,7 @@ import (
 	"github.com/Azure/custom-script-extension-linux/pkg/blobutil"
 	"github.com/Azure/custom-script-extension-linux/pkg/download"
 	"github.com/Azure/custom-script-extension-linux/pkg/preprocess"
+	"github.com/Azure/custom-script-extension-linux/pkg/signature"
 	"github.com/Azure/custom-script-extension-linux/pkg/urlutil"
 	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
@@ -25,25 +26,51 @@ import (
 // specified existing directory, which must be the path to the saved file. Then
 // it post-processes file based on heuristics.
 // If extension policy settings manager is provided, the downloaded file will be validated against the policy.
-func downloadAndProcessURL(ctx *log.Context, url, downloadDir string, cfg *handlerSettings, eps *extensionpolicysettings.ExtensionPolicySettingsManager[CSEExtensionPolicySettings]) *vmextension.ErrorWithClarification {
+// If a signature verifier is provided, the file as downloaded is verified against
+// the signature published next to it, and the kind of signature is returned.
+func downloadAndProcessURL(ctx *log.Context, url, downloadDir string, cfg *handlerSettings, eps *extensionpolicysettings.ExtensionPolicySettingsManager[CSEExtensionPolicySettings], v *signature.Verifier) (verified string, _ *vmextension.ErrorWithClarification) {
 	fn, err := urlToFileName(url)
 	if err != nil {
-		return vmextension.NewErrorWithClarificationPtr(errorutil.CustomerInput_invalidFileUris, err)
+		return "", vmextension.NewErrorWithClarificationPtr(errorutil.CustomerInput_invalidFileUris, err)
 	}
 
 	if !urlutil.IsValidUrl(url) {
-		return vmextension.NewErrorWithClarificationPtr(errorutil.CustomerInput_invalidFileUris, fmt.Errorf("[REDACTED] is not a valid url"))
+		return "", vmextension.NewErrorWithClarificationPtr(errorutil.CustomerInput_invalidFileUris, fmt.Errorf("[REDACTED] is not a valid url"))
 	}
 
 	dl, ewc := getDownloaders(url, cfg.StorageAccountName, cfg.StorageAccountKey, cfg.ManagedIdentity)
 	if ewc != nil {
-		return ewc
+		return "", ewc
 	}
 
 	fp := filepath.Join(downloadDir, fn)
 	const mode = 0500 // we assume users download scripts to execute
 	if _, ewc := download.SaveTo(ctx, dl, fp, mode); ewc != nil {
-		return ewc
+		return "", ewc
+	}
+
+	var settings *CSEExtensionPolicySettings
+	if eps != nil {
+		if settings, err = eps.GetSettings(); err != nil {
+			return "", vmextension.NewErrorWithClarificationPtr(errorutil.SystemError, fmt.Errorf("failed to get extension policy settings: %w", err))
+		}
+		if settings == nil {
+			return "", vmextension.NewErrorWithClarificationPtr(errorutil.SystemError, fmt.Errorf("extension policy settings manager initialized, but settings not properly loaded."))
+		}
+	}
+
+	// the signature is over the file as published, verify before post-processing
+	if v != nil {
+		if verified, ewc = verifyFileSignature(ctx, v, url, fp, cfg); ewc != nil {
+			ewc.Err = errors.Wrapf(ewc.Err, "signature verification of '%s' failed", fn)
+			if settings != nil {
+				if herr := handleBlockedFile(ctx, fp, url, ewc.Err.Error(), settings, filepath.Join(dataDir, quarantineDir)); herr != nil {
+					ctx.Log("event", "failed to handle blocked file", "file", fn, "error", herr)
+				}
+			}
+			return "", ewc
+		}
+		ctx.Log("event", "verified file signature", "file", fn, "kind", verified)
 	}
 
 	if cfg.SkipDos2Unix == false {
@@ -51,27 +78,20 @@ func downloadAndProcessURL(ctx *log.Context, url, downloadDir string, cfg *handl
 	}
 
 	if err != nil {
-		return vmextension.NewErrorWithClarificationPtr(errorutil.SystemError, errors.Wrapf(err, "failed to post-process '%s'", fn))
+		return "", vmextension.NewErrorWithClarificationPtr(errorutil.SystemError, errors.Wrapf(err, "failed to post-process '%s'", fn))
 	}
 
-	if eps != nil {
-		settings, err := eps.GetSettings()
-		if err != nil {
-			return vmextension.NewErrorWithClarificationPtr(errorutil.SystemError, fmt.Errorf("failed to get extension policy settings: %w", err))
-		}
-		if settings == nil {
-			return vmextension.NewErrorWithClarificationPtr(errorutil.SystemError, fmt.Errorf("extension policy settings manager initialized, but settings not properly loaded."))
-		}
-
-		if len(settings.AllowedScripts) > 0 {
-			if err := extensionpolicysettings.ValidateFileHashInAllowlist(fp, settings.AllowedScripts, extensionpolicysettings.HashTypeSHA256); err != nil {
-				// TO DO: Consider whether to delete the blocked file.
-				return vmextension.NewErrorWithClarificationPtr(errorutil.SystemError, fmt.Errorf("Validation of script '%s' against policy-allowlist failed: %w.", fn, err))
+	if settings != nil && len(settings.AllowedScripts) > 0 {
+		if err := extensionpolicysettings.ValidateFileHashInAllowlist(fp, settings.AllowedScripts, extensionpolicysettings.HashTypeSHA256); err != nil {
+			err = fmt.Errorf("Validation of script '%s' against policy-allowlist failed: %w.", fn, err)
+			if herr := handleBlockedFile(ctx, fp, url, err.Error(), settings, filepath.Join(dataDir, quarantineDir)); herr != nil {
+				ctx.Log("event", "failed to handle blocked file", "file", fn, "error", herr)
 			}
+			return "", vmextension.NewErrorWithClarificationPtr(errorutil.SystemError, err)
 		}
 	}
 
-	return nil
+	return verified, nil
 }
 
 // getDownloader returns a downloader for the given URL based on whether the
@@ -76,3 +76,29 @@ func ParseHandlerEnv(b []byte) (he HandlerEnvironment, _ error) {
 	}
 	return hf[0], nil
 }
+
+const (
+	// defaultLogFolder is where the handler logs if the handler environment
+	// has no log folder.
+	defaultLogFolder = "/var/log/azure/custom-script"
+
+	// handlerLogFile is the file in the log folder the handler logs to.
+	handlerLogFile = "handler.log"
+)
+
+// openHandlerLog opens the handler log in the log folder of h for appending,
+// creating it if needed.
+func openHandlerLog(h HandlerEnvironment) (*os.File, error) {
+	dir := h.HandlerEnvironment.LogFolder
+	if dir == "" {
+		dir = defaultLogFolder
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log folder: %v", err)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, handlerLogFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open handler log: %v", err)
+	}
+	return f, nil
+}
@@ -4,9 +4,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"path/filepath"
+	"strings"
 
 	"github.com/Azure/azure-extension-platform/vmextension"
 	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
+	"github.com/Azure/custom-script-extension-linux/pkg/secrets"
 	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
 )
@@ -18,6 +20,10 @@ var (
 	errFileUrisTooMany              = errors.New("'fileUris' were specified both in public and protected settings; it must be specified only once")
 	errCmdAndScript                 = errors.New("'commandToExecute' and 'script' were both specified, but only one is validate at a time")
 	errCmdMissing                   = errors.New("'commandToExecute' is not specified")
+	errFileToExecuteAndCmd          = errors.New("'fileToExecute' must not be specified with 'commandToExecute' or 'script'")
+	errArgumentsWithoutFile         = errors.New("'arguments' and 'protectedArguments' can only be specified with 'fileToExecute'")
+	errFileToExecuteNotInDir        = errors.New("'fileToExecute' must be the relative path of a downloaded file")
+	errInlineFilesTooMany           = errors.New("'inlineFiles' and 'inlineBundle' must each be specified only once, in public or protected settings")
 	errUsingBothKeyAndMsi           = errors.New("'storageAccountName' or 'storageAccountKey' must not be specified with 'managedServiceIdentity'")
 	errUsingBothClientIdAndObjectId = errors.New("only one of 'clientId' or 'objectId' must be specified with 'managedServiceIdentity'")
 )
@@ -35,6 +41,12 @@ func (s *handlerSettings) commandToExecute() string {
 	return s.protectedSettings.CommandToExecute
 }
 
+// arguments returns the arguments of fileToExecute: the public ones followed
+// by the protected ones.
+func (s *handlerSettings) arguments() []string {
+	return append(append([]string{}, s.publicSettings.Arguments...), s.protectedSettings.ProtectedArguments...)
+}
+
 func (s *handlerSettings) script() string {
 	if s.publicSettings.Script != "" {
 		return s.publicSettings.Script
@@ -42,6 +54,22 @@ func (s *handlerSettings) script() string {
 	return s.protectedSettings.Script
 }
 
+// inlineFiles returns the inline files of the public settings, or else of
+// the protected settings.
+func (s *handlerSettings) inlineFiles() map[string]inlineFile {
+	if len(s.publicSettings.InlineFiles) > 0 {
+		return s.publicSettings.InlineFiles
+	}
+	return s.protectedSettings.InlineFiles
+}
+
+func (s *handlerSettings) inlineBundle() string {
+	if s.publicSettings.InlineBundle != "" {
+		return string(s.publicSettings.InlineBundle)
+	}
+	return string(s.protectedSettings.InlineBundle)
+}
+
 func (s *handlerSettings) fileUrls() []string {
 	if len(s.publicSettings.FileURLs) > 0 {
 		return s.publicSettings.FileURLs
@@ -50,68 +78,179 @@ func (s *handlerSettings) fileUrls() []string {
 }
 
 // validate makes logical validation on the handlerSettings which already passed
-// the schema validation.
+// the schema validation. Every problem found is reported, the error code is the
+// one of the first problem.
 func (h handlerSettings) validate() *vmextension.ErrorWithClarification {
-	if h.commandToExecute() == "" && h.script() == "" {
-		return vmextension.NewErrorWithClarificationPtr(errorutil.CustomerInput_commandToExecuteAndScriptNotSpecified, errCmdMissing)
+	var ewc *vmextension.ErrorWithClarification
+	var problems settingsErrors
+	add := func(code int, err error) {
+		if ewc == nil {
+			ewc = vmextension.NewErrorWithClarificationPtr(code, err)
+		}
+		problems = append(problems, err.Error())
+	}
+
+	fileToExecute := h.publicSettings.FileToExecute
+	if h.commandToExecute() == "" && h.script() == "" && fileToExecute == "" {
+		add(errorutil.CustomerInput_commandToExecuteAndScriptNotSpecified, errCmdMissing)
+	}
+	if fileToExecute != "" && (h.commandToExecute() != "" || h.script() != "") {
+		add(errorutil.CustomerInput_fileToExecuteAndCommandBothSpecified, errFileToExecuteAndCmd)
+	}
+	if fileToExecute == "" && len(h.arguments()) > 0 {
+		add(errorutil.CustomerInput_argumentsWithoutFileToExecute, errArgumentsWithoutFile)
+	}
+	if fileToExecute != "" && (filepath.IsAbs(fileToExecute) || strings.HasPrefix(filepath.Clean(fileToExecute), "..")) {
+		add(errorutil.CustomerInput_invalidFileToExecute, errFileToExecuteNotInDir)
 	}
 	if h.publicSettings.CommandToExecute != "" && h.protectedSettings.CommandToExecute != "" {
-		return vmextension.NewErrorWithClarificationPtr(errorutil.CustomerInput_commandToExecuteSpecifiedInTwoPlaces, errCmdTooMany)
+		add(errorutil.CustomerInput_commandToExecuteSpecifiedInTwoPlaces, errCmdTooMany)
 	}
 
 	if h.publicSettings.Script != "" && h.protectedSettings.Script != "" {
-		return vmextension.NewErrorWithClarificationPtr(errorutil.CustomerInput_scriptSpecifiedInTwoPlaces, errScriptTooMany)
+		add(errorutil.CustomerInput_scriptSpecifiedInTwoPlaces, errScriptTooMany)
 	}
 
 	if (h.publicSettings.FileURLs != nil && len(h.publicSettings.FileURLs) > 0) && (h.protectedSettings.FileURLs != nil && len(h.protectedSettings.FileURLs) > 0) {
-		return vmextension.NewErrorWithClarificationPtr(errorutil.CustomerInput_fileUrisSpecifiedInTwoPlaces, errFileUrisTooMany)
+		add(errorutil.CustomerInput_fileUrisSpecifiedInTwoPlaces, errFileUrisTooMany)
+	}
+
+	if (len(h.publicSettings.InlineFiles) > 0 && len(h.protectedSettings.InlineFiles) > 0) ||
+		(h.publicSettings.InlineBundle != "" && h.protectedSettings.InlineBundle != "") {
+		add(errorutil.CustomerInput_inlineFilesSpecifiedInTwoPlaces, errInlineFilesTooMany)
+	}
+	for _, name := range sortedInlineFileNames(h) {
+		if err := validateInlineFileName(name); err != nil {
+			add(errorutil.CustomerInput_invalidInlineFile, err)
+		}
 	}
 
 	if h.commandToExecute() != "" && h.script() != "" {
-		return vmextension.NewErrorWithClarificationPtr(errorutil.CustomerInput_commandToExecuteAndScriptBothSpecified, errCmdAndScript)
+		add(errorutil.CustomerInput_commandToExecuteAndScriptBothSpecified, errCmdAndScript)
+	}
+
+	if h.publicSettings.Schedule != "" {
+		if _, err := parseSchedule(h.publicSettings.Schedule); err != nil {
+			add(errorutil.CustomerInput_invalidSchedule, err)
+		}
 	}
 
 	if (h.protectedSettings.StorageAccountName != "") !=
 		(h.protectedSettings.StorageAccountKey != "") {
-		return vmextension.NewErrorWithClarificationPtr(errorutil.CustomerInput_incompleteStorageCreds, errStoragePartialCredentials)
+		add(errorutil.CustomerInput_incompleteStorageCreds, errStoragePartialCredentials)
 	}
 
 	if (h.protectedSettings.StorageAccountKey != "" || h.protectedSettings.StorageAccountName != "") && h.protectedSettings.ManagedIdentity != nil {
-		return vmextension.NewErrorWithClarificationPtr(errorutil.CustomerInput_storageCredsAndMIBothSpecified, errUsingBothKeyAndMsi)
+		add(errorutil.CustomerInput_storageCredsAndMIBothSpecified, errUsingBothKeyAndMsi)
 	}
 
 	if h.protectedSettings.ManagedIdentity != nil {
 		if h.protectedSettings.ManagedIdentity.ClientId != "" && h.protectedSettings.ManagedIdentity.ObjectId != "" {
-			return vmextension.NewErrorWithClarificationPtr(errorutil.CustomerInput_clientIdObjectIdBothSpecified, errUsingBothClientIdAndObjectId)
+			add(errorutil.CustomerInput_clientIdObjectIdBothSpecified, errUsingBothClientIdAndObjectId)
 		}
 	}
 
-	return nil
+	for _, name := range sortedEnvNames(h) {
+		if !envNameRegex.MatchString(name) {
+			add(errorutil.CustomerInput_invalidEnvironmentVariable, fmt.Errorf("invalid environment variable name %q", name))
+		} else if strings.HasPrefix(name, secretEnvPrefix) {
+			add(errorutil.CustomerInput_invalidEnvironmentVariable, fmt.Errorf("environment variable names starting with %s are reserved", secretEnvPrefix))
+		}
+		if ref := h.protectedSettings.EnvironmentVariables[name].SecretRef; ref != "" {
+			if err := secrets.ValidateName(ref); err != nil {
+				add(errorutil.CustomerInput_invalidSecretRef, err)
+			}
+		}
+	}
+	for _, m := range secretRefRegex.FindAllStringSubmatch(h.commandToExecute(), -1) {
+		if err := secrets.ValidateName(m[1]); err != nil {
+			add(errorutil.CustomerInput_invalidSecretRef, err)
+		}
+	}
+
+	if len(problems) > 1 {
+		ewc.Err = problems
+	}
+	return ewc
+}
+
+// settingsErrors is the list of every problem found in the handler settings.
+type settingsErrors []string
+
+// maxSettingsErrorsLen caps the length of the message listing the problems, so
+// that it fits in the .status file.
+const maxSettingsErrorsLen = 2 * 1024
+
+func (e settingsErrors) Error() string {
+	if len(e) == 1 {
+		return e[0]
+	}
+	msg := fmt.Sprintf("%d problems found", len(e))
+	for i, p := range e {
+		if len(msg)+len(p) > maxSettingsErrorsLen {
+			return msg + fmt.Sprintf("\n... and %d more", len(e)-i)
+		}
+		msg += "\n- " + p
+	}
+	return msg
+}
+
+// problemsOf returns the problems err is made of.
+func problemsOf(err error) settingsErrors {
+	if e, ok := errors.Cause(err).(settingsErrors); ok {
+		return e
+	}
+	return settingsErrors{err.Error()}
 }
 
 // publicSettings is the type deserialized from public configuration section of
-// the extension handler. This should be in sync with publicSettingsSchema.
+// the extension handler. Its JSON schema is generated from the field tags, see
+// schema.go.
 type publicSettings struct {
-	SkipDos2Unix     bool     `json:"skipDos2Unix"`
-	CommandToExecute string   `json:"commandToExecute"`
-	Script           string   `json:"script"`
-	FileURLs         []string `json:"fileUris"`
+	SkipDos2Unix         bool     `json:"skipDos2Unix" description:"Skip DOS2UNIX and BOM removal for download files and script"`
+	CommandToExecute     string   `json:"commandToExecute" description:"Command to be executed"`
+	Script               string   `json:"script" description:"Script to be executed"`
+	FileURLs             []string `json:"fileUris" description:"List of files to be downloaded" format:"uri"`
+	Timestamp            int      `json:"timestamp" description:"An integer, intended to trigger re-execution of the script when changed"`
+	RerunPolicy          string   `json:"rerunPolicy" description:"When to run the settings again: on each new sequence number (onSeqNumChange, the default), only when their content changed (onContentChange), or on every enable (always)" pattern:"^(onSeqNumChange|onContentChange|always)$"`
+	ConcurrentEnable     string   `json:"concurrentEnable" description:"What enable does while another enable invocation runs: wait until it completes (wait, the default) or report this one as skipped (skip)" pattern:"^(wait|skip)$"`
+	LockTimeoutInSeconds int      `json:"lockTimeoutInSeconds" description:"Maximum number of seconds to wait for another enable invocation, 1800 by default" minimum:"1"`
+	OnNewSequenceNumber  string   `json:"onNewSequenceNumber" description:"What enable does with the command of an older sequence number which still runs: terminate it (supersede, the default) or wait until it completes (queue)" pattern:"^(supersede|queue)$"`
+	SupersedeSignal      string   `json:"supersedeSignal" description:"Signal sent to the process group of a superseded command, SIGTERM by default. It is killed if it still runs 30 seconds later" pattern:"^SIG(TERM|INT|HUP|QUIT|KILL|USR1|USR2)$"`
+	Schedule             string   `json:"schedule" description:"Run the command again on this schedule: a cron expression of five numeric fields, @hourly, @daily, @weekly, @monthly, or an interval which divides an hour or a day such as 15m or 2h" minLength:"1"`
+	RunOnBoot            bool     `json:"runOnBoot" description:"Run the command again on each boot of the VM"`
+	FileToExecute        string   `json:"fileToExecute" description:"Name of a downloaded file to execute directly with the arguments, without a shell" minLength:"1"`
+	Arguments            []string `json:"arguments" description:"Arguments of fileToExecute"`
+	RunAsUser            string   `json:"runAsUser" description:"Name of the local user to run the command as" minLength:"1"`
+	TimeoutInSeconds     int      `json:"timeoutInSeconds" description:"Maximum number of seconds the command may run before it is terminated" minimum:"0"`
+
+	InlineFiles  map[string]inlineFile `json:"inlineFiles" description:"Files to write into the download directory, by relative path, with base64 encoded (optionally gzip, zstd, xz or bzip2 compressed) content"`
+	InlineBundle base64String          `json:"inlineBundle" description:"Base64 encoded tar.gz archive of files to extract into the download directory"`
 }
 
 // protectedSettings is the type decoded and deserialized from protected
-// configuration section. This should be in sync with protectedSettingsSchema.
+// configuration section. Its JSON schema is generated from the field tags, see
+// schema.go.
 type protectedSettings struct {
-	CommandToExecute   string            `json:"commandToExecute"`
-	Script             string            `json:"script"`
-	FileURLs           []string          `json:"fileUris"`
-	StorageAccountName string            `json:"storageAccountName"`
-	StorageAccountKey  string            `json:"storageAccountKey"`
-	ManagedIdentity    *clientOrObjectId `json:"managedIdentity"`
+	CommandToExecute   string            `json:"commandToExecute" description:"Command to be executed"`
+	Script             string            `json:"script" description:"Script to be executed"`
+	FileURLs           []string          `json:"fileUris" description:"List of files to be downloaded" format:"uri"`
+	StorageAccountName string            `json:"storageAccountName" description:"Name of the Azure Storage Account (3-24 characters of lowercase letters or digits)" pattern:"^[a-z0-9]{3,24}$"`
+	StorageAccountKey  string            `json:"storageAccountKey" description:"Key for the Azure Storage Account (a base64 encoded string)" pattern:"^(?:[A-Za-z0-9+/]{4})*(?:[A-Za-z0-9+/]{2}==|[A-Za-z0-9+/]{3}=|[A-Za-z0-9+/]{4})$"`
+	ManagedIdentity    *clientOrObjectId `json:"managedIdentity" description:"Setting to use Managed Service Identity to try to download fileUri from azure blob"`
+	SignaturePublicKey string            `json:"signaturePublicKey" description:"PEM encoded public key the downloaded files must be signed with" minLength:"1"`
+
+	EnvironmentVariables map[string]secretValue `json:"protectedEnvironmentVariables" description:"Environment variables of the command, with string values or secret references like {\"secretRef\": \"name\"}"`
+	ProtectedArguments   []string               `json:"protectedArguments" description:"Arguments of fileToExecute passed after arguments"`
+	SecretVaultURL       string                 `json:"secretVaultUrl" description:"HTTPS URL of the Azure Key Vault to resolve secret references from with the managed identity, instead of local files" format:"uri" pattern:"^https://"`
+
+	InlineFiles  map[string]inlineFile `json:"inlineFiles" description:"Files to write into the download directory, by relative path, with base64 encoded (optionally gzip, zstd, xz or bzip2 compressed) content"`
+	InlineBundle base64String          `json:"inlineBundle" description:"Base64 encoded tar.gz archive of files to extract into the download directory"`
 }
 
 type clientOrObjectId struct {
-	ObjectId string `json:"objectId"`
-	ClientId string `json:"clientId"`
+	ObjectId string `json:"objectId" description:"Object id that identifies the user created managed identity" pattern:"^(?:[0-9A-Fa-f]{8}[-][0-9A-Fa-f]{4}[-][0-9A-Fa-f]{4}[-][0-9A-Fa-f]{4}[-][0-9A-Fa-f]{12})$"`
+	ClientId string `json:"clientId" description:"Client id that identifies the user created managed identity" pattern:"^(?:[0-9A-Fa-f]{8}[-][0-9A-Fa-f]{4}[-][0-9A-Fa-f]{4}[-][0-9A-Fa-f]{4}[-][0-9A-Fa-f]{12})$"`
 }
 
 func (self *clientOrObjectId) isEmpty() bool {
@@ -119,30 +258,70 @@ func (self *clientOrObjectId) isEmpty() bool {
 }
 
 // parseAndValidateSettings reads configuration from configFolder, decrypts it,
-// runs JSON-schema and logical validation on it and returns it back.
-func parseAndValidateSettings(ctx *log.Context, configFolder string, seqNum int) (h handlerSettings, _ *vmextension.ErrorWithClarification) {
+// runs JSON-schema and logical validation on each of its runtime settings
+// blocks and returns them back. If any block is invalid, none is returned.
+func parseAndValidateSettings(ctx *log.Context, configFolder string, seqNum int) (_ []handlerSettings, _ *vmextension.ErrorWithClarification) {
 	ctx.Log("event", "reading configuration")
 	pubJSON, protJSON, err := readSettings(configFolder, seqNum)
 	if err != nil {
-		return h, vmextension.NewErrorWithClarificationPtr(errorutil.Internal_badConfig, err)
+		var certErr *certificateError
+		if errors.As(err, &certErr) {
+			return nil, vmextension.NewErrorWithClarificationPtr(certErr.code, err)
+		}
+		return nil, vmextension.NewErrorWithClarificationPtr(errorutil.Internal_badConfig, err)
 	}
-	ctx.Log("event", "read configuration")
+	ctx.Log("event", "read configuration", "blocks", len(pubJSON))
 
+	cfgs := make([]handlerSettings, len(pubJSON))
+	for i := range pubJSON {
+		var ewc *vmextension.ErrorWithClarification
+		if cfgs[i], ewc = validateHandlerSettings(ctx, pubJSON[i], protJSON[i]); ewc != nil {
+			if len(pubJSON) > 1 {
+				ewc.Err = errors.Wrapf(ewc.Err, "runtimeSettings[%d]", i)
+			}
+			return nil, ewc
+		}
+	}
+	return cfgs, nil
+}
+
+// validateHandlerSettings runs JSON-schema and logical validation on the
+// public and protected settings of a runtime settings block and parses them.
+func validateHandlerSettings(ctx *log.Context, pubJSON, protJSON map[string]interface{}) (h handlerSettings, _ *vmextension.ErrorWithClarification) {
+	// schema and logical problems are reported together, so that they can
+	// all be fixed at once
 	ctx.Log("event", "validating json schema")
+	var ewc *vmextension.ErrorWithClarification
+	var problems settingsErrors
 	if err := validateSettingsSchema(pubJSON, protJSON); err != nil {
-		return h, vmextension.NewErrorWithClarificationPtr(errorutil.Internal_badConfig, errors.Wrap(err, "json validation error"))
+		ewc = vmextension.NewErrorWithClarificationPtr(errorutil.Internal_badConfig, errors.Wrap(err, "json validation error"))
+		problems = problemsOf(err)
+	} else {
+		ctx.Log("event", "json schema valid")
 	}
-	ctx.Log("event", "json schema valid")
 
 	ctx.Log("event", "parsing configuration json")
 	if err := UnmarshalHandlerSettings(pubJSON, protJSON, &h.publicSettings, &h.protectedSettings); err != nil {
+		if ewc != nil {
+			// the schema violations explain why parsing failed
+			return h, ewc
+		}
 		return h, vmextension.NewErrorWithClarificationPtr(errorutil.Internal_badConfig, errors.Wrap(err, "json parsing error"))
 	}
 	ctx.Log("event", "parsed configuration json")
 
 	ctx.Log("event", "validating configuration logically")
-	if ewc := h.validate(); err != nil {
-		ewc.Err = errors.Wrap(ewc.Err, "invalid configuration")
+	if vewc := h.validate(); vewc != nil {
+		if ewc == nil {
+			vewc.Err = errors.Wrap(vewc.Err, "invalid configuration")
+			return h, vewc
+		}
+		problems = append(problems, problemsOf(vewc.Err)...)
+	}
+	if ewc != nil {
+		if len(problems) > 1 {
+			ewc.Err = errors.Wrap(problems, "invalid configuration")
+		}
 		return h, ewc
 	}
 	ctx.Log("event", "validated configuration")
@@ -150,10 +329,10 @@ func parseAndValidateSettings(ctx *log.Context, configFolder string, seqNum int)
 }
 
 // readSettings uses specified configFolder (comes from HandlerEnvironment) to
-// decrypt and parse the public/protected settings of the extension handler into
-// JSON objects.
-func readSettings(configFolder string, seqNum int) (pubSettingsJSON, protSettingsJSON map[string]interface{}, err error) {
-	cf := filepath.Join(configFolder, fmt.Sprintf("%d%s", seqNum, ".settings"))
+// decrypt and parse the public/protected settings of each runtime settings
+// block of the extension handler into JSON objects.
+func readSettings(configFolder string, seqNum int) (pubSettingsJSON, protSettingsJSON []map[string]interface{}, err error) {
+	cf := filepath.Join(configFolder, instanceFileName(seqNum, settingsFileSuffix))
 	pubSettingsJSON, protSettingsJSON, err = ReadSettings(cf)
 	err = errors.Wrapf(err, "error reading extension configuration")
 	return
@@ -171,11 +350,15 @@ func validateSettingsSchema(pubSettingsJSON, protSettingsJSON map[string]interfa
 		return errors.Wrap(err, "failed to unmarshal protected settings into json")
 	}
 
+	var problems settingsErrors
 	if err := validatePublicSettings(pubJSON); err != nil {
-		return err
+		problems = append(problems, problemsOf(err)...)
 	}
 	if err := validateProtectedSettings(protJSON); err != nil {
-		return err
+		problems = append(problems, problemsOf(err)...)
+	}
+	if len(problems) > 0 {
+		return problems
 	}
 	return nil
 }
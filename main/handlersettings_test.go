@@ -2,8 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -54,6 +61,106 @@ func Test_handlerSettingsValidate(t *testing.T) {
 	}.validate().Err)
 }
 
+func Test_handlerSettingsValidate_reportsEveryProblem(t *testing.T) {
+	ewc := handlerSettings{
+		publicSettings{CommandToExecute: "foo", Script: "bar"},
+		protectedSettings{CommandToExecute: "foo", StorageAccountName: "foo"},
+	}.validate()
+	require.NotNil(t, ewc)
+	require.Equal(t, errorutil.CustomerInput_commandToExecuteSpecifiedInTwoPlaces, ewc.ErrorCode, "code of the first problem")
+	require.Equal(t, settingsErrors{errCmdTooMany.Error(), errCmdAndScript.Error(), errStoragePartialCredentials.Error()}, ewc.Err)
+	require.True(t, strings.HasPrefix(ewc.Err.Error(), "3 problems found\n- "))
+}
+
+func Test_settingsErrors_capped(t *testing.T) {
+	var e settingsErrors
+	for i := 0; i < 100; i++ {
+		e = append(e, strings.Repeat("x", 100))
+	}
+	msg := e.Error()
+	require.True(t, len(msg) <= maxSettingsErrorsLen+len("\n... and 100 more"), "message is not capped: %d", len(msg))
+	require.Contains(t, msg, "100 problems found")
+	require.Regexp(t, `\.\.\. and \d+ more$`, msg)
+
+	require.Equal(t, "only", settingsErrors{"only"}.Error())
+}
+
+func Test_parseAndValidateSettings_mergesSchemaAndLogicalProblems(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	require.Nil(t, writeToFile(filepath.Join(dir, "0.settings"), `{"runtimeSettings": [{"handlerSettings": {
+		"publicSettings": {"timeoutInSeconds": -1, "fileUris": ["https://a.b/c"]}
+	}}]}`))
+
+	_, ewc := parseAndValidateSettings(log.NewContext(log.NewNopLogger()), dir, 0)
+	require.NotNil(t, ewc)
+	require.Equal(t, errorutil.Internal_badConfig, ewc.ErrorCode)
+	require.Equal(t, settingsErrors{
+		"publicSettings.timeoutInSeconds: Must be greater than or equal to 0",
+		errCmdMissing.Error(),
+	}, errors.Cause(ewc.Err))
+
+	// logical problems alone keep their own code
+	require.Nil(t, writeToFile(filepath.Join(dir, "0.settings"), `{"runtimeSettings": [{"handlerSettings": {
+		"publicSettings": {"fileUris": ["https://a.b/c"]}
+	}}]}`))
+	_, ewc = parseAndValidateSettings(log.NewContext(log.NewNopLogger()), dir, 0)
+	require.NotNil(t, ewc)
+	require.Equal(t, errorutil.CustomerInput_commandToExecuteAndScriptNotSpecified, ewc.ErrorCode)
+}
+
+func Test_parseAndValidateSettings_multipleRuntimeSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	require.Nil(t, writeToFile(filepath.Join(dir, "0.settings"), `{"runtimeSettings": [
+		{"handlerSettings": {"publicSettings": {"commandToExecute": "echo 0"}}},
+		{"handlerSettings": {"publicSettings": {"script": "ZWNobyAx"}}}
+	]}`))
+
+	cfgs, ewc := parseAndValidateSettings(log.NewContext(log.NewNopLogger()), dir, 0)
+	require.Nil(t, ewc)
+	require.Len(t, cfgs, 2)
+	require.Equal(t, "echo 0", cfgs[0].commandToExecute())
+	require.Equal(t, "ZWNobyAx", cfgs[1].script())
+
+	// any invalid block fails the whole configuration
+	require.Nil(t, writeToFile(filepath.Join(dir, "0.settings"), `{"runtimeSettings": [
+		{"handlerSettings": {"publicSettings": {"commandToExecute": "echo 0"}}},
+		{"handlerSettings": {"publicSettings": {}}}
+	]}`))
+	cfgs, ewc = parseAndValidateSettings(log.NewContext(log.NewNopLogger()), dir, 0)
+	require.Nil(t, cfgs)
+	require.NotNil(t, ewc)
+	require.Equal(t, errorutil.CustomerInput_commandToExecuteAndScriptNotSpecified, ewc.ErrorCode)
+	require.Contains(t, ewc.Err.Error(), "runtimeSettings[1]: invalid configuration")
+}
+
+func Test_handlerSettingsValidate_fileToExecute(t *testing.T) {
+	// fileToExecute alone is a command
+	require.Nil(t, handlerSettings{publicSettings{FileToExecute: "a.sh", Arguments: []string{"x"}}, protectedSettings{ProtectedArguments: []string{"y"}}}.validate())
+
+	for _, tc := range []struct {
+		h    handlerSettings
+		code int
+	}{
+		{handlerSettings{publicSettings{FileToExecute: "a.sh", CommandToExecute: "date"}, protectedSettings{}}, errorutil.CustomerInput_fileToExecuteAndCommandBothSpecified},
+		{handlerSettings{publicSettings{FileToExecute: "a.sh"}, protectedSettings{Script: "ZGF0ZQ=="}}, errorutil.CustomerInput_fileToExecuteAndCommandBothSpecified},
+		{handlerSettings{publicSettings{CommandToExecute: "date", Arguments: []string{"x"}}, protectedSettings{}}, errorutil.CustomerInput_argumentsWithoutFileToExecute},
+		{handlerSettings{publicSettings{CommandToExecute: "date"}, protectedSettings{ProtectedArguments: []string{"y"}}}, errorutil.CustomerInput_argumentsWithoutFileToExecute},
+		{handlerSettings{publicSettings{FileToExecute: "/bin/sh"}, protectedSettings{}}, errorutil.CustomerInput_invalidFileToExecute},
+		{handlerSettings{publicSettings{FileToExecute: "../a.sh"}, protectedSettings{}}, errorutil.CustomerInput_invalidFileToExecute},
+	} {
+		ewc := tc.h.validate()
+		require.NotNil(t, ewc, "%+v", tc.h)
+		require.Equal(t, tc.code, ewc.ErrorCode, "%+v", tc.h)
+	}
+
+	h := handlerSettings{publicSettings{Arguments: []string{"a"}}, protectedSettings{ProtectedArguments: []string{"b", "c"}}}
+	require.Equal(t, []string{"a", "b", "c"}, h.arguments())
+}
+
 func Test_commandToExecutePrivateIfNotPublic(t *testing.T) {
 	testSubject := handlerSettings{
 		publicSettings{},
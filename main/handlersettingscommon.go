@@ -2,18 +2,29 @@ package main
 
 import (
 	"bytes"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/Azure/custom-script-extension-linux/pkg/cms"
+	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
 	"github.com/pkg/errors"
 )
 
 const (
 	settingsFileSuffix = ".settings"
+	stateFileSuffix    = ".state"
 )
 
 type handlerSettingsFile struct {
@@ -35,22 +46,29 @@ func settingsPath(configFolder string) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("Cannot find seqnum: %v", err)
 	}
-	return filepath.Join(configFolder, fmt.Sprintf("%d%s", seq, settingsFileSuffix)), nil
+	return filepath.Join(configFolder, instanceFileName(seq, settingsFileSuffix)), nil
 }
 
 // ReadSettings locates the .settings file and returns public settings
 // JSON, and protected settings JSON (by decrypting it with the keys in
-// configFolder).
-func ReadSettings(configFilePath string) (public, protected map[string]interface{}, _ error) {
-	hs, err := parseHandlerSettingsFile(configFilePath)
+// configFolder) of each of its runtime settings blocks, in order.
+func ReadSettings(configFilePath string) (public, protected []map[string]interface{}, _ error) {
+	blocks, err := parseHandlerSettingsFile(configFilePath)
 	if err != nil {
 		return nil, nil, fmt.Errorf("error parsing settings file: %v", err)
 	}
 
-	public = hs.PublicSettings
 	configFolder := filepath.Dir(configFilePath)
-	if err := unmarshalProtectedSettings(configFolder, hs, &protected); err != nil {
-		return nil, nil, fmt.Errorf("failed to parse protected settings: %v", err)
+	for i, hs := range blocks {
+		var prot map[string]interface{}
+		if err := unmarshalProtectedSettings(configFolder, hs, &prot); err != nil {
+			if len(blocks) > 1 {
+				return nil, nil, fmt.Errorf("failed to parse protected settings of runtimeSettings[%d]: %w", i, err)
+			}
+			return nil, nil, fmt.Errorf("failed to parse protected settings: %w", err)
+		}
+		public = append(public, hs.PublicSettings)
+		protected = append(protected, prot)
 	}
 	return public, protected, nil
 }
@@ -82,24 +100,28 @@ func unmarshalSettings(in interface{}, v interface{}) error {
 }
 
 // parseHandlerSettings parses a handler settings file (e.g. 0.settings) and
-// returns it as a structured object.
-func parseHandlerSettingsFile(path string) (h handlerSettingsCommon, _ error) {
+// returns its runtime settings blocks as structured objects.
+func parseHandlerSettingsFile(path string) ([]handlerSettingsCommon, error) {
 	b, err := ioutil.ReadFile(path)
 	if err != nil {
-		return h, fmt.Errorf("Error reading %s: %v", path, err)
+		return nil, fmt.Errorf("Error reading %s: %v", path, err)
 	}
 	if len(b) == 0 { // if no config is specified, we get an empty file
-		return h, nil
+		return []handlerSettingsCommon{{}}, nil
 	}
 
 	var f handlerSettingsFile
 	if err := json.Unmarshal(b, &f); err != nil {
-		return h, fmt.Errorf("error parsing json: %v", err)
+		return nil, fmt.Errorf("error parsing json: %v", err)
+	}
+	if len(f.RuntimeSettings) == 0 {
+		return nil, fmt.Errorf("wrong runtimeSettings count. expected at least 1, got:0")
 	}
-	if len(f.RuntimeSettings) != 1 {
-		return h, fmt.Errorf("wrong runtimeSettings count. expected:1, got:%d", len(f.RuntimeSettings))
+	blocks := make([]handlerSettingsCommon, len(f.RuntimeSettings))
+	for i, rs := range f.RuntimeSettings {
+		blocks[i] = rs.HandlerSettings
 	}
-	return f.RuntimeSettings[0].HandlerSettings, nil
+	return blocks, nil
 }
 
 // unmarshalProtectedSettings decodes the protected settings from handler
@@ -118,10 +140,127 @@ func unmarshalProtectedSettings(configFolder string, hs handlerSettingsCommon, v
 		return fmt.Errorf("failed to decode base64: %v", err)
 	}
 
-	// go two levels up where certs are placed (/var/lib/waagent)
-	crt := filepath.Join(configFolder, "..", "..", fmt.Sprintf("%s.crt", hs.SettingsCertThumbprint))
-	prv := filepath.Join(configFolder, "..", "..", fmt.Sprintf("%s.prv", hs.SettingsCertThumbprint))
+	crt, prv, err := findSettingsCertificate(configFolder, hs.SettingsCertThumbprint)
+	if err != nil {
+		return err
+	}
+
+	decrypted, err := decryptProtectedSettings(decoded, crt, prv)
+	if err != nil {
+		return err
+	}
+
+	// decrypted: json object for protected settings
+	if err := json.Unmarshal(decrypted, &v); err != nil {
+		return fmt.Errorf("failed to unmarshal decrypted settings json: %v", err)
+	}
+	return nil
+}
+
+// certificateError is a failure to find a usable certificate for decrypting
+// the protected settings, with its error clarification code.
+type certificateError struct {
+	code int
+	err  error
+}
+
+func (e *certificateError) Error() string { return e.err.Error() }
+func (e *certificateError) Unwrap() error { return e.err }
 
+// findSettingsCertificate finds the certificate and private key files for the
+// given thumbprint in the directory the agent saves them to, two levels up from
+// the config folder (/var/lib/waagent for a standard installation), and checks
+// that the thumbprint matches the certificate and that it hasn't expired.
+func findSettingsCertificate(configFolder, thumbprint string) (crt, prv string, _ error) {
+	dir := filepath.Join(configFolder, "..", "..")
+	// the agent writes upper case thumbprints, but don't depend on it
+	for _, name := range []string{thumbprint, strings.ToUpper(thumbprint)} {
+		crt = filepath.Join(dir, name+".crt")
+		prv = filepath.Join(dir, name+".prv")
+		if _, err := os.Stat(crt); err != nil {
+			continue
+		}
+		if _, err := os.Stat(prv); err != nil {
+			return "", "", &certificateError{errorutil.Internal_couldNotFindCertificate,
+				fmt.Errorf("found certificate %s but not its private key: %v", crt, err)}
+		}
+		cert, err := readCertificate(crt)
+		if err != nil {
+			return "", "", &certificateError{errorutil.Internal_certificateThumbprintMismatch, err}
+		}
+		sum := sha1.Sum(cert.Raw)
+		if actual := hex.EncodeToString(sum[:]); !strings.EqualFold(actual, thumbprint) {
+			return "", "", &certificateError{errorutil.Internal_certificateThumbprintMismatch,
+				fmt.Errorf("certificate %s has thumbprint %s, expected %s", crt, strings.ToUpper(actual), thumbprint)}
+		}
+		if time.Now().After(cert.NotAfter) {
+			return "", "", &certificateError{errorutil.Internal_certificateExpired,
+				fmt.Errorf("certificate %s expired on %s", thumbprint, cert.NotAfter.UTC().Format(time.RFC3339))}
+		}
+		return crt, prv, nil
+	}
+	return "", "", &certificateError{errorutil.Internal_couldNotFindCertificate,
+		fmt.Errorf("certificate %s.crt for the protected settings was not found in %s", thumbprint, dir)}
+}
+
+// readCertificate reads the PEM encoded certificate at path.
+func readCertificate(path string) (*x509.Certificate, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read certificate")
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded certificate found in %s", path)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	return cert, errors.Wrapf(err, "failed to parse certificate %s", path)
+}
+
+// decryptProtectedSettings decrypts the CMS enveloped protected settings with
+// the certificate and private key files at crt and prv. They are decrypted
+// natively, openssl is only used as a fallback for content the native
+// decryptor does not support.
+func decryptProtectedSettings(enveloped []byte, crt, prv string) ([]byte, error) {
+	out, nativeErr := decryptNative(enveloped, crt, prv)
+	if nativeErr == nil {
+		return out, nil
+	}
+	out, err := decryptWithOpenssl(enveloped, crt, prv)
+	if err != nil {
+		return nil, errors.Wrapf(err, "native decryption failed (%v), falling back to openssl failed", nativeErr)
+	}
+	return out, nil
+}
+
+func decryptNative(enveloped []byte, crt, prv string) ([]byte, error) {
+	cert, err := readCertificate(crt)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadFile(prv)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read private key")
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM encoded private key found")
+	}
+	var key interface{}
+	if key, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+		if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, errors.Wrap(err, "failed to parse private key")
+		}
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return cms.Decrypt(enveloped, cert, rsaKey)
+}
+
+func decryptWithOpenssl(enveloped []byte, crt, prv string) ([]byte, error) {
 	// we use os/exec instead of azure-docker-extension/pkg/executil here as
 	// other extension handlers depend on this package for parsing handler
 	// settings.
@@ -130,7 +269,7 @@ func unmarshalProtectedSettings(configFolder string, hs handlerSettingsCommon, v
 	cmd := exec.Command("openssl", "cms", "-inform", "DER", "-decrypt", "-recip", crt, "-inkey", prv)
 	var bOut, bErr bytes.Buffer
 	var errMsg error
-	cmd.Stdin = bytes.NewReader(decoded)
+	cmd.Stdin = bytes.NewReader(enveloped)
 	cmd.Stdout = &bOut
 	cmd.Stderr = &bErr
 
@@ -138,19 +277,14 @@ func unmarshalProtectedSettings(configFolder string, hs handlerSettingsCommon, v
 	if err := cmd.Run(); err != nil {
 		errMsg = fmt.Errorf("decrypting protected settings with cms command failed: error=%v stderr=%s \n now decrypting with smime command", err, bErr.String())
 		cmd = exec.Command("openssl", "smime", "-inform", "DER", "-decrypt", "-recip", crt, "-inkey", prv)
-		cmd.Stdin = bytes.NewReader(decoded)
+		cmd.Stdin = bytes.NewReader(enveloped)
 		bOut.Reset()
 		bErr.Reset()
 		cmd.Stdout = &bOut
 		cmd.Stderr = &bErr
 		if err := cmd.Run(); err != nil {
-			return errors.Wrapf(errMsg, "decrypting protected settings with smime command failed: error=%v stderr=%s", err, bErr.String())
+			return nil, errors.Wrapf(errMsg, "decrypting protected settings with smime command failed: error=%v stderr=%s", err, bErr.String())
 		}
 	}
-
-	// decrypted: json object for protected settings
-	if err := json.Unmarshal(bOut.Bytes(), &v); err != nil {
-		return fmt.Errorf("failed to unmarshal decrypted settings json: %v", err)
-	}
-	return nil
+	return bOut.Bytes(), nil
 }
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+const cmsTestdata = "../pkg/cms/testdata"
+
+func Test_ReadSettings_decryptsProtectedSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// certificates are two levels up from the config folder
+	configFolder := filepath.Join(dir, "ext", "config")
+	require.Nil(t, os.MkdirAll(configFolder, 0700))
+	thumbprint := installTestCertificate(t, dir, readFile(t, filepath.Join(cmsTestdata, "recipient.crt")))
+
+	for _, f := range []string{"aes256cbc.p7m", "oaep-sha256.p7m", "aes256gcm.p7m"} {
+		settings := writeProtectedTestSettings(t, configFolder, thumbprint, f)
+		pub, prot, err := ReadSettings(settings)
+		require.Nil(t, err, f)
+		require.Equal(t, []map[string]interface{}{{"fileUris": []interface{}{"https://a.b/c"}}}, pub)
+		require.Equal(t, []map[string]interface{}{{"commandToExecute": "echo secret"}}, prot, f)
+	}
+
+	// the thumbprint in the settings may be in lower case
+	_, prot, err := ReadSettings(writeProtectedTestSettings(t, configFolder, strings.ToLower(thumbprint), "aes256cbc.p7m"))
+	require.Nil(t, err)
+	require.Equal(t, []map[string]interface{}{{"commandToExecute": "echo secret"}}, prot)
+}
+
+func Test_ReadSettings_certificateNotFound(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	configFolder := filepath.Join(dir, "ext", "config")
+	require.Nil(t, os.MkdirAll(configFolder, 0700))
+	_, _, err = ReadSettings(writeProtectedTestSettings(t, configFolder, "ABCDEF", "aes256cbc.p7m"))
+	requireCertificateError(t, errorutil.Internal_couldNotFindCertificate, err)
+	require.Contains(t, err.Error(), "ABCDEF.crt for the protected settings was not found")
+}
+
+func Test_ReadSettings_thumbprintMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	configFolder := filepath.Join(dir, "ext", "config")
+	require.Nil(t, os.MkdirAll(configFolder, 0700))
+	installTestCertificate(t, dir, readFile(t, filepath.Join(cmsTestdata, "recipient.crt")))
+	// another certificate saved under the thumbprint of the settings
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "ABCDEF.crt"), readFile(t, filepath.Join(cmsTestdata, "other.crt")), 0600))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "ABCDEF.prv"), readFile(t, filepath.Join(cmsTestdata, "recipient.prv")), 0600))
+
+	_, _, err = ReadSettings(writeProtectedTestSettings(t, configFolder, "ABCDEF", "aes256cbc.p7m"))
+	requireCertificateError(t, errorutil.Internal_certificateThumbprintMismatch, err)
+	require.Contains(t, err.Error(), "expected ABCDEF")
+}
+
+func Test_ReadSettings_certificateExpired(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	configFolder := filepath.Join(dir, "ext", "config")
+	require.Nil(t, os.MkdirAll(configFolder, 0700))
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "expired"},
+		NotBefore:    time.Now().Add(-48 * time.Hour),
+		NotAfter:     time.Now().Add(-24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.Nil(t, err)
+	thumbprint := installTestCertificate(t, dir, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, thumbprint+".prv"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), 0600))
+
+	// the settings were encrypted for another certificate, it isn't even tried
+	_, _, err = ReadSettings(writeProtectedTestSettings(t, configFolder, thumbprint, "aes256cbc.p7m"))
+	requireCertificateError(t, errorutil.Internal_certificateExpired, err)
+	require.Contains(t, err.Error(), "expired on")
+}
+
+func Test_parseAndValidateSettings_certificateErrorCode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	configFolder := filepath.Join(dir, "ext", "config")
+	require.Nil(t, os.MkdirAll(configFolder, 0700))
+	writeProtectedTestSettings(t, configFolder, "ABCDEF", "aes256cbc.p7m")
+
+	_, ewc := parseAndValidateSettings(log.NewContext(log.NewNopLogger()), configFolder, 0)
+	require.NotNil(t, ewc)
+	require.Equal(t, errorutil.Internal_couldNotFindCertificate, ewc.ErrorCode)
+}
+
+func Test_ReadSettings_multipleRuntimeSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	configFolder := filepath.Join(dir, "ext", "config")
+	require.Nil(t, os.MkdirAll(configFolder, 0700))
+	thumbprint := installTestCertificate(t, dir, readFile(t, filepath.Join(cmsTestdata, "recipient.crt")))
+
+	settings := filepath.Join(configFolder, "0.settings")
+	require.Nil(t, writeToFile(settings, `{"runtimeSettings": [
+		{"handlerSettings": {"publicSettings": {"commandToExecute": "echo 0"}}},
+		{"handlerSettings": {
+			"protectedSettingsCertThumbprint": "`+thumbprint+`",
+			"protectedSettings": "`+base64.StdEncoding.EncodeToString(readFile(t, filepath.Join(cmsTestdata, "aes256cbc.p7m")))+`"
+		}}
+	]}`))
+	pub, prot, err := ReadSettings(settings)
+	require.Nil(t, err)
+	require.Equal(t, []map[string]interface{}{{"commandToExecute": "echo 0"}, nil}, pub)
+	require.Equal(t, []map[string]interface{}{nil, {"commandToExecute": "echo secret"}}, prot)
+
+	// the failing block is named
+	require.Nil(t, writeToFile(settings, `{"runtimeSettings": [
+		{"handlerSettings": {"publicSettings": {"commandToExecute": "echo 0"}}},
+		{"handlerSettings": {"protectedSettingsCertThumbprint": "ABCDEF", "protectedSettings": "Zm9v"}}
+	]}`))
+	_, _, err = ReadSettings(settings)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "runtimeSettings[1]")
+}
+
+func Test_parseHandlerSettingsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	settings := filepath.Join(dir, "0.settings")
+
+	// no configuration at all is a single empty block
+	require.Nil(t, writeToFile(settings, ""))
+	blocks, err := parseHandlerSettingsFile(settings)
+	require.Nil(t, err)
+	require.Equal(t, []handlerSettingsCommon{{}}, blocks)
+
+	require.Nil(t, writeToFile(settings, `{"runtimeSettings": []}`))
+	_, err = parseHandlerSettingsFile(settings)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "wrong runtimeSettings count")
+
+	require.Nil(t, writeToFile(settings, `{"runtimeSettings": [
+		{"handlerSettings": {"publicSettings": {"a": 1}}},
+		{"handlerSettings": {"protectedSettingsCertThumbprint": "T"}}
+	]}`))
+	blocks, err = parseHandlerSettingsFile(settings)
+	require.Nil(t, err)
+	require.Equal(t, []handlerSettingsCommon{
+		{PublicSettings: map[string]interface{}{"a": float64(1)}},
+		{SettingsCertThumbprint: "T"},
+	}, blocks)
+}
+
+func Test_decryptProtectedSettings_reportsBothFailures(t *testing.T) {
+	_, err := decryptProtectedSettings([]byte("not cms"), "/non/existing.crt", "/non/existing.prv")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "native decryption failed (failed to read certificate")
+	require.Contains(t, err.Error(), "falling back to openssl failed")
+}
+
+func Test_decryptNative_pkcs1Key(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// convert the PKCS#8 test key to the traditional RSA PRIVATE KEY format
+	block, _ := pem.Decode(readFile(t, filepath.Join(cmsTestdata, "recipient.prv")))
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	require.Nil(t, err)
+	prv := filepath.Join(dir, "key.prv")
+	require.Nil(t, ioutil.WriteFile(prv, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key.(*rsa.PrivateKey))}), 0600))
+
+	out, err := decryptNative(readFile(t, filepath.Join(cmsTestdata, "des3.p7m")), filepath.Join(cmsTestdata, "recipient.crt"), prv)
+	require.Nil(t, err)
+	require.Equal(t, readFile(t, filepath.Join(cmsTestdata, "plain.json")), out)
+}
+
+// installTestCertificate writes the PEM certificate and the private key of the
+// test recipient to dir under the certificate's thumbprint, which it returns.
+func installTestCertificate(t *testing.T, dir string, crt []byte) string {
+	block, _ := pem.Decode(crt)
+	require.NotNil(t, block)
+	sum := sha1.Sum(block.Bytes)
+	thumbprint := strings.ToUpper(hex.EncodeToString(sum[:]))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, thumbprint+".crt"), crt, 0600))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, thumbprint+".prv"), readFile(t, filepath.Join(cmsTestdata, "recipient.prv")), 0600))
+	return thumbprint
+}
+
+// writeProtectedTestSettings writes 0.settings to configFolder with the
+// encrypted testdata file p7m as the protected settings.
+func writeProtectedTestSettings(t *testing.T, configFolder, thumbprint, p7m string) string {
+	settings := filepath.Join(configFolder, "0.settings")
+	require.Nil(t, writeToFile(settings, `{"runtimeSettings": [{"handlerSettings": {
+		"protectedSettingsCertThumbprint": "`+thumbprint+`",
+		"protectedSettings": "`+base64.StdEncoding.EncodeToString(readFile(t, filepath.Join(cmsTestdata, p7m)))+`",
+		"publicSettings": {"fileUris": ["https://a.b/c"]}
+	}}]}`))
+	return settings
+}
+
+func requireCertificateError(t *testing.T, code int, err error) {
+	var certErr *certificateError
+	require.True(t, errors.As(err, &certErr), "%v", err)
+	require.Equal(t, code, certErr.code)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	vmextension "github.com/Azure/azure-extension-platform/vmextension"
+	"github.com/Azure/custom-script-extension-linux/pkg/atomicfile"
+	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
+	"github.com/Azure/custom-script-extension-linux/pkg/state"
+	"github.com/go-kit/kit/log"
+)
+
+// While an operation runs, the handler writes the heartbeat file of the
+// handler environment every heartbeatInterval, so that a long-running command
+// can be told from a dead handler when looking at the VM. It is a local
+// diagnostic only: the agent considers the handler unresponsive if the file is
+// older than 10 minutes, and nothing writes it while no operation runs, so
+// reportHeartbeat is off in the handler manifest and the agent doesn't read it.
+
+const (
+	heartbeatReady    = "Ready"
+	heartbeatNotReady = "NotReady"
+)
+
+// heartbeatInterval is how often the heartbeat is written.
+var heartbeatInterval = time.Minute
+
+// HeartbeatReport is the format of the heartbeat file read by the agent.
+type HeartbeatReport []HeartbeatItem
+
+type HeartbeatItem struct {
+	Version   float64         `json:"version"`
+	Heartbeat HeartbeatStatus `json:"heartbeat"`
+}
+
+type HeartbeatStatus struct {
+	Status           string           `json:"status"`
+	Code             int              `json:"code"`
+	FormattedMessage FormattedMessage `json:"formattedMessage"`
+}
+
+var (
+	heartbeatMu sync.Mutex
+	// heartbeatPhase is the last phase the sequence number of the operation
+	// went through, see stateTracker.
+	heartbeatPhase state.Phase
+)
+
+// setHeartbeatPhase records the phase reported by the next heartbeat.
+func setHeartbeatPhase(p state.Phase) {
+	heartbeatMu.Lock()
+	defer heartbeatMu.Unlock()
+	heartbeatPhase = p
+}
+
+// heartbeat writes the heartbeat of an operation until stopped. The methods
+// of a nil *heartbeat do nothing.
+type heartbeat struct {
+	ctx       log.Logger
+	path      string
+	operation string
+	start     time.Time
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// startHeartbeat writes the heartbeat of the operation of c to the heartbeat
+// file of hEnv, if any, now and every heartbeatInterval. Operations which
+// don't report status don't write it either.
+func startHeartbeat(ctx log.Logger, hEnv HandlerEnvironment, c cmd) *heartbeat {
+	path := hEnv.HandlerEnvironment.HeartbeatFile
+	if path == "" || !c.shouldReportStatus {
+		return nil
+	}
+	h := &heartbeat{
+		ctx:       ctx,
+		path:      path,
+		operation: c.name,
+		start:     time.Now(),
+		done:      make(chan struct{}),
+	}
+	h.beat()
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		t := time.NewTicker(heartbeatInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-h.done:
+				return
+			case <-t.C:
+				h.beat()
+			}
+		}
+	}()
+	return h
+}
+
+// beat writes that the operation is in progress, in its current phase.
+func (h *heartbeat) beat() {
+	heartbeatMu.Lock()
+	phase := heartbeatPhase
+	heartbeatMu.Unlock()
+	msg := fmt.Sprintf("%s in progress for %v", h.operation, h.elapsed())
+	if phase != "" {
+		msg += fmt.Sprintf(", phase: %s", phase)
+	}
+	h.write(heartbeatReady, 0, msg)
+}
+
+// stop stops the heartbeat and writes the outcome of the operation: NotReady
+// with ewc if the handler failed. The result of the command, which may have
+// failed, is reported in the status.
+func (h *heartbeat) stop(ewc *vmextension.ErrorWithClarification) {
+	if h == nil {
+		return
+	}
+	close(h.done)
+	h.wg.Wait()
+	if handlerFailed(ewc) {
+		h.write(heartbeatNotReady, ewc.ErrorCode, fmt.Sprintf("%s failed after %v: %s", h.operation, h.elapsed(), ewc.Error()))
+		return
+	}
+	h.write(heartbeatReady, 0, fmt.Sprintf("%s completed after %v", h.operation, h.elapsed()))
+}
+
+// handlerFailed returns whether ewc is a failure of the handler rather than of
+// the command or the settings of the customer, which are user errors.
+func handlerFailed(ewc *vmextension.ErrorWithClarification) bool {
+	return ewc != nil && ewc.Err != nil && ewc.ErrorCode <= errorutil.SystemError
+}
+
+func (h *heartbeat) elapsed() time.Duration {
+	return time.Since(h.start).Round(time.Second)
+}
+
+func (h *heartbeat) write(status string, code int, msg string) {
+	b, err := json.Marshal(HeartbeatReport{{
+		Version: 1.0,
+		Heartbeat: HeartbeatStatus{
+			Status:           status,
+			Code:             code,
+			FormattedMessage: FormattedMessage{Lang: "en", Message: msg},
+		},
+	}})
+	if err != nil {
+		h.ctx.Log("event", "failed to marshal heartbeat", "error", err)
+		return
+	}
+	if err := atomicfile.WriteFile(h.path, b, 0644); err != nil {
+		h.ctx.Log("event", "failed to write heartbeat", "error", err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	vmextension "github.com/Azure/azure-extension-platform/vmextension"
+	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
+	"github.com/Azure/custom-script-extension-linux/pkg/state"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_startHeartbeat_noHeartbeat(t *testing.T) {
+	hEnv := HandlerEnvironment{}
+	h := startHeartbeat(log.NewNopLogger(), hEnv, cmdEnable)
+	require.Nil(t, h, "no heartbeat file")
+	h.stop(nil)
+
+	hEnv.HandlerEnvironment.HeartbeatFile = filepath.Join(tempDir(t), "heartbeat.log")
+	require.Nil(t, startHeartbeat(log.NewNopLogger(), hEnv, cmd{name: "Install"}), "no status")
+	require.False(t, fileExists(t, hEnv.HandlerEnvironment.HeartbeatFile))
+}
+
+func Test_heartbeat(t *testing.T) {
+	defer func(d time.Duration) { heartbeatInterval = d }(heartbeatInterval)
+	heartbeatInterval = 10 * time.Millisecond
+	defer setHeartbeatPhase("")
+	hEnv := HandlerEnvironment{}
+	hEnv.HandlerEnvironment.HeartbeatFile = filepath.Join(tempDir(t), "heartbeat.log")
+
+	setHeartbeatPhase("")
+	h := startHeartbeat(log.NewNopLogger(), hEnv, cmdEnable)
+	hb := requireHeartbeat(t, hEnv.HandlerEnvironment.HeartbeatFile)
+	require.Equal(t, heartbeatReady, hb.Status)
+	require.Equal(t, "Enable in progress for 0s", hb.FormattedMessage.Message)
+
+	setHeartbeatPhase(state.Executing)
+	time.Sleep(50 * time.Millisecond)
+	hb = requireHeartbeat(t, hEnv.HandlerEnvironment.HeartbeatFile)
+	require.Equal(t, heartbeatReady, hb.Status)
+	require.Equal(t, "Enable in progress for 0s, phase: executing", hb.FormattedMessage.Message)
+
+	h.stop(nil)
+	hb = requireHeartbeat(t, hEnv.HandlerEnvironment.HeartbeatFile)
+	require.Equal(t, heartbeatReady, hb.Status)
+	require.Equal(t, "Enable completed after 0s", hb.FormattedMessage.Message)
+}
+
+func Test_heartbeat_commandFailed(t *testing.T) {
+	hEnv := HandlerEnvironment{}
+	hEnv.HandlerEnvironment.HeartbeatFile = filepath.Join(tempDir(t), "heartbeat.log")
+
+	h := startHeartbeat(log.NewNopLogger(), hEnv, cmdEnable)
+	h.stop(vmextension.NewErrorWithClarificationPtr(errorutil.CommandExecution_failureExitCode, errors.New("exit status 1")))
+	hb := requireHeartbeat(t, hEnv.HandlerEnvironment.HeartbeatFile)
+	require.Equal(t, heartbeatReady, hb.Status, "the handler is healthy, the status reports the command")
+	require.Equal(t, 0, hb.Code)
+	require.Equal(t, "Enable completed after 0s", hb.FormattedMessage.Message)
+}
+
+func Test_heartbeat_handlerFailed(t *testing.T) {
+	hEnv := HandlerEnvironment{}
+	hEnv.HandlerEnvironment.HeartbeatFile = filepath.Join(tempDir(t), "heartbeat.log")
+
+	h := startHeartbeat(log.NewNopLogger(), hEnv, cmdEnable)
+	h.stop(vmextension.NewErrorWithClarificationPtr(errorutil.Os_FailedToOpenStdOut, errors.New("read-only file system")))
+	hb := requireHeartbeat(t, hEnv.HandlerEnvironment.HeartbeatFile)
+	require.Equal(t, heartbeatNotReady, hb.Status)
+	require.Equal(t, errorutil.Os_FailedToOpenStdOut, hb.Code)
+	require.Contains(t, hb.FormattedMessage.Message, "Enable failed after 0s: ")
+	require.Contains(t, hb.FormattedMessage.Message, "read-only file system")
+}
+
+func Test_handlerFailed(t *testing.T) {
+	require.False(t, handlerFailed(nil))
+	require.False(t, handlerFailed(vmextension.NewErrorWithClarificationPtr(errorutil.CustomerInput_invalidScript, errors.New("x"))))
+	require.False(t, handlerFailed(vmextension.NewErrorWithClarificationPtr(errorutil.CommandExecution_timedOut, errors.New("x"))))
+	require.True(t, handlerFailed(vmextension.NewErrorWithClarificationPtr(errorutil.SystemError, errors.New("x"))))
+	require.True(t, handlerFailed(vmextension.NewErrorWithClarificationPtr(errorutil.FileDownload_unknownError, errors.New("x"))))
+}
+
+// requireHeartbeat reads the heartbeat file at path in the format of the
+// agent.
+func requireHeartbeat(t *testing.T, path string) HeartbeatStatus {
+	b, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	var r []map[string]json.RawMessage
+	require.Nil(t, json.Unmarshal(b, &r))
+	require.Len(t, r, 1)
+	require.Contains(t, string(r[0]["version"]), "1")
+	var hb HeartbeatStatus
+	require.Nil(t, json.Unmarshal(r[0]["heartbeat"], &hb))
+	return hb
+}
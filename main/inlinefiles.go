@@ -0,0 +1,299 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Azure/azure-extension-platform/pkg/extensionpolicysettings"
+	vmextension "github.com/Azure/azure-extension-platform/vmextension"
+	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxInlineFilesSize caps the total decompressed size of the inline files
+	// and the inline bundle of a runtime settings block.
+	maxInlineFilesSize = 16 * 1024 * 1024
+
+	// defaultInlineFileMode is the mode of the inline files without a mode,
+	// like the downloaded files it assumes they are scripts to execute.
+	defaultInlineFileMode = 0500
+
+	base64Pattern = `^(?:[A-Za-z0-9+/]{4})*(?:[A-Za-z0-9+/]{2}==|[A-Za-z0-9+/]{3}=)?$`
+	modePattern   = `^0?[0-7]{3}$`
+)
+
+var (
+	// inlineFileSegmentRegex matches the segments of the relative paths of
+	// inline files.
+	inlineFileSegmentRegex = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+	// reservedInlineFileNames can't be written by inline files, the extension
+	// writes them into the download directory itself.
+	reservedInlineFileNames = map[string]bool{"stdout": true, "stderr": true, "script.sh": true}
+)
+
+// base64String is a settings string of base64 encoded data, validated against
+// base64Pattern like the content of the inline files.
+type base64String string
+
+func (base64String) settingsSchema() *jsonSchema {
+	return &jsonSchema{Type: "string", Pattern: base64Pattern}
+}
+
+// inlineFile is a file in the inlineFiles settings: either its base64 encoded
+// content, or an object like {"content": "<base64>", "mode": "0755"}. The
+// content may be gzip, zstd, xz or bzip2 compressed.
+type inlineFile struct {
+	Content string
+	Mode    string
+}
+
+func (f *inlineFile) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &f.Content); err == nil {
+		return nil
+	}
+	var o struct {
+		Content *string `json:"content"`
+		Mode    string  `json:"mode"`
+	}
+	if err := json.Unmarshal(b, &o); err != nil || o.Content == nil {
+		return errors.New(`inline file must be a base64 string or {"content": "<base64>", "mode": "<octal>"}`)
+	}
+	f.Content, f.Mode = *o.Content, o.Mode
+	return nil
+}
+
+func (f inlineFile) MarshalJSON() ([]byte, error) {
+	if f.Mode != "" {
+		return json.Marshal(map[string]string{"content": f.Content, "mode": f.Mode})
+	}
+	return json.Marshal(f.Content)
+}
+
+func (inlineFile) settingsSchema() *jsonSchema {
+	return &jsonSchema{AnyOf: []*jsonSchema{
+		{Type: "string", Pattern: base64Pattern},
+		{
+			Type: "object",
+			Properties: map[string]*jsonSchema{
+				"content": {Type: "string", Pattern: base64Pattern, Description: "Base64 encoded content of the file, optionally gzip, zstd, xz or bzip2 compressed"},
+				"mode":    {Type: "string", Pattern: modePattern, Description: "Octal permissions of the file, e.g. 0755"},
+			},
+			Required:             []string{"content"},
+			AdditionalProperties: false,
+		},
+	}}
+}
+
+// mode returns the permissions the file is written with.
+func (f inlineFile) mode() (os.FileMode, error) {
+	if f.Mode == "" {
+		return defaultInlineFileMode, nil
+	}
+	m, err := strconv.ParseUint(f.Mode, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, errors.Errorf("invalid mode %q", f.Mode)
+	}
+	return os.FileMode(m), nil
+}
+
+// validateInlineFileName checks that name is a relative path inside the
+// download directory made of safe segments, and is not one of the files the
+// extension writes there.
+func validateInlineFileName(name string) error {
+	if name == "" || strings.HasPrefix(name, "/") {
+		return errors.Errorf("invalid inline file name %q: must be a relative path", name)
+	}
+	for _, s := range strings.Split(name, "/") {
+		if s == "." || s == ".." || !inlineFileSegmentRegex.MatchString(s) {
+			return errors.Errorf("invalid inline file name %q: path segments must be made of letters, digits, '.', '_' or '-'", name)
+		}
+	}
+	if reservedInlineFileNames[name] {
+		return errors.Errorf("invalid inline file name %q: reserved by the extension", name)
+	}
+	return nil
+}
+
+// sortedInlineFileNames returns the names of the inline files of cfg in a
+// stable order.
+func sortedInlineFileNames(cfg handlerSettings) []string {
+	var names []string
+	for name := range cfg.inlineFiles() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// writeInlineFiles writes the inline files and the content of the inline
+// bundle of cfg into dir (assumed to exist), and post-processes them like the
+// downloaded files. If policy is not nil, the files must be in its allowlist
+// and can't be used when it requires signed files, since they have no
+// signature.
+func writeInlineFiles(ctx *log.Context, dir string, cfg handlerSettings, policy *CSEExtensionPolicySettings) *vmextension.ErrorWithClarification {
+	files, bundle := cfg.inlineFiles(), cfg.inlineBundle()
+	if len(files) == 0 && bundle == "" {
+		return nil
+	}
+	if policy != nil && policy.RequireSigning {
+		return vmextension.NewErrorWithClarificationPtr(errorutil.ExtensionPolicySettings_executionNotAllowed,
+			errors.New("inline files are not allowed, the extension policy requires signed files"))
+	}
+
+	dos2unix := 1
+	if cfg.publicSettings.SkipDos2Unix {
+		dos2unix = 0
+	}
+	scenario := "public"
+	if len(cfg.publicSettings.InlineFiles) == 0 && cfg.publicSettings.InlineBundle == "" {
+		scenario = "protected"
+	}
+	telemetry("scenario", fmt.Sprintf("%s-inlineFiles;files=%d;bundle=%t;dos2unix=%d", scenario, len(files), bundle != "", dos2unix), true, 0*time.Millisecond)
+
+	budget := int64(maxInlineFilesSize)
+	var written []string
+	for _, name := range sortedInlineFileNames(cfg) {
+		f := files[name]
+		mode, err := f.mode()
+		if err != nil {
+			return inlineFileError(errors.Wrapf(err, "inline file %q", name))
+		}
+		b, err := decodeInlineContent(f.Content, budget)
+		if err != nil {
+			return inlineFileError(errors.Wrapf(err, "inline file %q", name))
+		}
+		budget -= int64(len(b))
+		if err := writeInlineFile(dir, name, b, mode); err != nil {
+			return vmextension.NewErrorWithClarificationPtr(errorutil.SystemError, err)
+		}
+		written = append(written, name)
+	}
+
+	if bundle != "" {
+		b, err := decodeInlineContent(bundle, budget)
+		if err != nil {
+			return inlineFileError(errors.Wrap(err, "inline bundle"))
+		}
+		names, ewc := extractInlineBundle(dir, b)
+		if ewc != nil {
+			return ewc
+		}
+		written = append(written, names...)
+	}
+	ctx.Log("event", "wrote inline files", "count", len(written))
+
+	for _, name := range written {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if !cfg.publicSettings.SkipDos2Unix {
+			if err := postProcessFile(path); err != nil {
+				return vmextension.NewErrorWithClarificationPtr(errorutil.SystemError, errors.Wrapf(err, "failed to post-process '%s'", name))
+			}
+		}
+		if policy != nil && len(policy.AllowedScripts) > 0 {
+			if err := extensionpolicysettings.ValidateFileHashInAllowlist(path, policy.AllowedScripts, extensionpolicysettings.HashTypeSHA256); err != nil {
+				err = fmt.Errorf("Validation of inline file '%s' against policy-allowlist failed: %w.", name, err)
+				if herr := handleBlockedFile(ctx, path, "inline:"+name, err.Error(), policy, filepath.Join(dataDir, quarantineDir)); herr != nil {
+					ctx.Log("event", "failed to handle blocked file", "file", name, "error", herr)
+				}
+				return vmextension.NewErrorWithClarificationPtr(errorutil.SystemError, err)
+			}
+		}
+	}
+	return nil
+}
+
+// decodeInlineContent base64 decodes and decompresses the content of an
+// inline file or bundle, which may not exceed maxSize bytes once decompressed.
+// The size limit is shared by all the inline files, see maxInlineFilesSize.
+func decodeInlineContent(content string, maxSize int64) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(content)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode base64 content")
+	}
+	b, _, err = decompress(b, maxSize)
+	return b, err
+}
+
+// extractInlineBundle writes the regular files and directories of the tar
+// archive b into dir and returns the names of the files. Any other kind of
+// entry, like links or devices, is rejected.
+func extractInlineBundle(dir string, b []byte) ([]string, *vmextension.ErrorWithClarification) {
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(b))
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return names, nil
+		}
+		if err != nil {
+			return nil, inlineFileError(errors.Wrap(err, "invalid inline bundle"))
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(h.Name, "./"), "/")
+		if name == "" || name == "." {
+			continue
+		}
+		if err := validateInlineFileName(name); err != nil {
+			return nil, inlineFileError(errors.Wrap(err, "inline bundle"))
+		}
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		switch h.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0700); err != nil {
+				return nil, vmextension.NewErrorWithClarificationPtr(errorutil.SystemError, errors.Wrapf(err, "failed to create directory '%s'", name))
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			content, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, inlineFileError(errors.Wrapf(err, "failed to read '%s' from the inline bundle", name))
+			}
+			if err := writeInlineFile(dir, name, content, os.FileMode(h.Mode)&os.ModePerm); err != nil {
+				return nil, vmextension.NewErrorWithClarificationPtr(errorutil.SystemError, err)
+			}
+			names = append(names, name)
+		default:
+			return nil, inlineFileError(errors.Errorf("inline bundle: '%s' is not a regular file or directory", name))
+		}
+	}
+}
+
+// writeInlineFile writes content into the file name (a validated relative
+// path) under dir with the given mode, creating its parent directories. It
+// doesn't follow a symbolic link at the path.
+func writeInlineFile(dir, name string, content []byte, mode os.FileMode) error {
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.Wrapf(err, "failed to create the directory of '%s'", name)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to write '%s'", name)
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "failed to write '%s'", name)
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrapf(err, "failed to write '%s'", name)
+	}
+	return errors.Wrapf(os.Chmod(path, mode), "failed to set the mode of '%s'", name)
+}
+
+// inlineFileError returns the error for invalid inline files in the settings.
+func inlineFileError(err error) *vmextension.ErrorWithClarification {
+	return vmextension.NewErrorWithClarificationPtr(errorutil.CustomerInput_invalidInlineFile, err)
+}
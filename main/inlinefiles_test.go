@@ -0,0 +1,199 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_validateSettings_inlineBundle(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"commandToExecute": "date", "inlineBundle": "ZGF0ZQ=="}`))
+	require.Nil(t, validateProtectedSettings(`{"inlineBundle": "ZGF0"}`))
+	require.NotNil(t, validatePublicSettings(`{"commandToExecute": "date", "inlineBundle": "not base64"}`))
+	require.NotNil(t, validateProtectedSettings(`{"inlineBundle": "ZGF0ZQ="}`))
+}
+
+func Test_inlineFile_unmarshal(t *testing.T) {
+	var files map[string]inlineFile
+	require.Nil(t, json.Unmarshal([]byte(`{"a.sh": "ZGF0ZQ==", "b.txt": {"content": "", "mode": "0644"}}`), &files))
+	require.Equal(t, map[string]inlineFile{"a.sh": {Content: "ZGF0ZQ=="}, "b.txt": {Mode: "0644"}}, files)
+
+	b, err := json.Marshal(files)
+	require.Nil(t, err)
+	require.JSONEq(t, `{"a.sh": "ZGF0ZQ==", "b.txt": {"content": "", "mode": "0644"}}`, string(b))
+
+	require.NotNil(t, json.Unmarshal([]byte(`{"a": 1}`), &files))
+	require.NotNil(t, json.Unmarshal([]byte(`{"a": {"mode": "0644"}}`), &files))
+}
+
+func Test_validatePublicSettings_inlineFiles(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"inlineFiles": {"a.sh": "ZGF0ZQ==", "lib/b": {"content": "ZGF0ZQ==", "mode": "755"}}}`))
+	require.NotNil(t, validatePublicSettings(`{"inlineFiles": {"a.sh": "not base64"}}`))
+	require.NotNil(t, validatePublicSettings(`{"inlineFiles": {"a.sh": {"content": "ZGF0ZQ==", "mode": "0999"}}}`))
+	require.NotNil(t, validatePublicSettings(`{"inlineFiles": {"a.sh": {"content": "ZGF0ZQ==", "owner": "root"}}}`))
+	require.NotNil(t, validatePublicSettings(`{"inlineBundle": "not base64"}`))
+	require.Nil(t, validateProtectedSettings(`{"inlineFiles": {"a.sh": "ZGF0ZQ=="}, "inlineBundle": "ZGF0ZQ=="}`))
+}
+
+func Test_validateInlineFileName(t *testing.T) {
+	for _, name := range []string{"a.sh", "lib/helper.sh", ".env", "a/b/c-d_e.f"} {
+		require.Nil(t, validateInlineFileName(name), name)
+	}
+	for _, name := range []string{"", "/etc/passwd", "../a", "a/../../b", "./a", "a//b", "a/", "a b", "stdout", "stderr", "script.sh"} {
+		require.NotNil(t, validateInlineFileName(name), name)
+	}
+}
+
+func Test_validate_inlineFiles(t *testing.T) {
+	h := handlerSettings{
+		publicSettings{CommandToExecute: "date", InlineFiles: map[string]inlineFile{"../a": {}}, InlineBundle: "ZGF0ZQ=="},
+		protectedSettings{InlineFiles: map[string]inlineFile{"b": {}}, InlineBundle: "ZGF0ZQ=="},
+	}
+	ewc := h.validate()
+	require.NotNil(t, ewc)
+	require.Equal(t, errorutil.CustomerInput_inlineFilesSpecifiedInTwoPlaces, ewc.ErrorCode)
+	require.Len(t, problemsOf(ewc.Err), 2)
+
+	h.publicSettings.InlineBundle = ""
+	h.protectedSettings.InlineFiles = nil
+	ewc = h.validate()
+	require.NotNil(t, ewc)
+	require.Equal(t, errorutil.CustomerInput_invalidInlineFile, ewc.ErrorCode)
+}
+
+func Test_writeInlineFiles(t *testing.T) {
+	dir := tempDir(t)
+	cfg := handlerSettings{publicSettings: publicSettings{InlineFiles: map[string]inlineFile{
+		"run.sh":        {Content: base64.StdEncoding.EncodeToString([]byte("#!/bin/sh\r\necho hi\r\n"))},
+		"lib/common.sh": {Content: base64.StdEncoding.EncodeToString(gzipBytes(t, []byte("x=1\n"))), Mode: "0640"},
+		"data.txt":      {Content: base64.StdEncoding.EncodeToString(zstdBytes(t, []byte("data"))), Mode: "600"},
+	}}}
+	require.Nil(t, writeInlineFiles(log.NewContext(log.NewNopLogger()), dir, cfg, nil))
+
+	requireFile(t, filepath.Join(dir, "run.sh"), "#!/bin/sh\necho hi\n", 0500)
+	requireFile(t, filepath.Join(dir, "lib", "common.sh"), "x=1\n", 0640)
+	requireFile(t, filepath.Join(dir, "data.txt"), "data", 0600)
+}
+
+func Test_writeInlineFiles_skipDos2Unix(t *testing.T) {
+	dir := tempDir(t)
+	cfg := handlerSettings{protectedSettings: protectedSettings{InlineFiles: map[string]inlineFile{
+		"run.sh": {Content: base64.StdEncoding.EncodeToString([]byte("echo hi\r\n"))},
+	}}}
+	cfg.publicSettings.SkipDos2Unix = true
+	require.Nil(t, writeInlineFiles(log.NewContext(log.NewNopLogger()), dir, cfg, nil))
+	requireFile(t, filepath.Join(dir, "run.sh"), "echo hi\r\n", 0500)
+}
+
+func Test_writeInlineFiles_bundle(t *testing.T) {
+	dir := tempDir(t)
+	bundle := tarBytes(t,
+		&tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "./bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "./bin/run.sh", Typeflag: tar.TypeReg, Mode: 0755, Size: 8},
+	)
+	cfg := handlerSettings{publicSettings: publicSettings{
+		InlineBundle: base64String(base64.StdEncoding.EncodeToString(gzipBytes(t, bundle))),
+		InlineFiles:  map[string]inlineFile{"config": {Content: "YT0x"}},
+	}}
+	require.Nil(t, writeInlineFiles(log.NewContext(log.NewNopLogger()), dir, cfg, nil))
+	requireFile(t, filepath.Join(dir, "bin", "run.sh"), "content\n", 0755)
+	requireFile(t, filepath.Join(dir, "config"), "a=1", 0500)
+}
+
+func Test_writeInlineFiles_bundleRejectsLinks(t *testing.T) {
+	for _, h := range []*tar.Header{
+		{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"},
+		{Name: "hard", Typeflag: tar.TypeLink, Linkname: "/etc/passwd"},
+		{Name: "../escape", Typeflag: tar.TypeReg, Size: 8},
+	} {
+		dir := tempDir(t)
+		cfg := handlerSettings{publicSettings: publicSettings{
+			InlineBundle: base64String(base64.StdEncoding.EncodeToString(gzipBytes(t, tarBytes(t, h)))),
+		}}
+		ewc := writeInlineFiles(log.NewContext(log.NewNopLogger()), dir, cfg, nil)
+		require.NotNil(t, ewc, h.Name)
+		require.Equal(t, errorutil.CustomerInput_invalidInlineFile, ewc.ErrorCode)
+		_, err := os.Lstat(filepath.Join(dir, h.Name))
+		require.True(t, os.IsNotExist(err), h.Name)
+	}
+}
+
+func Test_writeInlineFiles_maxSize(t *testing.T) {
+	big := bytes.Repeat([]byte("a"), maxInlineFilesSize/2+1)
+	cfg := handlerSettings{publicSettings: publicSettings{InlineFiles: map[string]inlineFile{
+		"a": {Content: base64.StdEncoding.EncodeToString(gzipBytes(t, big))},
+		"b": {Content: base64.StdEncoding.EncodeToString(gzipBytes(t, big))},
+	}}}
+	ewc := writeInlineFiles(log.NewContext(log.NewNopLogger()), tempDir(t), cfg, nil)
+	require.NotNil(t, ewc)
+	require.Equal(t, errorutil.CustomerInput_invalidInlineFile, ewc.ErrorCode)
+	require.Contains(t, ewc.Err.Error(), `inline file "b"`)
+}
+
+func Test_writeInlineFiles_requireSigningPolicy(t *testing.T) {
+	cfg := handlerSettings{publicSettings: publicSettings{InlineFiles: map[string]inlineFile{"a": {Content: "YT0x"}}}}
+	ewc := writeInlineFiles(log.NewContext(log.NewNopLogger()), tempDir(t), cfg, &CSEExtensionPolicySettings{RequireSigning: true})
+	require.NotNil(t, ewc)
+	require.Equal(t, errorutil.ExtensionPolicySettings_executionNotAllowed, ewc.ErrorCode)
+}
+
+func Test_runCmd_inlineFileToExecute(t *testing.T) {
+	dir := tempDir(t)
+	cfg := handlerSettings{publicSettings: publicSettings{
+		FileToExecute: "bin/hello.sh",
+		Arguments:     []string{"world"},
+		InlineFiles: map[string]inlineFile{
+			"bin/hello.sh": {Content: base64.StdEncoding.EncodeToString([]byte("#!/bin/sh\necho hello $1\n")), Mode: "0700"},
+		},
+	}}
+	require.Nil(t, writeInlineFiles(log.NewContext(log.NewNopLogger()), dir, cfg, nil))
+	require.Nil(t, runCmd(log.NewNopLogger(), dir, cfg, nil, nil))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "stdout"))
+	require.Nil(t, err)
+	require.Equal(t, "hello world\n", string(b))
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// tarBytes returns a tar archive of the entries, with "content\n" as the
+// content of the regular files.
+func tarBytes(t *testing.T, headers ...*tar.Header) []byte {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for _, h := range headers {
+		if h.Typeflag == tar.TypeReg {
+			h.Size = 8
+		}
+		require.Nil(t, w.WriteHeader(h))
+		if h.Typeflag == tar.TypeReg {
+			_, err := w.Write([]byte("content\n"))
+			require.Nil(t, err)
+		}
+	}
+	require.Nil(t, w.Close())
+	return buf.Bytes()
+}
+
+func requireFile(t *testing.T, path, content string, mode os.FileMode) {
+	b, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, content, string(b))
+	fi, err := os.Stat(path)
+	require.Nil(t, err)
+	require.Equal(t, mode, fi.Mode().Perm(), path)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+)
+
+var (
+	// extensionNameRegex restricts extension instance names to what can be
+	// safely used in file names.
+	extensionNameRegex = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+	// seqNumRegex matches the names which extension instance names must not
+	// take, since they are sequence numbers.
+	seqNumRegex = regexp.MustCompile(`^[0-9]+$`)
+)
+
+// validateExtensionName returns an error if name, the value of the
+// configExtensionName environment variable, is not usable.
+func validateExtensionName(name string) error {
+	if name != "" && (!extensionNameRegex.MatchString(name) || seqNumRegex.MatchString(name)) {
+		return fmt.Errorf("invalid extension name %q", name)
+	}
+	return nil
+}
+
+// instanceFileName returns the name of the file with the given extension (e.g.
+// ".settings") for the sequence number of the handled extension instance:
+// "{seqnum}{ext}", or "{extensionName}.{seqnum}{ext}" for a multi-config
+// extension.
+func instanceFileName(seqNum int, ext string) string {
+	if extensionName == "" {
+		return fmt.Sprintf("%d%s", seqNum, ext)
+	}
+	return fmt.Sprintf("%s.%d%s", extensionName, seqNum, ext)
+}
+
+// instanceFileRegex returns the regular expression matching the names
+// returned by instanceFileName for ext, with the sequence number as the
+// first submatch.
+func instanceFileRegex(ext string) string {
+	if extensionName == "" {
+		return fmt.Sprintf(`^(\d+)%s$`, regexp.QuoteMeta(ext))
+	}
+	return fmt.Sprintf(`^%s\.(\d+)%s$`, regexp.QuoteMeta(extensionName), regexp.QuoteMeta(ext))
+}
+
+// instanceMostRecentSequence returns the path of the mrseq file of the
+// handled extension instance.
+func instanceMostRecentSequence() string {
+	if extensionName == "" {
+		return mostRecentSequence
+	}
+	return extensionName + "." + mostRecentSequence
+}
+
+// instanceMostRecentSettingsHash returns the path of the mrhash file of the
+// handled extension instance.
+func instanceMostRecentSettingsHash() string {
+	if extensionName == "" {
+		return mostRecentSettingsHash
+	}
+	return extensionName + "." + mostRecentSettingsHash
+}
+
+// instanceLockPath returns the path of the file locked by the enable
+// invocations of the handled extension instance.
+func instanceLockPath() string {
+	if extensionName == "" {
+		return filepath.Join(dataDir, enableLockFile)
+	}
+	return filepath.Join(dataDir, extensionName+"."+enableLockFile)
+}
+
+// instanceDisabledPath returns the path of the marker left by disable for the
+// handled extension instance.
+func instanceDisabledPath() string {
+	if extensionName == "" {
+		return filepath.Join(dataDir, disabledMarker)
+	}
+	return filepath.Join(dataDir, extensionName+"."+disabledMarker)
+}
+
+// instanceStatePath returns the path of the state file of the sequence number
+// of the handled extension instance.
+func instanceStatePath(seqNum int) string {
+	return filepath.Join(dataDir, stateDir, instanceFileName(seqNum, stateFileSuffix))
+}
+
+// instanceDownloadDir returns the directory holding the download directories
+// of each sequence number of the handled extension instance. The ones of
+// multi-config extension instances are next to each other, the cleanup of one
+// instance doesn't remove the directories of another.
+func instanceDownloadDir() string {
+	return filepath.Join(dataDir, instanceDirName(downloadDir))
+}
+
+// instanceDirName returns the name of the dir directory of the handled
+// extension instance: dir, or "{dir}.{extensionName}" for a multi-config
+// extension.
+func instanceDirName(dir string) string {
+	if extensionName == "" {
+		return dir
+	}
+	return dir + "." + extensionName
+}
+
+// instanceHistoryDir returns the directory holding the run history of each
+// sequence number of the handled extension instance, laid out like
+// instanceDownloadDir.
+func instanceHistoryDir() string {
+	return filepath.Join(dataDir, instanceDirName(historyDir))
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_validateExtensionName(t *testing.T) {
+	for _, name := range []string{"", "a", "CustomScript_1", "my-ext.v2"} {
+		require.Nil(t, validateExtensionName(name), name)
+	}
+	for _, name := range []string{".", "..", "../a", "a/b", "a b", "-a", "5", "0123"} {
+		require.NotNil(t, validateExtensionName(name), name)
+	}
+}
+
+func Test_instanceNames(t *testing.T) {
+	require.Equal(t, "3.settings", instanceFileName(3, ".settings"))
+	require.Equal(t, "mrseq", instanceMostRecentSequence())
+	require.Equal(t, "mrhash", instanceMostRecentSettingsHash())
+	require.Equal(t, filepath.Join(dataDir, "download"), instanceDownloadDir())
+
+	setTestExtensionName(t, "a.b")
+	require.Equal(t, "a.b.3.settings", instanceFileName(3, ".settings"))
+	require.Equal(t, "a.b.mrseq", instanceMostRecentSequence())
+	require.Equal(t, "a.b.mrhash", instanceMostRecentSettingsHash())
+	require.Equal(t, filepath.Join(dataDir, "download.a.b"), instanceDownloadDir())
+	require.Equal(t, filepath.Join(dataDir, "history.a.b"), instanceHistoryDir())
+	require.Regexp(t, instanceFileRegex(".status"), "a.b.12.status")
+	require.NotRegexp(t, instanceFileRegex(".status"), "aXb.12.status")
+	require.NotRegexp(t, instanceFileRegex(".status"), "a.b.c.12.status")
+}
+
+func Test_FindSeqNum_extensionName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	for _, f := range []string{"a.1.settings", "a.10.settings", "a.2.settings", "b.20.settings", "a.b.30.settings"} {
+		require.Nil(t, writeToFile(filepath.Join(dir, f), ""))
+	}
+
+	setTestExtensionName(t, "a")
+	seq, err := FindSeqNumConfig(dir)
+	require.Nil(t, err)
+	require.Equal(t, 10, seq)
+
+	setTestExtensionName(t, "a.b")
+	seq, err = FindSeqNumConfig(dir)
+	require.Nil(t, err)
+	require.Equal(t, 30, seq)
+
+	setTestExtensionName(t, "c")
+	_, err = FindSeqNumConfig(dir)
+	require.NotNil(t, err, "no files of the instance")
+
+	// a single-config extension does not expect named files
+	setTestExtensionName(t, "")
+	_, err = FindSeqNumConfig(dir)
+	require.NotNil(t, err)
+}
+
+func Test_reportStatus_extensionName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	setTestExtensionName(t, "a")
+
+	fakeEnv := HandlerEnvironment{}
+	fakeEnv.HandlerEnvironment.StatusFolder = dir
+	require.Nil(t, reportStatus(log.NewContext(log.NewNopLogger()), fakeEnv, 4, StatusSuccess, cmdEnable, ""))
+	status, err := readStatus(log.NewContext(log.NewNopLogger()), fakeEnv, 4)
+	require.Nil(t, err)
+	require.Equal(t, StatusSuccess, status)
+	require.True(t, fileExists(t, filepath.Join(dir, "a.4.status")))
+	require.False(t, fileExists(t, filepath.Join(dir, "4.status")))
+}
+
+func Test_clearSettingsAndScriptExceptMostRecent_extensionName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(d string) { dataDir = d }(dataDir)
+	dataDir = filepath.Join(dir, "data")
+	configFolder := filepath.Join(dir, "config")
+	require.Nil(t, os.MkdirAll(configFolder, 0700))
+	for _, d := range []string{"download.a/1", "download.a/2", "download.b/1", "download/1"} {
+		require.Nil(t, os.MkdirAll(filepath.Join(dataDir, d), 0700))
+	}
+	for _, f := range []string{"a.1.settings", "a.2.settings", "b.1.settings"} {
+		require.Nil(t, writeToFile(filepath.Join(configFolder, f), "{}"))
+	}
+
+	setTestExtensionName(t, "a")
+	hEnv := HandlerEnvironment{}
+	hEnv.HandlerEnvironment.ConfigFolder = configFolder
+	clearSettingsAndScriptExceptMostRecent(2, log.NewContext(log.NewNopLogger()), hEnv)
+
+	// only the older files of the instance are cleared
+	require.False(t, fileExists(t, filepath.Join(dataDir, "download.a", "1")))
+	require.True(t, fileExists(t, filepath.Join(dataDir, "download.a", "2")))
+	require.True(t, fileExists(t, filepath.Join(dataDir, "download.b", "1")))
+	require.True(t, fileExists(t, filepath.Join(dataDir, "download", "1")))
+	for f, want := range map[string]string{"a.1.settings": "", "a.2.settings": "{}", "b.1.settings": "{}"} {
+		b, err := ioutil.ReadFile(filepath.Join(configFolder, f))
+		require.Nil(t, err)
+		require.Equal(t, want, string(b), f)
+	}
+}
+
+func Test_clearSettingsAndScriptExceptMostRecent_newerSettings(t *testing.T) {
+	setTestDataDir(t)
+	configFolder := tempDir(t)
+	require.Nil(t, os.MkdirAll(filepath.Join(dataDir, downloadDir, "1"), 0700))
+	require.Nil(t, writeToFile(filepath.Join(configFolder, "2.settings"), "{}"))
+	require.Nil(t, writeToFile(filepath.Join(configFolder, "1.settings"), "{}"))
+
+	hEnv := HandlerEnvironment{}
+	hEnv.HandlerEnvironment.ConfigFolder = configFolder
+	clearSettingsAndScriptExceptMostRecent(1, log.NewContext(log.NewNopLogger()), hEnv)
+
+	// 2 waits for the enable lock, its settings stay, even though written first
+	b, err := ioutil.ReadFile(filepath.Join(configFolder, "2.settings"))
+	require.Nil(t, err)
+	require.Equal(t, "{}", string(b))
+
+	// once 2 ran, the older settings are cleared
+	clearSettingsAndScriptExceptMostRecent(2, log.NewContext(log.NewNopLogger()), hEnv)
+	b, err = ioutil.ReadFile(filepath.Join(configFolder, "1.settings"))
+	require.Nil(t, err)
+	require.Empty(t, b)
+}
+
+func setTestExtensionName(t *testing.T, name string) {
+	orig := extensionName
+	extensionName = name
+	t.Cleanup(func() { extensionName = orig })
+}
+
+func Test_clearSettingsAndScriptExceptMostRecent_keepsOtherInstances(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(d string) { dataDir = d }(dataDir)
+	dataDir = filepath.Join(dir, "data")
+	configFolder := filepath.Join(dir, "config")
+	require.Nil(t, os.MkdirAll(configFolder, 0700))
+	for _, d := range []string{"download/1", "download/2", "download.a/1", "download.5x/1"} {
+		require.Nil(t, os.MkdirAll(filepath.Join(dataDir, d), 0700))
+	}
+	require.Nil(t, writeToFile(filepath.Join(configFolder, "2.settings"), "{}"))
+
+	hEnv := HandlerEnvironment{}
+	hEnv.HandlerEnvironment.ConfigFolder = configFolder
+	clearSettingsAndScriptExceptMostRecent(2, log.NewContext(log.NewNopLogger()), hEnv)
+
+	require.False(t, fileExists(t, filepath.Join(dataDir, "download", "1")))
+	require.True(t, fileExists(t, filepath.Join(dataDir, "download", "2")))
+	require.True(t, fileExists(t, filepath.Join(dataDir, "download.a", "1")), "the unnamed instance leaves named ones alone")
+	require.True(t, fileExists(t, filepath.Join(dataDir, "download.5x", "1")))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	vmextension "github.com/Azure/azure-extension-platform/vmextension"
+	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
+	"github.com/pkg/errors"
+)
+
+// What an enable invocation does while another one holds the enable lock, see
+// publicSettings.ConcurrentEnable.
+const (
+	concurrentEnableWait = "wait"
+	concurrentEnableSkip = "skip"
+
+	// defaultLockTimeout is how long an invocation waits for the lock by
+	// default.
+	defaultLockTimeout = 30 * time.Minute
+)
+
+var (
+	// enableLockFile is the file under dataDir locked by enable invocations.
+	enableLockFile = "enable.lock"
+
+	// lockPollInterval is how often a waiting invocation tries to take the
+	// lock.
+	lockPollInterval = time.Second
+
+	errLockBusy = errors.New("the enable lock is held by another invocation")
+)
+
+// lockWaitMsg is set by enablePre when the invocation waited for another one
+// to release the enable lock. enable adds it to the status message.
+var lockWaitMsg string
+
+// heldLock is the open lock file once the process holds the enable lock.
+// enable --detach hands it over to the invocation it starts.
+var heldLock *os.File
+
+// lockHolder is the content of the lock file: the invocation holding it.
+type lockHolder struct {
+	Pid    int `json:"pid"`
+	SeqNum int `json:"seqNum"`
+}
+
+// lockSettingsOf returns how long to wait for the enable lock according to
+// the first runtime settings block: zero to skip the invocation if another
+// one holds it.
+func lockSettingsOf(pub []map[string]interface{}) time.Duration {
+	if len(pub) == 0 {
+		return defaultLockTimeout
+	}
+	if mode, _ := pub[0]["concurrentEnable"].(string); mode == concurrentEnableSkip {
+		return 0
+	}
+	if secs, ok := pub[0]["lockTimeoutInSeconds"].(float64); ok && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	return defaultLockTimeout
+}
+
+// acquireEnableLock takes an exclusive lock on the file at path for the rest
+// of the process, the kernel releases it when the process exits. If another
+// process holds it, it retries for up to wait. It returns how long it waited
+// and the invocation it waited for, if any. If the lock is still held after
+// wait, the error is errLockBusy. If the process already holds it, it only
+// records seqNum as the one handled.
+func acquireEnableLock(path string, seqNum int, wait time.Duration) (time.Duration, *lockHolder, error) {
+	if heldLock != nil && heldLock.Name() == path {
+		writeLockHolder(heldLock, seqNum)
+		return 0, nil, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, nil, errors.Wrap(err, "failed to create lock directory")
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "failed to open lock file")
+	}
+
+	begin := time.Now()
+	var holder *lockHolder
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			return 0, nil, errors.Wrap(err, "failed to lock")
+		}
+		if h := readLockHolder(path); h != nil {
+			holder = h
+		}
+		if time.Since(begin) >= wait {
+			f.Close()
+			return time.Since(begin), holder, errLockBusy
+		}
+		time.Sleep(lockPollInterval)
+	}
+
+	// the file stays open, and locked, until the process exits
+	heldLock = f
+	writeLockHolder(f, seqNum)
+	return time.Since(begin), holder, nil
+}
+
+// writeLockHolder records this process, handling seqNum, as the holder of the
+// locked file f.
+func writeLockHolder(f *os.File, seqNum int) {
+	b, _ := json.Marshal(lockHolder{Pid: os.Getpid(), SeqNum: seqNum})
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt(b, 0)
+	}
+}
+
+// readLockHolder returns the invocation which holds the lock file at path, or
+// nil if unknown.
+func readLockHolder(path string) *lockHolder {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var h lockHolder
+	if json.Unmarshal(b, &h) != nil || h.Pid == 0 {
+		return nil
+	}
+	return &h
+}
+
+// concurrentEnableError returns the error reported for an invocation which
+// didn't run because another one held the enable lock.
+func concurrentEnableError(holder *lockHolder, waited time.Duration) *vmextension.ErrorWithClarification {
+	who := "another enable invocation"
+	if holder != nil {
+		who = fmt.Sprintf("another enable invocation (pid %d, sequence number %d)", holder.Pid, holder.SeqNum)
+	}
+	msg := who + " is running, this one was skipped"
+	if waited > 0 {
+		msg = fmt.Sprintf("%s is still running after %v, this one was skipped", who, waited.Round(time.Second))
+	}
+	return vmextension.NewErrorWithClarificationPtr(errorutil.CommandExecution_concurrentEnable, errors.New(msg))
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_lockSettingsOf(t *testing.T) {
+	require.Equal(t, defaultLockTimeout, lockSettingsOf(nil))
+	require.Equal(t, defaultLockTimeout, lockSettingsOf([]map[string]interface{}{{"concurrentEnable": "wait"}}))
+	require.Equal(t, time.Duration(0), lockSettingsOf([]map[string]interface{}{{"concurrentEnable": "skip", "lockTimeoutInSeconds": 5.0}}))
+	require.Equal(t, 5*time.Second, lockSettingsOf([]map[string]interface{}{{"lockTimeoutInSeconds": 5.0}}))
+}
+
+func Test_acquireEnableLock(t *testing.T) {
+	path := filepath.Join(tempDir(t), "data", "enable.lock")
+	waited, holder, err := acquireEnableLock(path, 1, 0)
+	require.Nil(t, err)
+	require.Nil(t, holder)
+	require.True(t, waited < time.Second)
+	require.Equal(t, &lockHolder{Pid: os.Getpid(), SeqNum: 1}, readLockHolder(path))
+
+	// the process holds it already
+	_, holder, err = acquireEnableLock(path, 2, 0)
+	require.Nil(t, err)
+	require.Nil(t, holder)
+	require.Equal(t, &lockHolder{Pid: os.Getpid(), SeqNum: 2}, readLockHolder(path))
+
+	// a lock is per open file, another one of this process conflicts
+	defer func(f *os.File) { heldLock = nil; f.Close() }(heldLock)
+	heldLock = nil
+	_, holder, err = acquireEnableLock(path, 3, 0)
+	require.Equal(t, errLockBusy, err)
+	require.Equal(t, &lockHolder{Pid: os.Getpid(), SeqNum: 2}, holder)
+}
+
+func Test_acquireEnableLock_wait(t *testing.T) {
+	defer func(d time.Duration) { lockPollInterval = d }(lockPollInterval)
+	lockPollInterval = 10 * time.Millisecond
+
+	path := filepath.Join(tempDir(t), "enable.lock")
+	f := lockFile(t, path)
+	require.Nil(t, writeToFile(path, `{"pid": 42, "seqNum": 3}`))
+
+	_, holder, err := acquireEnableLock(path, 4, 50*time.Millisecond)
+	require.Equal(t, errLockBusy, err, "timed out")
+	require.Equal(t, &lockHolder{Pid: 42, SeqNum: 3}, holder)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		f.Close()
+	}()
+	waited, holder, err := acquireEnableLock(path, 4, 10*time.Second)
+	require.Nil(t, err)
+	require.Equal(t, &lockHolder{Pid: 42, SeqNum: 3}, holder)
+	require.True(t, waited >= 100*time.Millisecond)
+	require.Equal(t, &lockHolder{Pid: os.Getpid(), SeqNum: 4}, readLockHolder(path))
+}
+
+func Test_concurrentEnableError(t *testing.T) {
+	ewc := concurrentEnableError(&lockHolder{Pid: 42, SeqNum: 3}, 0)
+	require.Equal(t, errorutil.CommandExecution_concurrentEnable, ewc.ErrorCode)
+	require.Equal(t, "another enable invocation (pid 42, sequence number 3) is running, this one was skipped", ewc.Err.Error())
+
+	ewc = concurrentEnableError(nil, 90*time.Second)
+	require.Equal(t, "another enable invocation is still running after 1m30s, this one was skipped", ewc.Err.Error())
+}
+
+// lockFile locks the file at path like another enable invocation would.
+func lockFile(t *testing.T, path string) *os.File {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	require.Nil(t, err)
+	t.Cleanup(func() { f.Close() })
+	require.Nil(t, syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB))
+	return f
+}
@@ -1,18 +1,20 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"syscall"
 
 	"github.com/pkg/errors"
 )
 
 // tailFile returns the last max bytes (or the entire file if the file size is
-// smaller than max) from the file at path. If the file does not exist, it
-// returns a nil slice and no error.
+// smaller than max) from the file at path, opened by openOutput. If the file
+// does not exist, it returns a nil slice and no error.
 func tailFile(path string, max int64) ([]byte, error) {
-	f, err := os.Open(path)
+	f, err := openOutput(path)
 	if err != nil && os.IsNotExist(err) {
 		return nil, nil
 	} else if err != nil {
@@ -38,3 +40,23 @@ func tailFile(path string, max int64) ([]byte, error) {
 	b, err := ioutil.ReadAll(io.LimitReader(f, max))
 	return b, errors.Wrap(err, "error reading from file")
 }
+
+// openOutput opens the output file of a command at path for reading. The
+// command may have created files in the directory of path: symbolic links,
+// which would have the handler read other files, and anything but regular
+// files are refused.
+func openOutput(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err == nil && !fi.Mode().IsRegular() {
+		err = fmt.Errorf("%s is not a regular file", path)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
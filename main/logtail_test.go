@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"syscall"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -25,6 +27,21 @@ func Test_tailFile_openError(t *testing.T) {
 	require.Regexp(t, `^error opening file:`, err.Error())
 }
 
+func Test_tailFile_notRegular(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	tf := tempFile(t)
+	defer os.RemoveAll(tf)
+
+	require.Nil(t, os.Symlink(tf, filepath.Join(dir, "link")))
+	_, err = tailFile(filepath.Join(dir, "link"), 1024)
+	require.NotNil(t, err, "symbolic links are not followed")
+	require.Nil(t, syscall.Mkfifo(filepath.Join(dir, "fifo"), 0600))
+	_, err = tailFile(filepath.Join(dir, "fifo"), 1024)
+	require.NotNil(t, err, "only regular files are read")
+}
+
 func Test_tailFile(t *testing.T) {
 	tf := tempFile(t)
 	defer os.RemoveAll(tf)
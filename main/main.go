@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"strconv"
 	"strings"
@@ -24,22 +25,75 @@ var (
 	// incorrect. The correct way is mrseq.  This file is auto-preserved by the agent.
 	mostRecentSequence = "mrseq"
 
+	// mostRecentSettingsHash holds the hash of the settings which ran last,
+	// next to mostRecentSequence, for the rerun policies.
+	mostRecentSettingsHash = "mrhash"
+
+	// stateVersionFile holds the version of the layout of the state, up to
+	// which the migrations ran, see migrate.go. Stored under dataDir.
+	stateVersionFile = "version"
+
+	// stateDir is where the progress of each sequence number is stored as
+	// "{stateDir}/{seqnum}.state", see pkg/state. Stored under dataDir.
+	stateDir = "state"
+
 	// downloadDir is where we store the downloaded files in the "{downloadDir}/{seqnum}/file"
-	// format and the logs as "{downloadDir}/{seqnum}/std(out|err)". Stored under dataDir
+	// format and the logs as "{downloadDir}/{seqnum}/std(out|err)". Stored under dataDir.
+	// Multi-config extension instances use "{downloadDir}.{extensionName}/{seqnum}".
 	downloadDir = "download"
 
+	// historyDir is where the output and result of the scheduled runs are
+	// kept, in the layout of downloadDir with a directory per run. Stored
+	// under dataDir.
+	historyDir = "history"
+
+	// quarantineDir is where files that failed extension policy validation are
+	// moved to when the policy asks for it, in "{quarantineDir}/{entry}/" format
+	// with the file content and its metadata. Stored under dataDir.
+	quarantineDir = "quarantine"
+
+	// policyTrustAnchorPath holds the pinned PEM public key(s) or CA certificate(s)
+	// used to verify the detached signature of the extension policy file. If it
+	// exists, the policy must be signed. It is deliberately outside of the config
+	// folder so that whoever can write the policy cannot also replace the key.
+	policyTrustAnchorPath = "/etc/azure/custom-script/policy-trust.pem"
+
+	// secretsDir holds the secrets referenced in the settings, one file per
+	// secret named after it, if no secret vault is configured. Only root may
+	// have access to it.
+	secretsDir = "/etc/azure/custom-script/secrets"
+
 	// configSequenceNumber environment variable should be set by VMAgent to sequence number
 	configSequenceNumber = "ConfigSequenceNumber"
+
+	// configExtensionName environment variable is set by VMAgent to the name of
+	// the extension instance for multi-config extensions
+	configExtensionName = "ConfigExtensionName"
+
+	// extensionName is the name of the handled extension instance, read from
+	// configExtensionName. Its settings, status and mrseq files are prefixed
+	// with "{extensionName}.". Empty for a single-config extension.
+	extensionName = ""
 )
 
 func main() {
-	ctx := log.NewContext(log.NewSyncLogger(log.NewLogfmtLogger(
-		os.Stdout))).With("time", log.DefaultTimestamp).With("version", VersionString())
+	ctx := newLogContext(os.Stdout)
 
 	// parse command line arguments
-	cmd := parseCmd(os.Args)
+	cmd, args := parseCmd(os.Args)
+	if cmd.standalone != nil {
+		os.Exit(cmd.standalone(args))
+	}
+	detach := len(args) == 1 && args[0] == detachFlag
 	ctx = ctx.With("operation", strings.ToLower(cmd.name))
 
+	// the enable invocation started by enable --detach
+	detached, err := readHandoff()
+	if err != nil {
+		ctx.Log("message", "failed to read handoff", "error", err)
+		os.Exit(cmd.failExitCode)
+	}
+
 	// parse extension environment
 	hEnv, err := GetHandlerEnv()
 	if err != nil {
@@ -47,6 +101,23 @@ func main() {
 		os.Exit(cmd.failExitCode)
 	}
 
+	// the detached invocation logs to its stdout, which is the handler log
+	logFile, err := openHandlerLog(hEnv)
+	if err != nil {
+		ctx.Log("message", "failed to open handler log", "error", err)
+	} else if detached == nil {
+		ctx = newLogContext(io.MultiWriter(os.Stdout, logFile)).With("operation", strings.ToLower(cmd.name))
+	}
+
+	extensionName = os.Getenv(configExtensionName)
+	if err := validateExtensionName(extensionName); err != nil {
+		ctx.Log("message", "failed to parse env variable "+configExtensionName, "error", err)
+		os.Exit(cmd.failExitCode)
+	}
+	if extensionName != "" {
+		ctx = ctx.With("extensionName", extensionName)
+	}
+
 	seqNum := -1
 	// Agent should set env variable sequence number
 	seqNumVariable := os.Getenv(configSequenceNumber)
@@ -70,7 +141,19 @@ func main() {
 
 	// check sub-command preconditions, if any, before executing
 	ctx.Log("event", "start")
-	if cmd.pre != nil {
+	if detach {
+		pid, err := detachEnable(ctx, hEnv, seqNum, cmd, logFile)
+		if err != nil {
+			ctx.Log("event", "detach failed", "error", err)
+			os.Exit(cmd.failExitCode)
+		}
+		ctx.Log("event", "detached", "pid", pid)
+		return
+	}
+	if detached != nil && detached.PreDone {
+		ctx.Log("event", "pre-check done before detaching")
+		detached.restore(seqNum)
+	} else if cmd.pre != nil {
 		ctx.Log("event", "pre-check")
 		if err := cmd.pre(ctx, hEnv, seqNum); err != nil {
 			ctx.Log("event", "pre-check failed", "error", err)
@@ -79,21 +162,31 @@ func main() {
 	}
 	// execute the subcommand
 	reportStatus(ctx, hEnv, seqNum, StatusTransitioning, cmd, "")
-	msg, ewc := cmd.f(ctx, hEnv, seqNum)
+	hb := startHeartbeat(ctx, hEnv, cmd)
+	msg, substatus, ewc := cmd.f(ctx, hEnv, seqNum)
+	hb.stop(ewc)
 	if ewc != nil && ewc.Err != nil {
 		ctx.Log("event", "failed to handle", "error", ewc.Error())
 		ewc.Err = errors.Wrap(ewc.Err, ewc.Error()+msg)
-		reportErrorStatus(ctx, hEnv, seqNum, StatusError, cmd, ewc)
+		reportErrorStatus(ctx, hEnv, seqNum, StatusError, cmd, ewc, substatus...)
 		os.Exit(cmd.failExitCode)
 	}
-	reportStatus(ctx, hEnv, seqNum, StatusSuccess, cmd, msg)
+	reportStatus(ctx, hEnv, seqNum, StatusSuccess, cmd, msg, substatus...)
 	ctx.Log("event", "end")
 }
 
-// parseCmd looks at os.Args and parses the subcommand. If it is invalid,
-// it prints the usage string and an error message and exits with code 0.
-func parseCmd(args []string) cmd {
-	if len(os.Args) != 2 {
+// newLogContext returns the logger of the handler, writing to w.
+func newLogContext(w io.Writer) *log.Context {
+	return log.NewContext(log.NewSyncLogger(log.NewLogfmtLogger(
+		w))).With("time", log.DefaultTimestamp).With("version", VersionString())
+}
+
+// parseCmd looks at os.Args and parses the subcommand and the arguments
+// following it. Only standalone commands, and enable with detachFlag, take
+// arguments. If it is invalid, it prints the usage string and an error
+// message and exits with code 2.
+func parseCmd(args []string) (cmd, []string) {
+	if len(os.Args) < 2 {
 		printUsage(args)
 		fmt.Println("Incorrect usage.")
 		os.Exit(2)
@@ -105,7 +198,13 @@ func parseCmd(args []string) cmd {
 		fmt.Printf("Incorrect command: %q\n", op)
 		os.Exit(2)
 	}
-	return cmd
+	detach := op == "enable" && len(os.Args) == 3 && os.Args[2] == detachFlag
+	if cmd.standalone == nil && len(os.Args) != 2 && !detach {
+		printUsage(args)
+		fmt.Println("Incorrect usage.")
+		os.Exit(2)
+	}
+	return cmd, os.Args[2:]
 }
 
 // printUsage prints the help string and version of the program to stdout with a
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/atomicfile"
+	"github.com/Azure/custom-script-extension-linux/pkg/seqnum"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// migration converts the state left by an older version of the extension
+// handler to the layout of the next state version.
+type migration struct {
+	name string
+	run  func(ctx log.Logger) error
+}
+
+// migrations convert the state to the current layout, in order: migrations[i]
+// converts state version i to i+1, the current version is len(migrations).
+// Only append to it, the state version of each entry is stamped in dataDir.
+var migrations = []migration{
+	{"convert the legacy seqnum file to mrseq", migrateSeqNumFile},
+}
+
+// migrate runs the migrations from the state version stamped in dataDir to
+// the current one, stamping the version after each. It stops at the first
+// failure, whose migration runs again the next time; the state is left as the
+// earlier migrations converted it.
+func migrate(ctx log.Logger) error {
+	from, err := readStateVersion()
+	if err != nil {
+		return err
+	}
+	if from > len(migrations) {
+		ctx.Log("event", "state of a newer version, not migrated", "version", from)
+		return nil
+	}
+	for v := from; v < len(migrations); v++ {
+		m := migrations[v]
+		ctx.Log("event", "migrating state", "from", v, "migration", m.name)
+		begin := time.Now()
+		err := m.run(ctx)
+		telemetry("migration", strconv.Itoa(v+1)+";"+m.name, err == nil, time.Since(begin))
+		if err != nil {
+			return errors.Wrapf(err, "state migration %d (%s) failed", v+1, m.name)
+		}
+		if err := writeStateVersion(v + 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readStateVersion returns the state version stamped in dataDir, 0 if none.
+func readStateVersion() (int, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dataDir, stateVersionFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, errors.Wrap(err, "failed to read state version")
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || v < 0 {
+		return 0, errors.Errorf("invalid state version %q", string(b))
+	}
+	return v, nil
+}
+
+func writeStateVersion(v int) error {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return errors.Wrap(err, "failed to create data dir")
+	}
+	return errors.Wrap(atomicfile.WriteFile(filepath.Join(dataDir, stateVersionFile), []byte(strconv.Itoa(v)), 0600),
+		"failed to write state version")
+}
+
+// migrateSeqNumFile converts the seqnum file of dataDir, used before mrseq, to
+// mrseq if there is none yet, and removes it. An existing mrseq is kept as is.
+// seqnum predates multiple extension instances, it belongs to the
+// single-config extension.
+func migrateSeqNumFile(ctx log.Logger) error {
+	legacy := filepath.Join(dataDir, seqNumFile)
+	seq, ok, err := seqnum.Get(legacy)
+	if err != nil {
+		return errors.Wrap(err, "failed to read legacy seqnum file")
+	}
+	if !ok {
+		return nil
+	}
+	if _, ok, err := seqnum.Get(mostRecentSequence); err != nil {
+		return errors.Wrap(err, "failed to read mrseq")
+	} else if !ok {
+		if err := seqnum.Set(mostRecentSequence, seq); err != nil {
+			return errors.Wrap(err, "failed to write mrseq")
+		}
+		ctx.Log("event", "converted legacy seqnum file", "seq", seq)
+	}
+	return errors.Wrap(os.Remove(legacy), "failed to remove legacy seqnum file")
+}
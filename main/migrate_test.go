@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_migrate(t *testing.T) {
+	setTestDataDir(t)
+	setTestMostRecentSequence(t)
+	require.Nil(t, writeToFile(filepath.Join(dataDir, seqNumFile), "5"))
+
+	require.Nil(t, migrate(log.NewNopLogger()))
+	requireFileContent(t, mostRecentSequence, "5")
+	require.False(t, fileExists(t, filepath.Join(dataDir, seqNumFile)))
+	v, err := readStateVersion()
+	require.Nil(t, err)
+	require.Equal(t, len(migrations), v)
+
+	// nothing left to migrate
+	require.Nil(t, writeToFile(filepath.Join(dataDir, seqNumFile), "6"))
+	require.Nil(t, migrate(log.NewNopLogger()))
+	require.True(t, fileExists(t, filepath.Join(dataDir, seqNumFile)))
+}
+
+func Test_migrate_keepsMrseq(t *testing.T) {
+	setTestDataDir(t)
+	setTestMostRecentSequence(t)
+	require.Nil(t, writeToFile(filepath.Join(dataDir, seqNumFile), "5"))
+	require.Nil(t, writeToFile(mostRecentSequence, "7"))
+
+	require.Nil(t, migrate(log.NewNopLogger()))
+	requireFileContent(t, mostRecentSequence, "7")
+	require.False(t, fileExists(t, filepath.Join(dataDir, seqNumFile)))
+}
+
+func Test_migrate_failure(t *testing.T) {
+	setTestDataDir(t)
+	defer func(m []migration) { migrations = m }(migrations)
+	var ran []string
+	migrations = []migration{
+		{"first", func(log.Logger) error { ran = append(ran, "first"); return nil }},
+		{"second", func(log.Logger) error { ran = append(ran, "second"); return errors.New("boom") }},
+	}
+
+	err := migrate(log.NewNopLogger())
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "state migration 2 (second) failed: boom")
+	v, err := readStateVersion()
+	require.Nil(t, err)
+	require.Equal(t, 1, v, "the version of the last successful migration")
+
+	// only the failed migration runs again
+	require.NotNil(t, migrate(log.NewNopLogger()))
+	require.Equal(t, []string{"first", "second", "second"}, ran)
+}
+
+func Test_migrate_newerVersion(t *testing.T) {
+	setTestDataDir(t)
+	require.Nil(t, writeStateVersion(len(migrations)+1))
+	require.Nil(t, migrate(log.NewNopLogger()))
+
+	require.Nil(t, writeToFile(filepath.Join(dataDir, stateVersionFile), "x"))
+	require.NotNil(t, migrate(log.NewNopLogger()))
+}
+
+// setTestMostRecentSequence points mostRecentSequence to a file in a new
+// temporary directory.
+func setTestMostRecentSequence(t *testing.T) {
+	orig := mostRecentSequence
+	mostRecentSequence = filepath.Join(tempDir(t), "mrseq")
+	t.Cleanup(func() { mostRecentSequence = orig })
+}
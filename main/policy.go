@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Azure/azure-extension-platform/pkg/extensionpolicysettings"
+	"github.com/Azure/azure-extension-platform/vmextension"
+	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
+	"github.com/Azure/custom-script-extension-linux/pkg/signature"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+type CSEExtensionPolicySettings struct {
+	RequireSigning bool     `json:"requireSigning"`
+	FileRootCertCA string   `json:"fileRootCertCA,omitempty"` // optional field for customer that want to specify a root cert or public key for script signature verification. This is a path to a cert or key file on the VM that the extension can use to verify script signatures. The customer is responsible for ensuring the cert is there and updated as needed (e.g. if the cert expires). The customer can choose to use this field or not based on their needs.
+	AllowedScripts []string `json:"allowedScripts"`
+
+	// BlockedFileAction decides what happens to a downloaded file that fails
+	// policy validation: "keep" (default) leaves it in the download directory,
+	// "quarantine" moves it under the quarantine directory and "delete" removes it.
+	BlockedFileAction string `json:"blockedFileAction,omitempty"`
+	// QuarantineMaxSizeBytes caps the total size of quarantined files. Oldest
+	// entries are evicted first. Zero means defaultQuarantineMaxSize.
+	QuarantineMaxSizeBytes int64 `json:"quarantineMaxSizeBytes,omitempty"`
+
+	// MaxExecutionSeconds caps how long the command may run. Zero means no cap.
+	MaxExecutionSeconds int `json:"maxExecutionSeconds,omitempty"`
+	// AllowedRunAsUsers lists the users the command may run as. Empty allows any user.
+	AllowedRunAsUsers []string `json:"allowedRunAsUsers,omitempty"`
+	// DenyRoot forbids running the command as root.
+	DenyRoot bool `json:"denyRoot,omitempty"`
+}
+
+// ValidateFormat checks the policy for inconsistent values, reporting all of
+// the problems found in a single error.
+func (cseps CSEExtensionPolicySettings) ValidateFormat() error {
+	if problems := cseps.formatProblems(); len(problems) > 0 {
+		return fmt.Errorf("invalid policy settings: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (cseps CSEExtensionPolicySettings) formatProblems() (problems []string) {
+	if cseps.RequireSigning && len(cseps.FileRootCertCA) == 0 {
+		problems = append(problems, "if RequireSigning is true, fileRootCertCA must be provided")
+	}
+	switch cseps.BlockedFileAction {
+	case "", blockedFileActionKeep, blockedFileActionQuarantine, blockedFileActionDelete:
+	default:
+		problems = append(problems, fmt.Sprintf("unknown blockedFileAction %q, must be one of %q, %q or %q",
+			cseps.BlockedFileAction, blockedFileActionKeep, blockedFileActionQuarantine, blockedFileActionDelete))
+	}
+	if cseps.QuarantineMaxSizeBytes < 0 {
+		problems = append(problems, "quarantineMaxSizeBytes must not be negative")
+	}
+	if cseps.MaxExecutionSeconds < 0 {
+		problems = append(problems, "maxExecutionSeconds must not be negative")
+	}
+	if cseps.DenyRoot && containsString(cseps.AllowedRunAsUsers, "root") {
+		problems = append(problems, "allowedRunAsUsers contains root while denyRoot is set")
+	}
+	return problems
+}
+
+// contentProblems runs the checks which need to look beyond the policy file
+// itself, such as the referenced certificate file and the allowlist hashes.
+func (cseps CSEExtensionPolicySettings) contentProblems() (problems []string) {
+	if cseps.FileRootCertCA != "" {
+		if _, err := loadTrustAnchors(cseps.FileRootCertCA); err != nil {
+			problems = append(problems, fmt.Sprintf("fileRootCertCA: %v", err))
+		}
+	}
+	for i, h := range cseps.AllowedScripts {
+		if b, err := hex.DecodeString(h); err != nil || len(b) != 32 {
+			problems = append(problems, fmt.Sprintf("allowedScripts[%d]: %q is not a hex encoded SHA256 hash", i, h))
+		}
+	}
+	return problems
+}
+
+const (
+	// policySignatureSuffix is appended to the policy file path to find its
+	// detached signature (raw or base64 encoded).
+	policySignatureSuffix = ".sig"
+	// policySigningCertSuffix is appended to the policy file path to find the
+	// optional PEM signing certificate chain, needed when the pinned trust
+	// anchor is a CA rather than a public key.
+	policySigningCertSuffix = ".crt"
+)
+
+// loadExtensionPolicy loads the extension policy at policyPath. If the file does
+// not exist, nil manager and settings are returned without error, meaning that
+// the default extension behavior applies.
+//
+// If a trust anchor is pinned at policyTrustAnchorPath, the policy must exist
+// and carry a valid detached signature, otherwise loading fails closed.
+func loadExtensionPolicy(ctx *log.Context, policyPath string) (*extensionpolicysettings.ExtensionPolicySettingsManager[CSEExtensionPolicySettings], *CSEExtensionPolicySettings, *vmextension.ErrorWithClarification) {
+	signed, err := pathExists(policyTrustAnchorPath)
+	if err != nil {
+		return nil, nil, vmextension.NewErrorWithClarificationPtr(errorutil.ExtensionPolicySettings_policyLoadFailed, errors.Wrap(err, "failed to check for the policy trust anchor"))
+	}
+
+	if _, err := os.Stat(policyPath); os.IsNotExist(err) {
+		if signed {
+			// removing the policy would loosen it just as well as editing it
+			return nil, nil, vmextension.NewErrorWithClarificationPtr(errorutil.ExtensionPolicySettings_policyLoadFailed,
+				fmt.Errorf("extension policy signing is enforced by %s, but the policy file does not exist", policyTrustAnchorPath))
+		}
+		ctx.Log("message", "extension policy settings file does not exist, proceeding with default extension behavior.", "path", policyPath)
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, vmextension.NewErrorWithClarificationPtr(errorutil.ExtensionPolicySettings_policyLoadFailed, errors.Wrap(err, "error while checking for extension policy settings file. Stat failed with an error other than file not existing"))
+	}
+
+	loadPath := policyPath
+	if signed {
+		verified, ewc := verifyPolicySignature(policyPath, policyTrustAnchorPath)
+		if ewc != nil {
+			return nil, nil, ewc
+		}
+		ctx.Log("message", "verified extension policy signature", "path", policyPath)
+		// the manager reads the file on its own, which may have changed since
+		// it was verified: it reads a private copy of what was verified
+		copyPath, err := writePrivateCopy(verified)
+		if err != nil {
+			return nil, nil, vmextension.NewErrorWithClarificationPtr(errorutil.ExtensionPolicySettings_policyLoadFailed, errors.Wrap(err, "failed to copy the verified extension policy"))
+		}
+		defer os.Remove(copyPath)
+		loadPath = copyPath
+	}
+
+	m, err := extensionpolicysettings.NewExtensionPolicySettingsManager[CSEExtensionPolicySettings](loadPath)
+	if err != nil {
+		return nil, nil, vmextension.NewErrorWithClarificationPtr(errorutil.ExtensionPolicySettings_policyLoadFailed, errors.Wrap(err, "failed to create extension policy settings manager"))
+	}
+	if err := m.LoadExtensionPolicySettings(); err != nil {
+		return nil, nil, vmextension.NewErrorWithClarificationPtr(errorutil.ExtensionPolicySettings_policyLoadFailed, errors.Wrap(err, "failed to load extension policy settings"))
+	}
+	settings, err := m.GetSettings()
+	if err != nil {
+		return nil, nil, vmextension.NewErrorWithClarificationPtr(errorutil.ExtensionPolicySettings_policyLoadFailed, errors.Wrap(err, "failed to get extension policy settings"))
+	}
+	ctx.Log("message", "successfully loaded extension policy settings", "settings", fmt.Sprintf("%+v", settings))
+	return m, settings, nil
+}
+
+// writePrivateCopy writes b to a new temporary file which only the handler can
+// change, and returns its path.
+func writePrivateCopy(b []byte) (string, error) {
+	f, err := ioutil.TempFile("", "policy")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// verifyPolicySignature verifies the detached signature of the policy file at
+// policyPath against the trust anchors pinned at anchorPath, and returns the
+// contents of the policy file which were verified.
+func verifyPolicySignature(policyPath, anchorPath string) ([]byte, *vmextension.ErrorWithClarification) {
+	anchors, err := ioutil.ReadFile(anchorPath)
+	if err != nil {
+		return nil, vmextension.NewErrorWithClarificationPtr(errorutil.ExtensionPolicySettings_policyLoadFailed, errors.Wrap(err, "failed to read the policy trust anchor"))
+	}
+	v, err := signature.NewVerifier(anchors)
+	if err != nil {
+		return nil, vmextension.NewErrorWithClarificationPtr(errorutil.ExtensionPolicySettings_policyLoadFailed, errors.Wrapf(err, "invalid policy trust anchor %s", anchorPath))
+	}
+
+	sig, err := ioutil.ReadFile(policyPath + policySignatureSuffix)
+	if os.IsNotExist(err) {
+		return nil, vmextension.NewErrorWithClarificationPtr(errorutil.ExtensionPolicySettings_signatureMissing,
+			fmt.Errorf("extension policy signing is enforced by %s, but %s does not exist", anchorPath, filepath.Base(policyPath+policySignatureSuffix)))
+	} else if err != nil {
+		return nil, vmextension.NewErrorWithClarificationPtr(errorutil.ExtensionPolicySettings_signatureMissing, errors.Wrap(err, "failed to read extension policy signature"))
+	}
+
+	var chain []*x509.Certificate
+	if b, err := ioutil.ReadFile(policyPath + policySigningCertSuffix); err == nil {
+		if chain, err = signature.ParseCertificates(b); err != nil {
+			return nil, vmextension.NewErrorWithClarificationPtr(errorutil.ExtensionPolicySettings_signatureInvalid, errors.Wrap(err, "invalid extension policy signing certificate"))
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, vmextension.NewErrorWithClarificationPtr(errorutil.ExtensionPolicySettings_signatureInvalid, errors.Wrap(err, "failed to read extension policy signing certificate"))
+	}
+
+	data, err := ioutil.ReadFile(policyPath)
+	if err != nil {
+		return nil, vmextension.NewErrorWithClarificationPtr(errorutil.ExtensionPolicySettings_policyLoadFailed, errors.Wrap(err, "failed to read extension policy"))
+	}
+	if err := v.Verify(data, signature.DecodeSignature(sig), chain); err != nil {
+		return nil, vmextension.NewErrorWithClarificationPtr(errorutil.ExtensionPolicySettings_signatureInvalid, errors.Wrap(err, "extension policy signature is invalid"))
+	}
+	return data, nil
+}
+
+// validatePolicyFile loads the policy file at path the same way enable does and
+// runs deeper checks on its contents. It returns every problem found.
+func validatePolicyFile(path string) (problems []string) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return []string{fmt.Sprintf("failed to read policy file: %v", err)}
+	}
+
+	m, err := extensionpolicysettings.NewExtensionPolicySettingsManager[CSEExtensionPolicySettings](path)
+	if err != nil {
+		return []string{fmt.Sprintf("failed to create extension policy settings manager: %v", err)}
+	}
+	var p CSEExtensionPolicySettings
+	if err := json.Unmarshal(b, &p); err != nil {
+		// the manager would fail with the same error, no need to report it twice
+		return []string{fmt.Sprintf("failed to parse policy file: %v", err)}
+	}
+	if err := m.LoadExtensionPolicySettings(); err != nil {
+		problems = append(problems, fmt.Sprintf("failed to load extension policy settings: %v", err))
+	}
+
+	if signed, err := pathExists(policyTrustAnchorPath); err != nil {
+		problems = append(problems, fmt.Sprintf("failed to check for the policy trust anchor: %v", err))
+	} else if signed {
+		if _, ewc := verifyPolicySignature(path, policyTrustAnchorPath); ewc != nil {
+			problems = append(problems, ewc.Err.Error())
+		}
+	}
+
+	// unknown fields are silently ignored on load, which hides typos
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&CSEExtensionPolicySettings{}); err != nil {
+		problems = append(problems, fmt.Sprintf("policy file: %v", err))
+	}
+	return append(problems, p.contentProblems()...)
+}
+
+// validatePolicy implements the validate-policy command, printing the problems
+// found in the policy file given as the only argument.
+func validatePolicy(args []string) int {
+	if len(args) != 1 {
+		fmt.Println("Usage: validate-policy <path>")
+		return 2
+	}
+	problems := validatePolicyFile(args[0])
+	if len(problems) == 0 {
+		fmt.Printf("%s: policy is valid\n", args[0])
+		return 0
+	}
+	fmt.Printf("%s: %d problem(s) found\n", args[0], len(problems))
+	for _, p := range problems {
+		fmt.Printf("  - %s\n", p)
+	}
+	return 1
+}
+
+// loadTrustAnchors reads the public keys and certificates at path, see
+// signature.NewVerifier for the supported formats.
+func loadTrustAnchors(path string) (*signature.Verifier, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read trust anchor file")
+	}
+	return signature.NewVerifier(b)
+}
+
+// pathExists reports whether a file or directory exists at path.
+func pathExists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
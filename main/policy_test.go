@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+const validSHA256 = "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+
+func Test_CSEExtensionPolicySettings_ValidateFormat_reportsAllProblems(t *testing.T) {
+	err := CSEExtensionPolicySettings{
+		RequireSigning:      true,
+		BlockedFileAction:   "shred",
+		MaxExecutionSeconds: -1,
+	}.ValidateFormat()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "fileRootCertCA must be provided")
+	require.Contains(t, err.Error(), `unknown blockedFileAction "shred"`)
+	require.Contains(t, err.Error(), "maxExecutionSeconds must not be negative")
+}
+
+func Test_loadExtensionPolicy_missingFile(t *testing.T) {
+	m, p, ewc := loadExtensionPolicy(log.NewContext(log.NewNopLogger()), "/non/existing/policy.json")
+	require.Nil(t, ewc)
+	require.Nil(t, m)
+	require.Nil(t, p)
+}
+
+func Test_loadExtensionPolicy_invalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	fp := filepath.Join(dir, policyFileName)
+	require.Nil(t, writeToFile(fp, `{"requireSigning": true}`))
+
+	_, _, ewc := loadExtensionPolicy(log.NewContext(log.NewNopLogger()), fp)
+	require.NotNil(t, ewc)
+	require.Equal(t, errorutil.ExtensionPolicySettings_policyLoadFailed, ewc.ErrorCode)
+}
+
+func Test_loadExtensionPolicy_signed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	key := pinTestTrustAnchor(t, dir)
+	ctx := log.NewContext(log.NewNopLogger())
+
+	fp := filepath.Join(dir, policyFileName)
+	_, _, ewc := loadExtensionPolicy(ctx, fp)
+	require.NotNil(t, ewc, "missing policy must not pass when signing is enforced")
+	require.Equal(t, errorutil.ExtensionPolicySettings_policyLoadFailed, ewc.ErrorCode)
+
+	policy := `{"requireSigning": false, "allowedScripts": []}`
+	require.Nil(t, writeToFile(fp, policy))
+	_, _, ewc = loadExtensionPolicy(ctx, fp)
+	require.NotNil(t, ewc)
+	require.Equal(t, errorutil.ExtensionPolicySettings_signatureMissing, ewc.ErrorCode)
+
+	signTestPolicy(t, key, fp)
+	tmp := tempDir(t)
+	t.Setenv("TMPDIR", tmp)
+	m, p, ewc := loadExtensionPolicy(ctx, fp)
+	require.Nil(t, ewc)
+	require.NotNil(t, m)
+	require.NotNil(t, p)
+	require.Nil(t, writeToFile(fp, `{"requireSigning": true}`))
+	settings, err := m.GetSettings()
+	require.Nil(t, err)
+	require.Equal(t, p, settings, "loaded from what was verified")
+	require.False(t, settings.RequireSigning)
+	files, err := ioutil.ReadDir(tmp)
+	require.Nil(t, err)
+	require.Empty(t, files, "the private copy is removed")
+
+	// tampered after signing
+	require.Nil(t, writeToFile(fp, `{"requireSigning": false}`))
+	_, _, ewc = loadExtensionPolicy(ctx, fp)
+	require.NotNil(t, ewc)
+	require.Equal(t, errorutil.ExtensionPolicySettings_signatureInvalid, ewc.ErrorCode)
+	require.Len(t, validatePolicyFile(fp), 1)
+}
+
+func Test_validatePolicyFile_valid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := filepath.Join(dir, "ca.pem")
+	writeTestCertificate(t, ca)
+	fp := filepath.Join(dir, policyFileName)
+	require.Nil(t, writeToFile(fp, `{
+		"requireSigning": true,
+		"fileRootCertCA": "`+ca+`",
+		"allowedScripts": ["`+validSHA256+`"]
+	}`))
+
+	require.Empty(t, validatePolicyFile(fp))
+}
+
+func Test_validatePolicyFile_missingFile(t *testing.T) {
+	problems := validatePolicyFile("/non/existing/policy.json")
+	require.Len(t, problems, 1)
+	require.Contains(t, problems[0], "failed to read policy file")
+}
+
+func Test_validatePolicyFile_invalidJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	fp := filepath.Join(dir, policyFileName)
+	require.Nil(t, writeToFile(fp, `{"allowedScripts": [}`))
+
+	problems := validatePolicyFile(fp)
+	require.Len(t, problems, 1)
+	require.Contains(t, problems[0], "failed to parse policy file")
+}
+
+func Test_validatePolicyFile_reportsEveryProblem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	notACert := filepath.Join(dir, "ca.pem")
+	require.Nil(t, writeToFile(notACert, "hello"))
+	fp := filepath.Join(dir, policyFileName)
+	require.Nil(t, writeToFile(fp, `{
+		"requireSigning": true,
+		"fileRootCertCA": "`+notACert+`",
+		"allowedScripts": ["`+validSHA256+`", "xyz", "abcd"],
+		"blockedFileAction": "shred",
+		"allowedScript": []
+	}`))
+
+	problems := validatePolicyFile(fp)
+	require.Len(t, problems, 5)
+	require.Contains(t, problems[0], `unknown blockedFileAction "shred"`)
+	require.Contains(t, problems[1], `unknown field "allowedScript"`)
+	require.Contains(t, problems[2], "fileRootCertCA")
+	require.Contains(t, problems[3], `allowedScripts[1]: "xyz"`)
+	require.Contains(t, problems[4], `allowedScripts[2]: "abcd"`)
+}
+
+func Test_validatePolicy_exitCodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	fp := filepath.Join(dir, policyFileName)
+	require.Nil(t, writeToFile(fp, `{"requireSigning": false, "allowedScripts": []}`))
+
+	require.Equal(t, 0, validatePolicy([]string{fp}))
+	require.Equal(t, 1, validatePolicy([]string{filepath.Join(dir, "missing.json")}))
+	require.Equal(t, 2, validatePolicy(nil))
+}
+
+func Test_loadTrustAnchors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fp := filepath.Join(dir, "ca.pem")
+	writeTestCertificate(t, fp)
+	_, err = loadTrustAnchors(fp)
+	require.Nil(t, err)
+
+	// DER
+	block, _ := pem.Decode(readFile(t, fp))
+	require.Nil(t, ioutil.WriteFile(fp, block.Bytes, 0600))
+	_, err = loadTrustAnchors(fp)
+	require.Nil(t, err)
+
+	// public key
+	pinTestTrustAnchor(t, dir)
+	_, err = loadTrustAnchors(policyTrustAnchorPath)
+	require.Nil(t, err)
+
+	require.Nil(t, ioutil.WriteFile(fp, []byte("hello"), 0600))
+	_, err = loadTrustAnchors(fp)
+	require.Error(t, err)
+
+	_, err = loadTrustAnchors(filepath.Join(dir, "missing.pem"))
+	require.Error(t, err)
+}
+
+// writeTestCertificate writes a self-signed PEM encoded certificate to path.
+func writeTestCertificate(t *testing.T, path string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+}
+
+// pinTestTrustAnchor pins a new ECDSA public key as the policy trust anchor for
+// the duration of the test and returns its private key.
+func pinTestTrustAnchor(t *testing.T, dir string) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.Nil(t, err)
+
+	old := policyTrustAnchorPath
+	policyTrustAnchorPath = filepath.Join(dir, "policy-trust.pem")
+	t.Cleanup(func() { policyTrustAnchorPath = old })
+	require.Nil(t, ioutil.WriteFile(policyTrustAnchorPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600))
+	return key
+}
+
+// signTestPolicy writes the detached signature of the policy file at path.
+func signTestPolicy(t *testing.T, key *ecdsa.PrivateKey, path string) {
+	digest := sha256.Sum256(readFile(t, path))
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(path+policySignatureSuffix, sig, 0600))
+}
+
+func readFile(t *testing.T, path string) []byte {
+	b, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	return b
+}
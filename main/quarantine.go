@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	blockedFileActionKeep       = "keep"
+	blockedFileActionQuarantine = "quarantine"
+	blockedFileActionDelete     = "delete"
+
+	// defaultQuarantineMaxSize is the cap on the total size of quarantined
+	// file contents if the policy does not specify one.
+	defaultQuarantineMaxSize int64 = 100 * 1024 * 1024
+
+	quarantineContentFile  = "content"
+	quarantineMetadataFile = "metadata.json"
+)
+
+// quarantineRecord is the metadata saved next to a quarantined file so that it
+// can be inspected later without knowing the original settings. The full URL
+// is deliberately not recorded as it may contain a SAS token.
+type quarantineRecord struct {
+	FileName         string `json:"fileName"`
+	URLHost          string `json:"urlHost"`
+	SHA256           string `json:"sha256"`
+	Size             int64  `json:"size"`
+	TimestampUTC     string `json:"timestampUTC"`
+	Reason           string `json:"reason"`
+	ContentDiscarded bool   `json:"contentDiscarded"` // file alone exceeded the quarantine size cap
+}
+
+// handleBlockedFile applies the blockedFileAction of the policy on the file at
+// path which failed policy validation for the given reason. Quarantined files
+// are moved under qDir.
+func handleBlockedFile(ctx *log.Context, path, fileURL, reason string, settings *CSEExtensionPolicySettings, qDir string) error {
+	switch settings.BlockedFileAction {
+	case blockedFileActionQuarantine:
+		maxSize := settings.QuarantineMaxSizeBytes
+		if maxSize == 0 {
+			maxSize = defaultQuarantineMaxSize
+		}
+		entry, err := quarantineFile(path, fileURL, reason, qDir, maxSize)
+		if err != nil {
+			return errors.Wrap(err, "failed to quarantine file")
+		}
+		ctx.Log("event", "quarantined blocked file", "path", entry)
+	case blockedFileActionDelete:
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "failed to delete file")
+		}
+		ctx.Log("event", "deleted blocked file", "path", path)
+	default:
+		ctx.Log("event", "keeping blocked file", "path", path)
+	}
+	return nil
+}
+
+// quarantineFile moves the file at path into a new entry directory under dir
+// (created with root-only permissions if missing) along with its metadata and
+// evicts the oldest entries until the total content size is at most maxSize.
+// It returns the path to the new entry.
+func quarantineFile(path, fileURL, reason, dir string, maxSize int64) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to stat file")
+	}
+	hash, err := fileSHA256(path)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", errors.Wrap(err, "failed to create quarantine directory")
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return "", errors.Wrap(err, "failed to restrict quarantine directory")
+	}
+
+	now := time.Now().UTC()
+	entry := filepath.Join(dir, fmt.Sprintf("%d-%s", now.UnixNano(), hash[:12]))
+	if err := os.Mkdir(entry, 0700); err != nil {
+		return "", errors.Wrap(err, "failed to create quarantine entry")
+	}
+
+	rec := quarantineRecord{
+		FileName:     filepath.Base(path),
+		URLHost:      urlHost(fileURL),
+		SHA256:       hash,
+		Size:         fi.Size(),
+		TimestampUTC: now.Format(time.RFC3339),
+		Reason:       reason,
+	}
+	if fi.Size() > maxSize {
+		rec.ContentDiscarded = true
+		if err := os.Remove(path); err != nil {
+			return "", errors.Wrap(err, "failed to delete oversized file")
+		}
+	} else {
+		content := filepath.Join(entry, quarantineContentFile)
+		if err := os.Rename(path, content); err != nil {
+			return "", errors.Wrap(err, "failed to move file into quarantine")
+		}
+		if err := os.Chmod(content, 0400); err != nil {
+			return "", errors.Wrap(err, "failed to restrict quarantined file")
+		}
+	}
+
+	b, err := json.MarshalIndent(rec, "", "\t")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to marshal quarantine metadata")
+	}
+	if err := ioutil.WriteFile(filepath.Join(entry, quarantineMetadataFile), b, 0400); err != nil {
+		return "", errors.Wrap(err, "failed to write quarantine metadata")
+	}
+
+	return entry, enforceQuarantineCap(dir, maxSize)
+}
+
+// enforceQuarantineCap removes the oldest quarantine entries under dir until the
+// total size of quarantined contents is at most maxSize. Entry directory names
+// start with a timestamp, so lexical order is chronological order.
+func enforceQuarantineCap(dir string, maxSize int64) error {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return errors.Wrap(err, "failed to list quarantine directory")
+	}
+	var entries []string
+	sizes := make(map[string]int64)
+	var total int64
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			continue
+		}
+		entries = append(entries, fi.Name())
+		if cfi, err := os.Stat(filepath.Join(dir, fi.Name(), quarantineContentFile)); err == nil {
+			sizes[fi.Name()] = cfi.Size()
+			total += cfi.Size()
+		}
+	}
+	sort.Strings(entries)
+	for _, e := range entries {
+		if total <= maxSize {
+			break
+		}
+		if err := os.RemoveAll(filepath.Join(dir, e)); err != nil {
+			return errors.Wrapf(err, "failed to evict quarantine entry %s", e)
+		}
+		total -= sizes[e]
+	}
+	return nil
+}
+
+// fileSHA256 returns the hex encoded SHA256 hash of the file at path.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to open file")
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", errors.Wrap(err, "failed to hash file")
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// urlHost returns only the host section of fileURL, or an empty string if it
+// cannot be parsed.
+func urlHost(fileURL string) string {
+	u, err := url.Parse(fileURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
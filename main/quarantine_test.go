@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_handleBlockedFile_keep(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fp := filepath.Join(dir, "script.sh")
+	require.Nil(t, ioutil.WriteFile(fp, []byte("echo bad"), 0500))
+
+	require.Nil(t, handleBlockedFile(log.NewContext(log.NewNopLogger()), fp, "https://example.com/script.sh", "blocked",
+		&CSEExtensionPolicySettings{}, filepath.Join(dir, "quarantine")))
+	require.True(t, fileExists(t, fp), "file should be kept by default")
+	require.False(t, fileExists(t, filepath.Join(dir, "quarantine")), "quarantine should not be created")
+}
+
+func Test_handleBlockedFile_delete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fp := filepath.Join(dir, "script.sh")
+	require.Nil(t, ioutil.WriteFile(fp, []byte("echo bad"), 0500))
+
+	require.Nil(t, handleBlockedFile(log.NewContext(log.NewNopLogger()), fp, "https://example.com/script.sh", "blocked",
+		&CSEExtensionPolicySettings{BlockedFileAction: blockedFileActionDelete}, filepath.Join(dir, "quarantine")))
+	require.False(t, fileExists(t, fp), "file should be deleted")
+}
+
+func Test_quarantineFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fp := filepath.Join(dir, "script.sh")
+	require.Nil(t, ioutil.WriteFile(fp, []byte("echo bad"), 0500))
+	hash, err := fileSHA256(fp)
+	require.Nil(t, err)
+
+	qDir := filepath.Join(dir, "quarantine")
+	entry, err := quarantineFile(fp, "https://acct.blob.core.windows.net/c/script.sh?sig=secret", "not in allowlist", qDir, 1024)
+	require.Nil(t, err)
+	require.False(t, fileExists(t, fp), "file should be moved out of the download dir")
+
+	fi, err := os.Stat(qDir)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0700).String(), fi.Mode().Perm().String())
+
+	b, err := ioutil.ReadFile(filepath.Join(entry, quarantineContentFile))
+	require.Nil(t, err)
+	require.Equal(t, "echo bad", string(b))
+
+	b, err = ioutil.ReadFile(filepath.Join(entry, quarantineMetadataFile))
+	require.Nil(t, err)
+	require.NotContains(t, string(b), "secret", "SAS token must not be recorded")
+	var rec quarantineRecord
+	require.Nil(t, json.Unmarshal(b, &rec))
+	require.Equal(t, "script.sh", rec.FileName)
+	require.Equal(t, "acct.blob.core.windows.net", rec.URLHost)
+	require.Equal(t, hash, rec.SHA256)
+	require.EqualValues(t, 8, rec.Size)
+	require.Equal(t, "not in allowlist", rec.Reason)
+	require.False(t, rec.ContentDiscarded)
+}
+
+func Test_quarantineFile_oversizedKeepsMetadataOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fp := filepath.Join(dir, "big.bin")
+	require.Nil(t, ioutil.WriteFile(fp, make([]byte, 100), 0500))
+
+	entry, err := quarantineFile(fp, "https://example.com/big.bin", "blocked", filepath.Join(dir, "quarantine"), 10)
+	require.Nil(t, err)
+	require.False(t, fileExists(t, fp))
+	require.False(t, fileExists(t, filepath.Join(entry, quarantineContentFile)), "content should be discarded")
+	require.True(t, fileExists(t, filepath.Join(entry, quarantineMetadataFile)), "metadata should be kept")
+}
+
+func Test_quarantineFile_evictsOldestEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	qDir := filepath.Join(dir, "quarantine")
+
+	var entries []string
+	for _, name := range []string{"a", "b", "c"} {
+		fp := filepath.Join(dir, name)
+		require.Nil(t, ioutil.WriteFile(fp, []byte(name+"-0123456789"), 0500))
+		entry, err := quarantineFile(fp, "https://example.com/"+name, "blocked", qDir, 25)
+		require.Nil(t, err)
+		entries = append(entries, entry)
+	}
+
+	require.False(t, fileExists(t, entries[0]), "oldest entry should be evicted")
+	require.True(t, fileExists(t, entries[1]))
+	require.True(t, fileExists(t, entries[2]))
+}
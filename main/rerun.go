@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/atomicfile"
+	"github.com/Azure/custom-script-extension-linux/pkg/seqnum"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// The rerun policies decide whether enable runs the settings of a sequence
+// number, see publicSettings.RerunPolicy.
+const (
+	// rerunOnSeqNumChange runs the settings of every new sequence number.
+	rerunOnSeqNumChange = "onSeqNumChange"
+	// rerunOnContentChange runs the settings only when they differ from the
+	// ones which ran last, whatever their sequence number.
+	rerunOnContentChange = "onContentChange"
+	// rerunAlways runs the settings on every enable, e.g. on each boot.
+	rerunAlways = "always"
+)
+
+// settingsHashKeyFile holds the random key of the settings hashes of the VM,
+// next to mostRecentSettingsHash, so that the two are kept or lost together.
+// The protected settings are part of the hash, the key keeps their secrets
+// from being guessed from it.
+var settingsHashKeyFile = "settingshash.key"
+
+// settingsHashKeySize is the size of the key in bytes.
+const settingsHashKeySize = 32
+
+// settingsHash returns the hex encoded HMAC-SHA256, with key, of the effective
+// settings made of the public and protected settings of each runtime settings
+// block, including the timestamp.
+func settingsHash(key []byte, pub, prot []map[string]interface{}) (string, error) {
+	// the keys of the maps are marshaled in order, the hash is stable
+	b, err := json.Marshal(struct {
+		Public    []map[string]interface{} `json:"public"`
+		Protected []map[string]interface{} `json:"protected"`
+	}{pub, prot})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to marshal settings")
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// settingsHashKey returns the key of the settings hashes, creating it the first
+// time. Concurrent extension instances end up with the same key.
+func settingsHashKey() ([]byte, error) {
+	path := settingsHashKeyFile
+	if b, err := ioutil.ReadFile(path); err == nil && len(b) == settingsHashKeySize {
+		return b, nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "failed to read settings hash key")
+	}
+
+	key := make([]byte, settingsHashKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, errors.Wrap(err, "failed to generate settings hash key")
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create settings hash key")
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(key)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to write settings hash key")
+	}
+	// the first instance to link its key wins, an invalid key is replaced
+	if err := os.Link(tmp.Name(), path); os.IsExist(err) {
+		if b, err := ioutil.ReadFile(path); err == nil && len(b) == settingsHashKeySize {
+			return b, nil
+		}
+		if err := os.Rename(tmp.Name(), path); err != nil {
+			return nil, errors.Wrap(err, "failed to replace settings hash key")
+		}
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to save settings hash key")
+	}
+	return key, nil
+}
+
+// rerunPolicyOf returns the rerunPolicy of the first runtime settings block,
+// which applies to all of them, or the default policy.
+func rerunPolicyOf(pub []map[string]interface{}) string {
+	if len(pub) > 0 {
+		if p, ok := pub[0]["rerunPolicy"].(string); ok && p != "" {
+			return p
+		}
+	}
+	return rerunOnSeqNumChange
+}
+
+// rerunSettingsOf returns the rerun policy and the hash of the settings. If
+// they couldn't be read (nil), the default policy applies without a hash and
+// enable reports the problem.
+func rerunSettingsOf(ctx log.Logger, pub, prot []map[string]interface{}) (policy, hash string) {
+	if pub == nil {
+		return rerunOnSeqNumChange, ""
+	}
+	key, err := settingsHashKey()
+	if err != nil {
+		ctx.Log("event", "could not hash settings", "error", err)
+		return rerunPolicyOf(pub), ""
+	}
+	hash, err = settingsHash(key, pub, prot)
+	if err != nil {
+		ctx.Log("event", "could not hash settings", "error", err)
+	}
+	return rerunPolicyOf(pub), hash
+}
+
+// checkAndSaveSettings decides according to the rerun policy whether the
+// settings of seq with the given hash must run. Unless they were already
+// processed (shouldExit), seq and hash are saved as the most recent ones.
+// skipMsg is set if the settings of a new sequence number must not run
+// because they did not change.
+func checkAndSaveSettings(ctx log.Logger, seq int, policy, hash, mrseqPath, hashPath string) (shouldExit bool, skipMsg string, _ error) {
+	ctx.Log("event", "checking rerun policy", "policy", policy)
+	switch policy {
+	case rerunAlways:
+		if err := seqnum.Set(mrseqPath, seq); err != nil {
+			return false, "", errors.Wrap(err, "failed to save sequence number")
+		}
+	case rerunOnContentChange:
+		// the sequence number is checked first, the hash may be lost, e.g. on
+		// an update, when the sequence number is kept
+		last, ok, err := seqnum.Get(mrseqPath)
+		if err != nil {
+			return false, "", errors.Wrap(err, "failed to check sequence number")
+		}
+		if ok && last == seq {
+			return true, "", nil
+		}
+		stored, err := readSettingsHash(hashPath)
+		if err != nil {
+			return false, "", err
+		}
+		if hash != "" && hash == stored {
+			skipMsg = "the settings did not change since they last ran, will not run them again (rerunPolicy: " + policy + ")"
+		}
+		if err := seqnum.Set(mrseqPath, seq); err != nil {
+			return false, "", errors.Wrap(err, "failed to save sequence number")
+		}
+	default:
+		if shouldExit, err := checkAndSaveSeqNum(ctx, seq, mrseqPath); err != nil || shouldExit {
+			return shouldExit, "", err
+		}
+	}
+
+	if hash != "" {
+		if err := atomicfile.WriteFile(hashPath, []byte(hash), 0600); err != nil {
+			return false, "", errors.Wrap(err, "failed to save settings hash")
+		}
+		ctx.Log("event", "settings hash saved", "path", hashPath)
+	}
+	return false, skipMsg, nil
+}
+
+// readSettingsHash returns the hash of the settings which ran last, or an
+// empty string if there is none.
+func readSettingsHash(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(b)), errors.Wrap(err, "failed to read settings hash")
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_settingsHash(t *testing.T) {
+	key := []byte("key")
+	pub := []map[string]interface{}{{"commandToExecute": "date", "timestamp": 1.0}}
+	prot := []map[string]interface{}{{"storageAccountName": "foo"}}
+	h1, err := settingsHash(key, pub, prot)
+	require.Nil(t, err)
+	h2, err := settingsHash(key, []map[string]interface{}{{"timestamp": 1.0, "commandToExecute": "date"}}, prot)
+	require.Nil(t, err)
+	require.Equal(t, h1, h2, "the order of the keys doesn't matter")
+	require.Len(t, h1, 64)
+
+	h3, err := settingsHash(key, []map[string]interface{}{{"commandToExecute": "date", "timestamp": 2.0}}, prot)
+	require.Nil(t, err)
+	require.NotEqual(t, h1, h3, "the timestamp is part of the settings")
+	h4, err := settingsHash(key, pub, []map[string]interface{}{{"storageAccountName": "bar"}})
+	require.Nil(t, err)
+	require.NotEqual(t, h1, h4, "the protected settings are part of the settings")
+	h5, err := settingsHash([]byte("other key"), pub, prot)
+	require.Nil(t, err)
+	require.NotEqual(t, h1, h5, "the hash depends on the key")
+}
+
+func Test_settingsHashKey(t *testing.T) {
+	dir := setTestSettingsHashKeyFile(t)
+	key, err := settingsHashKey()
+	require.Nil(t, err)
+	require.Len(t, key, settingsHashKeySize)
+	path := settingsHashKeyFile
+	fi, err := os.Stat(path)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	again, err := settingsHashKey()
+	require.Nil(t, err)
+	require.Equal(t, key, again, "the key is kept")
+
+	require.Nil(t, writeToFile(path, "short"))
+	replaced, err := settingsHashKey()
+	require.Nil(t, err)
+	require.Len(t, replaced, settingsHashKeySize, "an invalid key is replaced")
+	requireFileContent(t, path, string(replaced))
+	files, err := ioutil.ReadDir(dir)
+	require.Nil(t, err)
+	require.Len(t, files, 1, "no temporary file left")
+}
+
+func Test_rerunPolicyOf(t *testing.T) {
+	require.Equal(t, rerunOnSeqNumChange, rerunPolicyOf(nil))
+	require.Equal(t, rerunOnSeqNumChange, rerunPolicyOf([]map[string]interface{}{{}}))
+	require.Equal(t, rerunAlways, rerunPolicyOf([]map[string]interface{}{{"rerunPolicy": "always"}, {"rerunPolicy": "onContentChange"}}))
+}
+
+func Test_rerunSettingsOf(t *testing.T) {
+	setTestSettingsHashKeyFile(t)
+	dir := tempDir(t)
+	require.Nil(t, writeToFile(filepath.Join(dir, "0.settings"), `{"runtimeSettings": [{"handlerSettings": {
+		"publicSettings": {"commandToExecute": "date", "rerunPolicy": "onContentChange"}}}]}`))
+	pub, prot, err := readSettings(dir, 0)
+	require.Nil(t, err)
+	policy, hash := rerunSettingsOf(log.NewNopLogger(), pub, prot)
+	require.Equal(t, rerunOnContentChange, policy)
+	require.NotEmpty(t, hash)
+
+	policy, hash = rerunSettingsOf(log.NewNopLogger(), nil, nil)
+	require.Equal(t, rerunOnSeqNumChange, policy)
+	require.Empty(t, hash)
+}
+
+func Test_checkAndSaveSettings_onSeqNumChange(t *testing.T) {
+	dir := tempDir(t)
+	mrseq, mrhash := filepath.Join(dir, "mrseq"), filepath.Join(dir, "mrhash")
+	nop := log.NewNopLogger()
+
+	shouldExit, skipMsg, err := checkAndSaveSettings(nop, 0, rerunOnSeqNumChange, "a", mrseq, mrhash)
+	require.Nil(t, err)
+	require.False(t, shouldExit)
+	require.Empty(t, skipMsg)
+	requireFileContent(t, mrhash, "a")
+
+	shouldExit, _, err = checkAndSaveSettings(nop, 0, rerunOnSeqNumChange, "b", mrseq, mrhash)
+	require.Nil(t, err)
+	require.True(t, shouldExit, "same seqnum")
+	requireFileContent(t, mrhash, "a")
+
+	shouldExit, _, err = checkAndSaveSettings(nop, 1, rerunOnSeqNumChange, "a", mrseq, mrhash)
+	require.Nil(t, err)
+	require.False(t, shouldExit, "new seqnum with the same settings")
+	requireFileContent(t, mrseq, "1")
+}
+
+func Test_checkAndSaveSettings_onContentChange(t *testing.T) {
+	dir := tempDir(t)
+	mrseq, mrhash := filepath.Join(dir, "mrseq"), filepath.Join(dir, "mrhash")
+	nop := log.NewNopLogger()
+
+	shouldExit, skipMsg, err := checkAndSaveSettings(nop, 3, rerunOnContentChange, "a", mrseq, mrhash)
+	require.Nil(t, err)
+	require.False(t, shouldExit)
+	require.Empty(t, skipMsg)
+
+	shouldExit, _, err = checkAndSaveSettings(nop, 3, rerunOnContentChange, "a", mrseq, mrhash)
+	require.Nil(t, err)
+	require.True(t, shouldExit, "same seqnum and settings")
+
+	// re-delivered with a new seqnum, e.g. after a migration
+	shouldExit, skipMsg, err = checkAndSaveSettings(nop, 0, rerunOnContentChange, "a", mrseq, mrhash)
+	require.Nil(t, err)
+	require.False(t, shouldExit)
+	require.Contains(t, skipMsg, "did not change")
+	requireFileContent(t, mrseq, "0")
+
+	shouldExit, _, err = checkAndSaveSettings(nop, 0, rerunOnContentChange, "b", mrseq, mrhash)
+	require.Nil(t, err)
+	require.True(t, shouldExit, "same seqnum with other settings")
+	requireFileContent(t, mrhash, "a")
+
+	// the hash was lost, e.g. on an update, the sequence number wasn't
+	require.Nil(t, os.Remove(mrhash))
+	shouldExit, _, err = checkAndSaveSettings(nop, 0, rerunOnContentChange, "a", mrseq, mrhash)
+	require.Nil(t, err)
+	require.True(t, shouldExit, "same seqnum without a hash")
+
+	shouldExit, skipMsg, err = checkAndSaveSettings(nop, 1, rerunOnContentChange, "b", mrseq, mrhash)
+	require.Nil(t, err)
+	require.False(t, shouldExit)
+	require.Empty(t, skipMsg)
+	requireFileContent(t, mrhash, "b")
+
+	// settings which couldn't be hashed always run
+	shouldExit, skipMsg, err = checkAndSaveSettings(nop, 2, rerunOnContentChange, "", mrseq, mrhash)
+	require.Nil(t, err)
+	require.False(t, shouldExit)
+	require.Empty(t, skipMsg)
+}
+
+func Test_checkAndSaveSettings_always(t *testing.T) {
+	dir := tempDir(t)
+	mrseq, mrhash := filepath.Join(dir, "mrseq"), filepath.Join(dir, "mrhash")
+	for i := 0; i < 2; i++ {
+		shouldExit, skipMsg, err := checkAndSaveSettings(log.NewNopLogger(), 1, rerunAlways, "a", mrseq, mrhash)
+		require.Nil(t, err)
+		require.False(t, shouldExit)
+		require.Empty(t, skipMsg)
+	}
+	requireFileContent(t, mrseq, "1")
+	requireFileContent(t, mrhash, "a")
+}
+
+func Test_checkAndSaveSettings_fails(t *testing.T) {
+	_, _, err := checkAndSaveSettings(log.NewNopLogger(), 0, rerunAlways, "a", "/non/existing/mrseq", "/non/existing/mrhash")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "failed to save sequence number")
+}
+
+// setTestSettingsHashKeyFile moves the settings hash key to a temporary
+// directory, which it returns.
+func setTestSettingsHashKeyFile(t *testing.T) string {
+	dir := tempDir(t)
+	orig := settingsHashKeyFile
+	settingsHashKeyFile = filepath.Join(dir, "settingshash.key")
+	t.Cleanup(func() { settingsHashKeyFile = orig })
+	return dir
+}
+
+func requireFileContent(t *testing.T, path, content string) {
+	b, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, content, string(b))
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	vmextension "github.com/Azure/azure-extension-platform/vmextension"
+	"github.com/Azure/custom-script-extension-linux/pkg/atomicfile"
+	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// A schedule is installed as a cron table in cronDir which runs the
+// run-scheduled command of the handler, through its shim, for the sequence
+// number which installed it.
+
+var (
+	// cronDir is where the schedule of each extension instance is installed.
+	cronDir = "/etc/cron.d"
+
+	// shimName is the name of the shim next to the handler binary.
+	shimName = "custom-script-shim"
+
+	cronFieldRegex   = regexp.MustCompile(`^[0-9*,/-]+$`)
+	cronMacros       = map[string]bool{"@hourly": true, "@daily": true, "@weekly": true, "@monthly": true}
+	cronFileBadChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+)
+
+// parseSchedule returns the cron expression of the schedule setting: a cron
+// expression of five numeric fields, one of @hourly, @daily, @weekly or
+// @monthly, or an interval such as 15m or 2h which divides an hour or a day.
+func parseSchedule(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if cronMacros[s] {
+		return s, nil
+	}
+	if fields := strings.Fields(s); len(fields) == 5 {
+		for _, f := range fields {
+			if !cronFieldRegex.MatchString(f) {
+				return "", fmt.Errorf("invalid schedule %q: invalid field %q", s, f)
+			}
+		}
+		return strings.Join(fields, " "), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid schedule %q: neither a cron expression nor an interval", s)
+	}
+	switch {
+	case d >= time.Minute && d < time.Hour && d%time.Minute == 0 && time.Hour%d == 0:
+		return fmt.Sprintf("*/%d * * * *", d/time.Minute), nil
+	case d == 24*time.Hour:
+		return "0 0 * * *", nil
+	case d >= time.Hour && d < 24*time.Hour && d%time.Hour == 0 && (24*time.Hour)%d == 0:
+		return fmt.Sprintf("0 */%d * * *", d/time.Hour), nil
+	}
+	return "", fmt.Errorf("invalid schedule %q: an interval must divide an hour or a day in whole minutes or hours", s)
+}
+
+// cronFilePath returns the path of the cron table of the handled extension
+// instance. cron ignores files with dots in their names.
+func cronFilePath() string {
+	name := "custom-script"
+	if extensionName != "" {
+		name += "-" + cronFileBadChars.ReplaceAllString(extensionName, "_")
+	}
+	return filepath.Join(cronDir, name)
+}
+
+// applySchedule installs the schedule of cfg for seqNum, or removes the
+// installed one if cfg has none.
+func applySchedule(ctx log.Logger, cfg handlerSettings, seqNum int) *vmextension.ErrorWithClarification {
+	if cfg.publicSettings.Schedule == "" {
+		if err := removeSchedule(); err != nil {
+			ctx.Log("event", "could not remove schedule", "error", err)
+		}
+		return nil
+	}
+	expr, err := parseSchedule(cfg.publicSettings.Schedule)
+	if err == nil {
+		err = installSchedule(expr, seqNum)
+	}
+	if err != nil {
+		return vmextension.NewErrorWithClarificationPtr(errorutil.SystemError, errors.Wrap(err, "failed to install schedule"))
+	}
+	ctx.Log("event", "installed schedule", "schedule", expr, "path", cronFilePath())
+	return nil
+}
+
+// installSchedule writes the cron table which runs run-scheduled for seqNum
+// according to the cron expression, from the current directory where the
+// agent runs the handler.
+func installSchedule(expr string, seqNum int) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "failed to find handler binary")
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return errors.Wrap(err, "failed to find working directory")
+	}
+	env := fmt.Sprintf("%s=%d", configSequenceNumber, seqNum)
+	if extensionName != "" {
+		env += fmt.Sprintf(" %s=%s", configExtensionName, extensionName)
+	}
+	table := fmt.Sprintf("# installed by the Custom Script extension for sequence number %d, do not edit\n"+
+		"%s root cd %s && %s %s run-scheduled >/dev/null 2>&1\n",
+		seqNum, expr, shellQuote(wd), env, shellQuote(filepath.Join(filepath.Dir(exe), shimName)))
+	if err := os.MkdirAll(cronDir, 0755); err != nil {
+		return errors.Wrap(err, "failed to create cron directory")
+	}
+	// cron ignores tables writable by others
+	return atomicfile.WriteFile(cronFilePath(), []byte(table), 0644)
+}
+
+// removeSchedule removes the cron table of the handled extension instance, if
+// any.
+func removeSchedule() error {
+	if err := os.Remove(cronFilePath()); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove cron table")
+	}
+	return nil
+}
+
+// shellQuote quotes s for /bin/sh.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseSchedule(t *testing.T) {
+	for in, want := range map[string]string{
+		"*/5 * * * *":    "*/5 * * * *",
+		" 0  3 * * 1-5 ": "0 3 * * 1-5",
+		"0 0,12 1 */2 *": "0 0,12 1 */2 *",
+		"@daily":         "@daily",
+		"15m":            "*/15 * * * *",
+		"1h":             "0 */1 * * *",
+		"6h":             "0 */6 * * *",
+		"24h":            "0 0 * * *",
+		"30m0s":          "*/30 * * * *",
+	} {
+		got, err := parseSchedule(in)
+		require.Nil(t, err, in)
+		require.Equal(t, want, got, in)
+	}
+	for _, in := range []string{"", "7m", "90m", "30s", "5h", "48h", "* * * *", "0 0 * * MON", "@reboot", "0 0 * * * rm -rf /", "0 0 * * *; date"} {
+		_, err := parseSchedule(in)
+		require.NotNil(t, err, in)
+	}
+}
+
+func Test_validate_schedule(t *testing.T) {
+	h := handlerSettings{publicSettings: publicSettings{CommandToExecute: "date", Schedule: "7m"}}
+	ewc := h.validate()
+	require.NotNil(t, ewc)
+	require.Equal(t, errorutil.CustomerInput_invalidSchedule, ewc.ErrorCode)
+
+	h.publicSettings.Schedule = "@hourly"
+	require.Nil(t, h.validate())
+}
+
+func Test_cronFilePath(t *testing.T) {
+	setTestCronDir(t)
+	require.Equal(t, filepath.Join(cronDir, "custom-script"), cronFilePath())
+	setTestExtensionName(t, "my-ext.v2")
+	require.Equal(t, filepath.Join(cronDir, "custom-script-my-ext_v2"), cronFilePath())
+}
+
+func Test_applySchedule(t *testing.T) {
+	setTestCronDir(t)
+	setTestExtensionName(t, "a")
+	nop := log.NewNopLogger()
+
+	require.Nil(t, applySchedule(nop, handlerSettings{publicSettings: publicSettings{Schedule: "15m"}}, 3))
+	b, err := ioutil.ReadFile(cronFilePath())
+	require.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	require.Len(t, lines, 2)
+	require.True(t, strings.HasPrefix(lines[1], "*/15 * * * * root cd '"), lines[1])
+	require.Contains(t, lines[1], "&& ConfigSequenceNumber=3 ConfigExtensionName=a '")
+	require.Contains(t, lines[1], "/custom-script-shim' run-scheduled >/dev/null 2>&1")
+	fi, err := os.Stat(cronFilePath())
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0644), fi.Mode().Perm())
+
+	require.Nil(t, applySchedule(nop, handlerSettings{}, 4))
+	require.False(t, fileExists(t, cronFilePath()), "removed without a schedule")
+	require.Nil(t, applySchedule(nop, handlerSettings{}, 4), "nothing to remove")
+}
+
+func Test_shellQuote(t *testing.T) {
+	require.Equal(t, `'/var/lib/waagent/ext'`, shellQuote("/var/lib/waagent/ext"))
+	require.Equal(t, `'it'\''s'`, shellQuote("it's"))
+}
+
+func setTestCronDir(t *testing.T) {
+	orig := cronDir
+	cronDir = tempDir(t)
+	t.Cleanup(func() { cronDir = orig })
+}
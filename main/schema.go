@@ -1,7 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/xeipuuv/gojsonschema"
@@ -9,96 +14,184 @@ import (
 
 // Refer to http://json-schema.org/ on how to use JSON Schemas.
 
-const (
-	publicSettingsSchema = `{
-  "$schema": "http://json-schema.org/draft-04/schema#",
-  "title": "Custom Script - Public Settings",
-  "type": "object",
-  "properties": {
-    "commandToExecute": {
-      "description": "Command to be executed",
-      "type": "string"
-    },
-    "script": {
-      "description": "Script to be executed",
-      "type": "string"
-    },
-    "skipDos2Unix": {
-      "description": "Skip DOS2UNIX and BOM removal for download files and script",
-      "type": "boolean"
-    },
-    "fileUris": {
-      "description": "List of files to be downloaded",
-      "type": "array",
-      "items": {
-        "type": "string",
-        "format": "uri"
-      }
-    },
-    "timestamp": {
-      "description": "An integer, intended to trigger re-execution of the script when changed",
-      "type": "integer"
-    }
-  },
-  "additionalProperties": false
-}`
-
-	protectedSettingsSchema = `{
-  "$schema": "http://json-schema.org/draft-04/schema#",
-  "title": "Custom Script - Protected Settings",
-  "type": "object",
-  "properties": {
-    "commandToExecute": {
-      "description": "Command to be executed",
-      "type": "string"
-    },
-    "fileUris": {
-      "description": "List of files to be downloaded",
-      "type": "array",
-      "items": {
-        "type": "string",
-        "format": "uri"
-      }
-    },
-    "script": {
-      "description": "Script to be executed",
-      "type": "string"
-    },
-    "storageAccountName": {
-      "description": "Name of the Azure Storage Account (3-24 characters of lowercase letters or digits)",
-      "type": "string",
-      "pattern": "^[a-z0-9]{3,24}$"
-    },
-    "storageAccountKey": {
-      "description": "Key for the Azure Storage Account (a base64 encoded string)",
-      "type": "string",
-      "pattern": "^(?:[A-Za-z0-9+/]{4})*(?:[A-Za-z0-9+/]{2}==|[A-Za-z0-9+/]{3}=|[A-Za-z0-9+/]{4})$"
-    },
-    "managedIdentity": {
-      "description": "Setting to use Managed Service Identity to try to download fileUri from azure blob",
-      "type": "object",
-      "properties": {
-        "objectId": {
-          "description": "Object id that identifies the user created managed identity",
-          "type": "string",
-          "pattern": "^(?:[0-9A-Fa-f]{8}[-][0-9A-Fa-f]{4}[-][0-9A-Fa-f]{4}[-][0-9A-Fa-f]{4}[-][0-9A-Fa-f]{12})$"
-        },
-        "clientId": {
-          "description": "Client id that identifies the user created managed identity",
-          "type": "string",
-          "pattern": "^(?:[0-9A-Fa-f]{8}[-][0-9A-Fa-f]{4}[-][0-9A-Fa-f]{4}[-][0-9A-Fa-f]{4}[-][0-9A-Fa-f]{12})$"
-        }
-      }
-    }
-  },
-  "additionalProperties": false
-}`
+// The settings schemas are generated from the json tags of the settings structs
+// and the following tags, so that the two can't drift apart:
+//
+//	description:"..."  description of the property
+//	pattern:"..."      regular expression a string (or every array item) must match
+//	format:"..."       format a string (or every array item) must have, e.g. uri
+//	minimum:"N"        minimum of an integer
+//	minLength:"N"      minimum length of a string
+//
+// Rules spanning several properties which come with their own error code (such
+// as commandToExecute and script being exclusive) are checked by
+// handlerSettings.validate instead.
+var (
+	publicSettingsSchema    = mustGenerateSchema("Custom Script - Public Settings", reflect.TypeOf(publicSettings{}))
+	protectedSettingsSchema = mustGenerateSchema("Custom Script - Protected Settings", reflect.TypeOf(protectedSettings{}))
 )
 
-// validateObjectJSON validates the specified json with schemaJSON.
-// If json is empty string, it will be converted into an empty JSON object
-// before being validated.
-func validateObjectJSON(schema *gojsonschema.Schema, json string) error {
+// jsonSchema is the subset of JSON schema draft-04 used by the settings schemas.
+type jsonSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	Title                string                 `json:"title,omitempty"`
+	Description          string                 `json:"description,omitempty"`
+	Type                 string                 `json:"type,omitempty"`
+	Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AnyOf                []*jsonSchema          `json:"anyOf,omitempty"`
+	AdditionalProperties interface{}            `json:"additionalProperties,omitempty"` // false or the *jsonSchema of all values
+	Items                *jsonSchema            `json:"items,omitempty"`
+	Pattern              string                 `json:"pattern,omitempty"`
+	Format               string                 `json:"format,omitempty"`
+	Minimum              *int                   `json:"minimum,omitempty"`
+	MinLength            *int                   `json:"minLength,omitempty"`
+}
+
+// mustGenerateSchema returns the JSON schema of the settings struct t, which
+// does not allow properties other than its fields.
+func mustGenerateSchema(title string, t reflect.Type) string {
+	s, err := schemaOf(t)
+	if err != nil {
+		panic(fmt.Sprintf("invalid settings type %s: %v", t, err))
+	}
+	s.Schema = "http://json-schema.org/draft-04/schema#"
+	s.Title = title
+	s.AdditionalProperties = false
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		panic(fmt.Sprintf("failed to marshal schema of %s: %v", t, err))
+	}
+	return string(b)
+}
+
+// settingsSchemaer is implemented by settings types whose schema can't be
+// derived from their Go type, e.g. because they accept several JSON types.
+type settingsSchemaer interface {
+	settingsSchema() *jsonSchema
+}
+
+// schemaOf returns the schema of a value of type t, without the constraints
+// coming from the tags of the field holding it.
+func schemaOf(t reflect.Type) (*jsonSchema, error) {
+	if s, ok := reflect.Zero(t).Interface().(settingsSchemaer); ok {
+		return s.settingsSchema(), nil
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaOf(t.Elem())
+	case reflect.String:
+		return &jsonSchema{Type: "string"}, nil
+	case reflect.Bool:
+		return &jsonSchema{Type: "boolean"}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &jsonSchema{Type: "integer"}, nil
+	case reflect.Slice:
+		items, err := schemaOf(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &jsonSchema{Type: "array", Items: items}, nil
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("unsupported map key type %s", t.Key())
+		}
+		values, err := schemaOf(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &jsonSchema{Type: "object", AdditionalProperties: values}, nil
+	case reflect.Struct:
+		return structSchema(t)
+	default:
+		return nil, fmt.Errorf("unsupported type %s", t)
+	}
+}
+
+func structSchema(t reflect.Type) (*jsonSchema, error) {
+	s := &jsonSchema{Type: "object", Properties: map[string]*jsonSchema{}}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" { // unexported
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			return nil, fmt.Errorf("field %s has no json name", f.Name)
+		}
+		p, err := schemaOf(f.Type)
+		if err != nil {
+			return nil, errors.Wrapf(err, "field %s", f.Name)
+		}
+		if err := applySchemaTags(p, f.Tag); err != nil {
+			return nil, errors.Wrapf(err, "field %s", f.Name)
+		}
+		s.Properties[name] = p
+	}
+	return s, nil
+}
+
+// applySchemaTags sets the constraints given in the struct tag on the schema
+// of the field, string constraints apply to the items of arrays.
+func applySchemaTags(s *jsonSchema, tag reflect.StructTag) error {
+	s.Description = tag.Get("description")
+	target := s
+	if s.Type == "array" {
+		target = s.Items
+	}
+	if v := tag.Get("pattern"); v != "" {
+		if _, err := regexp.Compile(v); err != nil {
+			return errors.Wrap(err, "invalid pattern")
+		}
+		target.Pattern = v
+	}
+	target.Format = tag.Get("format")
+	for _, c := range []struct {
+		tag string
+		dst **int
+	}{{"minimum", &target.Minimum}, {"minLength", &target.MinLength}} {
+		if v := tag.Get(c.tag); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return errors.Wrapf(err, "invalid %s", c.tag)
+			}
+			*c.dst = &n
+		}
+	}
+	return nil
+}
+
+// printSchema implements the print-schema command, printing the JSON schema of
+// the public or protected settings, or both if not specified.
+func printSchema(args []string) int {
+	switch {
+	case len(args) == 1 && args[0] == "public":
+		fmt.Println(publicSettingsSchema)
+	case len(args) == 1 && args[0] == "protected":
+		fmt.Println(protectedSettingsSchema)
+	case len(args) == 0:
+		b, err := json.MarshalIndent(map[string]json.RawMessage{
+			"publicSettings":    json.RawMessage(publicSettingsSchema),
+			"protectedSettings": json.RawMessage(protectedSettingsSchema),
+		}, "", "  ")
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		fmt.Println(string(b))
+	default:
+		fmt.Println("Usage: print-schema [public|protected]")
+		return 2
+	}
+	return 0
+}
+
+// validateObjectJSON validates the specified json with schemaJSON and returns
+// every violation found as settingsErrors, each prefixed with its JSON path
+// under root. If json is empty string, it will be converted into an empty JSON
+// object before being validated.
+func validateObjectJSON(schema *gojsonschema.Schema, root, json string) error {
 	if json == "" {
 		json = "{}"
 	}
@@ -109,20 +202,30 @@ func validateObjectJSON(schema *gojsonschema.Schema, json string) error {
 		return err
 	}
 	if !res.Valid() {
+		var problems settingsErrors
 		for _, err := range res.Errors() {
-			// return with the first error
-			return fmt.Errorf("%s", err)
+			problems = append(problems, fmt.Sprintf("%s: %s", jsonPath(root, err.Field()), err.Description()))
 		}
+		return problems
 	}
 	return nil
 }
 
+// jsonPath joins root and the field path reported by gojsonschema, which is
+// "(root)" for the document itself.
+func jsonPath(root, field string) string {
+	if field == gojsonschema.STRING_ROOT_SCHEMA_PROPERTY {
+		return root
+	}
+	return root + "." + field
+}
+
 func validateSettingsObject(settingsType, schemaJSON, docJSON string) error {
 	schema, err := gojsonschema.NewSchema(gojsonschema.NewStringLoader(schemaJSON))
 	if err != nil {
 		return errors.Wrapf(err, "failed to load %s settings schema", settingsType)
 	}
-	if err := validateObjectJSON(schema, docJSON); err != nil {
+	if err := validateObjectJSON(schema, settingsType+"Settings", docJSON); err != nil {
 		return errors.Wrapf(err, "invalid %s settings JSON", settingsType)
 	}
 	return nil
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"encoding/json"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"github.com/xeipuuv/gojsonschema"
 )
 
 func TestValidatePublicSettings_fieldHasWrongType(t *testing.T) {
@@ -156,3 +160,135 @@ func TestValidateProtectedSettings_managedServiceIdentity(t *testing.T) {
 	require.Error(t, validateProtectedSettings(`{"managedIdentity": { "clientId": "notaguid"}}`),
 		"guid validation succeded when expected to fail")
 }
+
+func TestValidatePublicSettings_reportsEveryViolation(t *testing.T) {
+	err := validatePublicSettings(`{"commandToExecute": 1, "fileUris": ["https://a.b/c", 0], "alien": 0}`)
+	require.NotNil(t, err)
+	problems := problemsOf(err)
+	require.Len(t, problems, 3)
+	require.Contains(t, problems, "publicSettings.commandToExecute: Invalid type. Expected: string, given: integer")
+	require.Contains(t, problems, "publicSettings.fileUris.1: Invalid type. Expected: string, given: integer")
+	require.Contains(t, problems, "publicSettings: Additional property alien is not allowed")
+}
+
+func TestValidateSettingsSchema_mergesPublicAndProtected(t *testing.T) {
+	err := validateSettingsSchema(
+		map[string]interface{}{"skipDos2Unix": "yes"},
+		map[string]interface{}{"storageAccountName": "a"})
+	require.NotNil(t, err)
+	require.Equal(t, settingsErrors{
+		"publicSettings.skipDos2Unix: Invalid type. Expected: boolean, given: string",
+		`protectedSettings.storageAccountName: Does not match pattern '^[a-z0-9]{3,24}$'`,
+	}, err)
+}
+
+func Test_settingsSchema_matchesStructs(t *testing.T) {
+	for _, c := range []struct {
+		schema string
+		v      interface{}
+	}{
+		{publicSettingsSchema, publicSettings{}},
+		{protectedSettingsSchema, protectedSettings{}},
+	} {
+		var s map[string]interface{}
+		require.Nil(t, json.Unmarshal([]byte(c.schema), &s))
+		require.Equal(t, false, s["additionalProperties"])
+		requireSchemaMatchesType(t, s, reflect.TypeOf(c.v), reflect.TypeOf(c.v).Name())
+	}
+}
+
+// requireSchemaMatchesType checks that the properties in schema s are exactly
+// the json fields of struct t, with matching types.
+func requireSchemaMatchesType(t *testing.T, s map[string]interface{}, typ reflect.Type, path string) {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if _, ok := reflect.Zero(typ).Interface().(settingsSchemaer); ok {
+		require.NotEmpty(t, s, "schema of %s", path)
+		return
+	}
+	kinds := map[reflect.Kind]string{reflect.String: "string", reflect.Bool: "boolean", reflect.Int: "integer", reflect.Slice: "array", reflect.Map: "object", reflect.Struct: "object"}
+	require.Equal(t, kinds[typ.Kind()], s["type"], "type of %s", path)
+
+	switch typ.Kind() {
+	case reflect.Slice:
+		requireSchemaMatchesType(t, s["items"].(map[string]interface{}), typ.Elem(), path+"[]")
+	case reflect.Map:
+		requireSchemaMatchesType(t, s["additionalProperties"].(map[string]interface{}), typ.Elem(), path+"{}")
+	case reflect.Struct:
+		props := s["properties"].(map[string]interface{})
+		fields := map[string]bool{}
+		for i := 0; i < typ.NumField(); i++ {
+			f := typ.Field(i)
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			require.NotEmpty(t, name, "%s.%s has no json name", path, f.Name)
+			require.NotEmpty(t, f.Tag.Get("description"), "%s.%s has no description", path, f.Name)
+			p, ok := props[name]
+			require.True(t, ok, "%s.%s is missing from the schema", path, name)
+			requireSchemaMatchesType(t, p.(map[string]interface{}), f.Type, path+"."+name)
+			fields[name] = true
+		}
+		for name := range props {
+			require.True(t, fields[name], "schema property %s.%s has no field", path, name)
+		}
+	}
+}
+
+func Test_settingsSchema_acceptsPopulatedStructs(t *testing.T) {
+	b, err := json.Marshal(publicSettings{
+		SkipDos2Unix: true, CommandToExecute: "date", Script: "ZGF0ZQ==", FileURLs: []string{"https://a.b/c"},
+		Timestamp: 1, RerunPolicy: "onContentChange", ConcurrentEnable: "skip", LockTimeoutInSeconds: 60, OnNewSequenceNumber: "queue", SupersedeSignal: "SIGINT", Schedule: "15m", RunOnBoot: true, RunAsUser: "nobody", TimeoutInSeconds: 10, FileToExecute: "a.sh", Arguments: []string{"x"},
+		InlineFiles: map[string]inlineFile{"a.sh": {Content: "ZGF0ZQ=="}, "b": {Content: "ZGF0ZQ==", Mode: "0644"}}, InlineBundle: "ZGF0ZQ==",
+	})
+	require.Nil(t, err)
+	require.Nil(t, validatePublicSettings(string(b)))
+
+	b, err = json.Marshal(protectedSettings{
+		CommandToExecute: "date", Script: "ZGF0ZQ==", FileURLs: []string{"https://a.b/c"},
+		StorageAccountName: "foo", StorageAccountKey: "Zm9v",
+		ManagedIdentity:      &clientOrObjectId{ClientId: "31b403aa-c364-4240-a7ff-d85fb6cd7232", ObjectId: "31b403aa-c364-4240-a7ff-d85fb6cd7232"},
+		SignaturePublicKey:   "key",
+		EnvironmentVariables: map[string]secretValue{"A": {Value: "a"}, "B": {SecretRef: "b"}},
+		SecretVaultURL:       "https://myvault.vault.azure.net",
+		ProtectedArguments:   []string{"y"},
+		InlineFiles:          map[string]inlineFile{"a.sh": {Content: "ZGF0ZQ=="}},
+		InlineBundle:         "ZGF0ZQ==",
+	})
+	require.Nil(t, err)
+	require.Nil(t, validateProtectedSettings(string(b)))
+}
+
+func Test_generateSchema_minimums(t *testing.T) {
+	type settings struct {
+		Name  string `json:"name" minLength:"1"`
+		Count int    `json:"count" minimum:"1"`
+	}
+	schema, err := gojsonschema.NewSchema(gojsonschema.NewStringLoader(mustGenerateSchema("test", reflect.TypeOf(settings{}))))
+	require.Nil(t, err)
+
+	require.Nil(t, validateObjectJSON(schema, "test", `{"name": "a", "count": 1}`))
+	require.ElementsMatch(t, settingsErrors{
+		"test.name: String length must be greater than or equal to 1",
+		"test.count: Must be greater than or equal to 1",
+	}, validateObjectJSON(schema, "test", `{"name": "", "count": 0}`))
+}
+
+func Test_generateSchema_unsupportedType(t *testing.T) {
+	require.Panics(t, func() {
+		mustGenerateSchema("test", reflect.TypeOf(struct {
+			M map[int]string `json:"m"`
+		}{}))
+	})
+	require.Panics(t, func() {
+		mustGenerateSchema("test", reflect.TypeOf(struct {
+			S string
+		}{}))
+	})
+}
+
+func Test_printSchema(t *testing.T) {
+	require.Equal(t, 0, printSchema(nil))
+	require.Equal(t, 0, printSchema([]string{"public"}))
+	require.Equal(t, 0, printSchema([]string{"protected"}))
+	require.Equal(t, 2, printSchema([]string{"private"}))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/Azure/azure-extension-platform/vmextension"
+	"github.com/Azure/custom-script-extension-linux/pkg/download"
+	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
+	"github.com/Azure/custom-script-extension-linux/pkg/signature"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// sigstoreBundleSuffix and cosignSignatureSuffix are appended to the path
+	// of a file URL to find its signature, tried in this order.
+	sigstoreBundleSuffix  = ".sigstore.json"
+	cosignSignatureSuffix = ".sig"
+)
+
+// scriptVerifier returns the verifier the downloaded files must pass, or nil if
+// they do not need to be signed. A policy requiring signing takes precedence
+// over the public key in the protected settings.
+func scriptVerifier(cfg handlerSettings, policy *CSEExtensionPolicySettings) (*signature.Verifier, *vmextension.ErrorWithClarification) {
+	if policy != nil && policy.RequireSigning {
+		v, err := loadTrustAnchors(policy.FileRootCertCA)
+		if err != nil {
+			return nil, vmextension.NewErrorWithClarificationPtr(errorutil.ExtensionPolicySettings_policyLoadFailed, errors.Wrap(err, "invalid fileRootCertCA in the extension policy"))
+		}
+		return v, nil
+	}
+	if key := cfg.protectedSettings.SignaturePublicKey; key != "" {
+		v, err := signature.NewVerifier([]byte(key))
+		if err != nil {
+			return nil, vmextension.NewErrorWithClarificationPtr(errorutil.CustomerInput_invalidSignaturePublicKey, errors.Wrap(err, "invalid signaturePublicKey"))
+		}
+		return v, nil
+	}
+	return nil, nil
+}
+
+// verifyFileSignature downloads the signature published next to fileURL and
+// verifies the file at path, as downloaded, against it. It returns which kind of
+// signature was verified.
+func verifyFileSignature(ctx *log.Context, v *signature.Verifier, fileURL, path string, cfg *handlerSettings) (string, *vmextension.ErrorWithClarification) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", vmextension.NewErrorWithClarificationPtr(errorutil.SystemError, errors.Wrap(err, "failed to read downloaded file"))
+	}
+
+	for _, suffix := range []string{sigstoreBundleSuffix, cosignSignatureSuffix} {
+		sig, ewc := fetchSidecar(ctx, fileURL, suffix, cfg)
+		if ewc != nil {
+			return "", ewc
+		}
+		if sig == nil {
+			continue
+		}
+
+		if suffix == sigstoreBundleSuffix {
+			b, err := signature.ParseBundle(sig)
+			if err != nil {
+				return "", vmextension.NewErrorWithClarificationPtr(errorutil.FileDownload_signatureInvalid, err)
+			}
+			if err := v.VerifyBundle(data, b); err != nil {
+				return "", vmextension.NewErrorWithClarificationPtr(errorutil.FileDownload_signatureInvalid, err)
+			}
+			return "sigstore bundle", nil
+		}
+		if err := v.Verify(data, signature.DecodeSignature(sig), nil); err != nil {
+			return "", vmextension.NewErrorWithClarificationPtr(errorutil.FileDownload_signatureInvalid, err)
+		}
+		return "signature", nil
+	}
+	return "", vmextension.NewErrorWithClarificationPtr(errorutil.FileDownload_signatureMissing,
+		fmt.Errorf("no %s or %s signature found next to the file", sigstoreBundleSuffix, cosignSignatureSuffix))
+}
+
+// fetchSidecar downloads the file published at fileURL with suffix appended to
+// its path, using the same credentials as the file itself, into a temporary
+// file rather than next to the file, where the command runs. It returns nil
+// contents if the sidecar does not exist, or if access to it is denied: the
+// SAS token of the file may be scoped to its blob.
+func fetchSidecar(ctx *log.Context, fileURL, suffix string, cfg *handlerSettings) ([]byte, *vmextension.ErrorWithClarification) {
+	u, err := url.Parse(fileURL)
+	if err != nil {
+		return nil, vmextension.NewErrorWithClarificationPtr(errorutil.CustomerInput_invalidFileUris, errors.Wrap(err, "unable to parse URL"))
+	}
+	u.Path += suffix
+	u.RawPath = ""
+
+	dl, ewc := getDownloaders(u.String(), cfg.StorageAccountName, cfg.StorageAccountKey, cfg.ManagedIdentity)
+	if ewc != nil {
+		return nil, ewc
+	}
+	f, err := ioutil.TempFile("", "signature")
+	if err != nil {
+		return nil, vmextension.NewErrorWithClarificationPtr(errorutil.SystemError, errors.Wrap(err, "failed to create signature file"))
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	if _, ewc := download.SaveTo(ctx, dl, f.Name(), 0400); ewc != nil {
+		var se *download.StatusError
+		switch {
+		case ewc.ErrorCode == errorutil.FileDownload_doesNotExist, ewc.ErrorCode == errorutil.Msi_notFound:
+			return nil, nil
+		case errors.As(ewc.Err, &se) && se.StatusCode == http.StatusForbidden:
+			ctx.Log("event", "access to the signature denied", "suffix", suffix)
+			return nil, nil
+		}
+		return nil, vmextension.NewErrorWithClarificationPtr(ewc.ErrorCode, errors.Wrapf(ewc.Err, "failed to download the %s signature", suffix))
+	}
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		return nil, vmextension.NewErrorWithClarificationPtr(errorutil.SystemError, errors.Wrap(err, "failed to read downloaded signature"))
+	}
+	return b, nil
+}
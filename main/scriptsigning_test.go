@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+// signedFileServer serves the given files, only if the request carries the
+// query string of a SAS token.
+func signedFileServer(t *testing.T, files map[string][]byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.RawQuery != "sig=secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		b, ok := files[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(b)
+	}))
+}
+
+func signTestFile(t *testing.T, key *ecdsa.PrivateKey, b []byte) []byte {
+	digest := sha256.Sum256(b)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	require.Nil(t, err)
+	return sig
+}
+
+func testSigningKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.Nil(t, err)
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func Test_downloadFiles_verifiesSignatures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	key, pub := testSigningKey(t)
+
+	// CRLF line endings would be changed by dos2unix, the signature is over the original
+	script := []byte("echo hello\r\n")
+	tool := []byte("binary")
+	bundle, err := json.Marshal(map[string]interface{}{
+		"messageSignature": map[string]interface{}{"signature": signTestFile(t, key, tool)},
+	})
+	require.Nil(t, err)
+	srv := signedFileServer(t, map[string][]byte{
+		"/script.sh":                 script,
+		"/script.sh.sig":             []byte(base64.StdEncoding.EncodeToString(signTestFile(t, key, script))),
+		"/tool":                      tool,
+		"/tool.sigstore.json":        bundle,
+		"/tool.sig":                  []byte("not used"),
+		"/unsigned.sh":               script,
+		"/tampered.sh":               []byte("rm -rf /"),
+		"/tampered.sh.sigstore.json": bundle,
+	})
+	defer srv.Close()
+
+	cfg := handlerSettings{
+		publicSettings:    publicSettings{FileURLs: []string{srv.URL + "/script.sh?sig=secret", srv.URL + "/tool?sig=secret"}},
+		protectedSettings: protectedSettings{SignaturePublicKey: pub},
+	}
+	msg, ewc := downloadFiles(log.NewContext(log.NewNopLogger()), dir, cfg, nil)
+	require.Nil(t, ewc)
+	require.Equal(t, "\n[signatures]\nfile[0] script.sh: verified signature\nfile[1] tool: verified sigstore bundle", msg)
+	require.Equal(t, "echo hello\n", string(readFile(t, filepath.Join(dir, "script.sh"))))
+	files, err := ioutil.ReadDir(dir)
+	require.Nil(t, err)
+	require.Len(t, files, 2, "the signatures are not kept where the command runs")
+
+	cfg.publicSettings.FileURLs = []string{srv.URL + "/unsigned.sh?sig=secret"}
+	_, ewc = downloadFiles(log.NewContext(log.NewNopLogger()), dir, cfg, nil)
+	require.NotNil(t, ewc)
+	require.Equal(t, errorutil.FileDownload_signatureMissing, ewc.ErrorCode)
+
+	cfg.publicSettings.FileURLs = []string{srv.URL + "/tampered.sh?sig=secret"}
+	_, ewc = downloadFiles(log.NewContext(log.NewNopLogger()), dir, cfg, nil)
+	require.NotNil(t, ewc)
+	require.Equal(t, errorutil.FileDownload_signatureInvalid, ewc.ErrorCode)
+	require.Contains(t, ewc.Err.Error(), "tampered.sh")
+}
+
+func Test_downloadFiles_signatureAccessDenied(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	_, pub := testSigningKey(t)
+	// a SAS token scoped to the blob of the file
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/script.sh" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("echo"))
+	}))
+	defer srv.Close()
+
+	_, ewc := downloadFiles(log.NewContext(log.NewNopLogger()), dir, handlerSettings{
+		publicSettings:    publicSettings{FileURLs: []string{srv.URL + "/script.sh?sig=secret"}},
+		protectedSettings: protectedSettings{SignaturePublicKey: pub},
+	}, nil)
+	require.NotNil(t, ewc)
+	require.Equal(t, errorutil.FileDownload_signatureMissing, ewc.ErrorCode)
+}
+
+func Test_downloadFiles_noSignaturesWithoutKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	srv := signedFileServer(t, map[string][]byte{"/unsigned.sh": []byte("echo")})
+	defer srv.Close()
+
+	msg, ewc := downloadFiles(log.NewContext(log.NewNopLogger()), dir, handlerSettings{
+		publicSettings: publicSettings{FileURLs: []string{srv.URL + "/unsigned.sh?sig=secret"}},
+	}, nil)
+	require.Nil(t, ewc)
+	require.Empty(t, msg)
+}
+
+func Test_scriptVerifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	_, pub := testSigningKey(t)
+
+	v, ewc := scriptVerifier(handlerSettings{}, nil)
+	require.Nil(t, ewc)
+	require.Nil(t, v)
+
+	v, ewc = scriptVerifier(handlerSettings{}, &CSEExtensionPolicySettings{RequireSigning: false, FileRootCertCA: "/non/existing"})
+	require.Nil(t, ewc)
+	require.Nil(t, v)
+
+	_, ewc = scriptVerifier(handlerSettings{protectedSettings: protectedSettings{SignaturePublicKey: "garbage"}}, nil)
+	require.NotNil(t, ewc)
+	require.Equal(t, errorutil.CustomerInput_invalidSignaturePublicKey, ewc.ErrorCode)
+
+	// the policy wins over an invalid customer key
+	ca := filepath.Join(dir, "ca.pem")
+	require.Nil(t, writeToFile(ca, pub))
+	v, ewc = scriptVerifier(handlerSettings{protectedSettings: protectedSettings{SignaturePublicKey: "garbage"}},
+		&CSEExtensionPolicySettings{RequireSigning: true, FileRootCertCA: ca})
+	require.Nil(t, ewc)
+	require.NotNil(t, v)
+
+	_, ewc = scriptVerifier(handlerSettings{}, &CSEExtensionPolicySettings{RequireSigning: true, FileRootCertCA: filepath.Join(dir, "missing.pem")})
+	require.NotNil(t, ewc)
+	require.Equal(t, errorutil.ExtensionPolicySettings_policyLoadFailed, ewc.ErrorCode)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+
+	vmextension "github.com/Azure/azure-extension-platform/vmextension"
+	"github.com/Azure/custom-script-extension-linux/pkg/download"
+	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
+	"github.com/Azure/custom-script-extension-linux/pkg/secrets"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// secretEnvPrefix prefixes the names of the environment variables holding
+	// the secrets referenced in the command.
+	secretEnvPrefix = "CSE_SECRET_"
+)
+
+var (
+	// secretRefRegex matches the secret references in a command, e.g.
+	// {{secretRef:name}}, with the name as the first submatch.
+	secretRefRegex = regexp.MustCompile(`\{\{secretRef:([^{}]*)\}\}`)
+
+	// envNameRegex matches the environment variable names the shell accepts.
+	envNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// secretValue is the value of an environment variable in the settings: either
+// a string, or a reference to a secret like {"secretRef": "name"}.
+type secretValue struct {
+	Value     string
+	SecretRef string
+}
+
+func (v *secretValue) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &v.Value); err == nil {
+		return nil
+	}
+	var ref struct {
+		SecretRef string `json:"secretRef"`
+	}
+	if err := json.Unmarshal(b, &ref); err != nil || ref.SecretRef == "" {
+		return errors.New(`value must be a string or {"secretRef": "<name>"}`)
+	}
+	v.SecretRef = ref.SecretRef
+	return nil
+}
+
+func (v secretValue) MarshalJSON() ([]byte, error) {
+	if v.SecretRef != "" {
+		return json.Marshal(map[string]string{"secretRef": v.SecretRef})
+	}
+	return json.Marshal(v.Value)
+}
+
+func (secretValue) settingsSchema() *jsonSchema {
+	minLength := 1
+	return &jsonSchema{AnyOf: []*jsonSchema{
+		{Type: "string"},
+		{
+			Type:                 "object",
+			Properties:           map[string]*jsonSchema{"secretRef": {Type: "string", MinLength: &minLength, Description: "Name of the secret in the secret provider"}},
+			Required:             []string{"secretRef"},
+			AdditionalProperties: false,
+		},
+	}}
+}
+
+// hasSecretRefs returns true if the command or the environment variables of
+// cfg reference any secret.
+func hasSecretRefs(cmd string, cfg handlerSettings) bool {
+	if secretRefRegex.MatchString(cmd) {
+		return true
+	}
+	for _, v := range cfg.protectedSettings.EnvironmentVariables {
+		if v.SecretRef != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// newSecretProvider returns the provider resolving the secrets of cfg: the
+// vault at secretVaultUrl using the managed identity, or else the files in
+// secretsDir.
+func newSecretProvider(cfg handlerSettings) (secrets.Provider, error) {
+	vaultURL := cfg.protectedSettings.SecretVaultURL
+	if vaultURL == "" {
+		return secrets.NewFileProvider(secretsDir)
+	}
+	resource, err := secrets.VaultResource(vaultURL)
+	if err != nil {
+		return nil, err
+	}
+	var clientID, objectID string
+	if mi := cfg.protectedSettings.ManagedIdentity; mi != nil {
+		clientID, objectID = mi.ClientId, mi.ObjectId
+	}
+	msiProvider := download.GetMsiProviderForResource(resource, clientID, objectID)
+	return secrets.NewVaultProvider(vaultURL, func() (string, error) {
+		m, err := msiProvider()
+		if err != nil {
+			return "", err
+		}
+		return m.AccessToken, nil
+	})
+}
+
+// resolveSecrets returns the environment of the command made of the protected
+// environment variables of cfg, and cmd with its secret references replaced by
+// expansions of additional environment variables holding the secrets. That
+// way the secrets don't show up in the command line of any process.
+//
+// Neither the logs nor the returned errors contain the resolved values.
+func resolveSecrets(ctx log.Logger, cmd string, cfg handlerSettings) (string, []string, *vmextension.ErrorWithClarification) {
+	var env []string
+	if !hasSecretRefs(cmd, cfg) {
+		for _, name := range sortedEnvNames(cfg) {
+			env = append(env, name+"="+cfg.protectedSettings.EnvironmentVariables[name].Value)
+		}
+		return cmd, env, nil
+	}
+
+	ctx.Log("event", "resolving secrets")
+	provider, err := newSecretProvider(cfg)
+	if err != nil {
+		return "", nil, secretError(err, "failed to initialize the secret provider")
+	}
+	resolved := map[string]string{}
+	get := func(name string) (string, *vmextension.ErrorWithClarification) {
+		if v, ok := resolved[name]; ok {
+			return v, nil
+		}
+		v, err := provider.Get(name)
+		if err != nil {
+			return "", secretError(err, fmt.Sprintf("failed to resolve secret %q", name))
+		}
+		resolved[name] = v
+		return v, nil
+	}
+
+	for _, name := range sortedEnvNames(cfg) {
+		v := cfg.protectedSettings.EnvironmentVariables[name]
+		if v.SecretRef != "" {
+			var ewc *vmextension.ErrorWithClarification
+			if v.Value, ewc = get(v.SecretRef); ewc != nil {
+				return "", nil, ewc
+			}
+		}
+		env = append(env, name+"="+v.Value)
+	}
+
+	vars := map[string]string{}
+	var ewc *vmextension.ErrorWithClarification
+	cmd = secretRefRegex.ReplaceAllStringFunc(cmd, func(ref string) string {
+		name := secretRefRegex.FindStringSubmatch(ref)[1]
+		if ewc != nil {
+			return ref
+		}
+		if _, ok := vars[name]; !ok {
+			var v string
+			if v, ewc = get(name); ewc != nil {
+				return ref
+			}
+			vars[name] = fmt.Sprintf("%s%d", secretEnvPrefix, len(vars))
+			env = append(env, vars[name]+"="+v)
+		}
+		return "${" + vars[name] + "}"
+	})
+	if ewc != nil {
+		return "", nil, ewc
+	}
+	ctx.Log("event", "resolved secrets", "count", len(resolved))
+	return cmd, env, nil
+}
+
+// sortedEnvNames returns the names of the protected environment variables of
+// cfg in a stable order.
+func sortedEnvNames(cfg handlerSettings) []string {
+	var names []string
+	for name := range cfg.protectedSettings.EnvironmentVariables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// secretError returns the error resolving a secret with the code matching its
+// cause.
+func secretError(err error, msg string) *vmextension.ErrorWithClarification {
+	code := errorutil.SecretProvider_unavailable
+	switch errors.Cause(err) {
+	case secrets.ErrNotFound:
+		code = errorutil.SecretProvider_secretNotFound
+	case secrets.ErrAccessDenied:
+		code = errorutil.SecretProvider_accessDenied
+	}
+	return vmextension.NewErrorWithClarificationPtr(code, errors.Wrap(err, msg))
+}
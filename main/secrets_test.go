@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_secretValue_unmarshal(t *testing.T) {
+	var env map[string]secretValue
+	require.Nil(t, json.Unmarshal([]byte(`{"A": "a", "B": {"secretRef": "b"}}`), &env))
+	require.Equal(t, map[string]secretValue{"A": {Value: "a"}, "B": {SecretRef: "b"}}, env)
+
+	b, err := json.Marshal(env)
+	require.Nil(t, err)
+	require.JSONEq(t, `{"A": "a", "B": {"secretRef": "b"}}`, string(b))
+
+	require.NotNil(t, json.Unmarshal([]byte(`{"A": 1}`), &env))
+	require.NotNil(t, json.Unmarshal([]byte(`{"A": {"secretRef": ""}}`), &env))
+	require.NotNil(t, json.Unmarshal([]byte(`{"A": {"name": "b"}}`), &env))
+}
+
+func Test_validateProtectedSettings_environmentVariables(t *testing.T) {
+	require.Nil(t, validateProtectedSettings(`{"protectedEnvironmentVariables": {"A": "a", "B": {"secretRef": "b"}}}`))
+	require.NotNil(t, validateProtectedSettings(`{"protectedEnvironmentVariables": {"A": 1}}`))
+	require.NotNil(t, validateProtectedSettings(`{"protectedEnvironmentVariables": {"A": {"secretRef": "b", "other": 1}}}`))
+	require.NotNil(t, validateProtectedSettings(`{"secretVaultUrl": "http://myvault.vault.azure.net"}`))
+}
+
+func Test_validate_secretReferences(t *testing.T) {
+	h := handlerSettings{
+		publicSettings{CommandToExecute: "echo {{secretRef:../x}}"},
+		protectedSettings{EnvironmentVariables: map[string]secretValue{
+			"1A":          {Value: "a"},
+			"CSE_SECRET_": {Value: "b"},
+			"C":           {SecretRef: "a/b"},
+		}},
+	}
+	ewc := h.validate()
+	require.NotNil(t, ewc)
+	require.Equal(t, errorutil.CustomerInput_invalidEnvironmentVariable, ewc.ErrorCode)
+	require.Len(t, problemsOf(ewc.Err), 4)
+}
+
+func Test_resolveSecrets(t *testing.T) {
+	setTestSecretsDir(t, map[string]string{"password": "s3cr3t", "token": "t0k3n"})
+
+	cfg := handlerSettings{protectedSettings: protectedSettings{EnvironmentVariables: map[string]secretValue{
+		"USER":     {Value: "admin"},
+		"PASSWORD": {SecretRef: "password"},
+	}}}
+	var logs bytes.Buffer
+	cmd, env, ewc := resolveSecrets(log.NewLogfmtLogger(&logs),
+		`login "{{secretRef:token}}" {{secretRef:password}} {{secretRef:token}}`, cfg)
+	require.Nil(t, ewc)
+	require.Equal(t, `login "${CSE_SECRET_0}" ${CSE_SECRET_1} ${CSE_SECRET_0}`, cmd)
+	require.Equal(t, []string{"PASSWORD=s3cr3t", "USER=admin", "CSE_SECRET_0=t0k3n", "CSE_SECRET_1=s3cr3t"}, env)
+	require.NotContains(t, logs.String(), "s3cr3t")
+	require.NotContains(t, logs.String(), "t0k3n")
+
+	_, _, ewc = resolveSecrets(log.NewNopLogger(), "echo {{secretRef:missing}}", cfg)
+	require.NotNil(t, ewc)
+	require.Equal(t, errorutil.SecretProvider_secretNotFound, ewc.ErrorCode)
+	require.Contains(t, ewc.Err.Error(), `failed to resolve secret "missing"`)
+}
+
+func Test_resolveSecrets_withoutReferences(t *testing.T) {
+	// the secret provider is not needed
+	defer func(d string) { secretsDir = d }(secretsDir)
+	secretsDir = "/non/existing"
+
+	cmd, env, ewc := resolveSecrets(log.NewNopLogger(), "date", handlerSettings{protectedSettings: protectedSettings{
+		EnvironmentVariables: map[string]secretValue{"B": {Value: "b"}, "A": {Value: "a"}},
+	}})
+	require.Nil(t, ewc)
+	require.Equal(t, "date", cmd)
+	require.Equal(t, []string{"A=a", "B=b"}, env)
+
+	_, _, ewc = resolveSecrets(log.NewNopLogger(), "echo {{secretRef:a}}", handlerSettings{})
+	require.NotNil(t, ewc)
+	require.Equal(t, errorutil.SecretProvider_unavailable, ewc.ErrorCode)
+}
+
+func Test_runCmd_secrets(t *testing.T) {
+	setTestSecretsDir(t, map[string]string{"password": "it's a $ecret"})
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	require.Nil(t, runCmd(log.NewNopLogger(), dir, handlerSettings{
+		publicSettings: publicSettings{CommandToExecute: `echo "{{secretRef:password}}|$FROM_ENV|$PLAIN"`},
+		protectedSettings: protectedSettings{EnvironmentVariables: map[string]secretValue{
+			"FROM_ENV": {SecretRef: "password"},
+			"PLAIN":    {Value: "plain"},
+		}},
+	}, nil, nil))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "stdout"))
+	require.Nil(t, err)
+	require.Equal(t, "it's a $ecret|it's a $ecret|plain\n", string(b))
+}
+
+// setTestSecretsDir points secretsDir to a new private directory with the
+// given secrets.
+func setTestSecretsDir(t *testing.T, secrets map[string]string) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	require.Nil(t, os.Chmod(dir, 0700))
+	for name, v := range secrets {
+		require.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(v+"\n"), 0600))
+	}
+	orig := secretsDir
+	secretsDir = dir
+	t.Cleanup(func() {
+		secretsDir = orig
+		os.RemoveAll(dir)
+	})
+}
@@ -4,9 +4,9 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
-	"strings"
 )
 
 const (
@@ -25,16 +25,25 @@ func FindSeqNumStatus(path string) (int, error) {
 }
 
 // FindSeqNum finds the file with the highest number under configFolder
-// named like 0.settings, 1.settings so on.
+// named like 0.settings, 1.settings so on, or {extensionName}.0.settings for
+// a multi-config extension instance, ignoring the files of other instances.
 func FindSeqNum(path, ext string) (int, error) {
 	g, err := filepath.Glob(filepath.Join(path, fmt.Sprintf("*%s", ext)))
 	if err != nil {
 		return 0, err
 	}
-	seqs := make([]int, len(g))
+	re := regexp.MustCompile(instanceFileRegex(ext))
+	seqs := make([]int, 0, len(g))
 	for _, v := range g {
 		f := filepath.Base(v)
-		i, err := strconv.Atoi(strings.TrimSuffix(f, filepath.Ext(f)))
+		m := re.FindStringSubmatch(f)
+		if m == nil && extensionName != "" {
+			continue
+		}
+		if m == nil {
+			return 0, fmt.Errorf("Can't parse int from filename: %s", f)
+		}
+		i, err := strconv.Atoi(m[1])
 		if err != nil {
 			return 0, fmt.Errorf("Can't parse int from filename: %s", f)
 		}
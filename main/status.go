@@ -33,6 +33,17 @@ const (
 type Status struct {
 	Operation        string           `json:"operation"`
 	Status           Type             `json:"status"`
+	Code             int              `json:"code,omitempty"`
+	FormattedMessage FormattedMessage `json:"formattedMessage"`
+	Substatus        []SubstatusItem  `json:"substatus,omitempty"`
+}
+
+// SubstatusItem is the status of a part of the operation, such as one of
+// several runtime settings blocks executed by enable.
+type SubstatusItem struct {
+	Name             string           `json:"name"`
+	Status           Type             `json:"status"`
+	Code             int              `json:"code,omitempty"`
 	FormattedMessage FormattedMessage `json:"formattedMessage"`
 }
 type FormattedMessage struct {
@@ -56,6 +67,18 @@ func NewStatus(t Type, operation, message string) StatusReport {
 	}
 }
 
+// NewSubstatus returns the substatus named name with the given message.
+func NewSubstatus(name string, t Type, code int, message string) SubstatusItem {
+	return SubstatusItem{
+		Name:   name,
+		Status: t,
+		Code:   code,
+		FormattedMessage: FormattedMessage{
+			Lang:    "en",
+			Message: message},
+	}
+}
+
 func (r StatusReport) marshal() ([]byte, error) {
 	return json.MarshalIndent(r, "", "\t")
 }
@@ -64,7 +87,7 @@ func (r StatusReport) marshal() ([]byte, error) {
 // sequence number. The operation consists of writing to a temporary file in the
 // same folder and moving it to the final destination for atomicity.
 func (r StatusReport) Save(statusFolder string, seqNum int) error {
-	fn := fmt.Sprintf("%d.status", seqNum)
+	fn := instanceFileName(seqNum, ".status")
 	path := filepath.Join(statusFolder, fn)
 	tmpFile, err := ioutil.TempFile(statusFolder, fn)
 	if err != nil {
@@ -87,16 +110,17 @@ func (r StatusReport) Save(statusFolder string, seqNum int) error {
 }
 
 // reportStatus saves operation status to the status file for the extension
-// handler with the optional given message, if the given cmd requires reporting
-// status.
+// handler with the optional given message and substatus, if the given cmd
+// requires reporting status.
 //
 // If an error occurs reporting the status, it will be logged and returned.
-func reportStatus(ctx *log.Context, hEnv HandlerEnvironment, seqNum int, t Type, c cmd, msg string) error {
+func reportStatus(ctx *log.Context, hEnv HandlerEnvironment, seqNum int, t Type, c cmd, msg string, substatus ...SubstatusItem) error {
 	if !c.shouldReportStatus {
 		ctx.Log("status", "not reported for operation (by design)")
 		return nil
 	}
 	s := NewStatus(t, c.name, statusMsg(c, t, msg))
+	s[0].Status.Substatus = substatus
 	if err := s.Save(hEnv.HandlerEnvironment.StatusFolder, seqNum); err != nil {
 		ctx.Log("event", "failed to save handler status", "error", err)
 		return errors.Wrap(err, "failed to save handler status")
@@ -106,10 +130,10 @@ func reportStatus(ctx *log.Context, hEnv HandlerEnvironment, seqNum int, t Type,
 
 // reportErrorStatus saves the error(s) that occurred during the operation
 // to the status file for the extension handler with clarification messages and codes,
-// if the given cmd requires reporting status.
+// and the optional substatus, if the given cmd requires reporting status.
 //
 // If an error occurs reporting the status, it will be logged and returned.
-func reportErrorStatus(ctx *log.Context, hEnv HandlerEnvironment, seqNum int, t Type, c cmd, ewc *vmextension.ErrorWithClarification) error {
+func reportErrorStatus(ctx *log.Context, hEnv HandlerEnvironment, seqNum int, t Type, c cmd, ewc *vmextension.ErrorWithClarification, substatus ...SubstatusItem) error {
 	if !c.shouldReportStatus {
 		ctx.Log("status", "not reported for operation (by design)")
 		return nil
@@ -118,6 +142,12 @@ func reportErrorStatus(ctx *log.Context, hEnv HandlerEnvironment, seqNum int, t
 	if ewc == nil {
 		s := NewStatus(t, c.name, statusMsg(c, t, ewc.Err.Error()))
 		err = s.Save(hEnv.HandlerEnvironment.StatusFolder, seqNum)
+	} else if len(substatus) > 0 || extensionName != "" {
+		// the platform's error status has neither substatus nor instance names
+		s := NewStatus(t, c.name, ewc.Error())
+		s[0].Status.Code = ewc.ErrorCode
+		s[0].Status.Substatus = substatus
+		err = s.Save(hEnv.HandlerEnvironment.StatusFolder, seqNum)
 	} else {
 		s := status.NewError(c.name, status.ErrorClarification{Code: ewc.ErrorCode, Message: ewc.Error()})
 		err = s.Save(hEnv.HandlerEnvironment.StatusFolder, uint(seqNum))
@@ -131,7 +161,7 @@ func reportErrorStatus(ctx *log.Context, hEnv HandlerEnvironment, seqNum int, t
 
 // readStatus loads current status file in StatusReport
 func readStatus(ctx *log.Context, hEnv HandlerEnvironment, seqNum int) (Type, error) {
-	fileName := fmt.Sprintf("%d.status", seqNum)
+	fileName := instanceFileName(seqNum, ".status")
 	path := filepath.Join(hEnv.HandlerEnvironment.StatusFolder, fileName)
 	buffer, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -66,6 +67,44 @@ func Test_reportErrorStatus_fileExists(t *testing.T) {
 	require.NotEqual(t, 0, len(b), ".status file not empty")
 }
 
+func Test_reportStatus_substatus(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	fakeEnv := HandlerEnvironment{}
+	fakeEnv.HandlerEnvironment.StatusFolder = tmpDir
+	ctx := log.NewContext(log.NewNopLogger())
+
+	// without substatus there is no substatus key
+	require.Nil(t, reportStatus(ctx, fakeEnv, 1, StatusSuccess, cmdEnable, "msg"))
+	b, err := ioutil.ReadFile(filepath.Join(tmpDir, "1.status"))
+	require.Nil(t, err)
+	require.NotContains(t, string(b), "substatus")
+
+	require.Nil(t, reportStatus(ctx, fakeEnv, 1, StatusSuccess, cmdEnable, "msg",
+		NewSubstatus("runtimeSettings[0]", StatusSuccess, 0, "ok")))
+	var r StatusReport
+	b, err = ioutil.ReadFile(filepath.Join(tmpDir, "1.status"))
+	require.Nil(t, err)
+	require.Nil(t, json.Unmarshal(b, &r))
+	require.Equal(t, []SubstatusItem{NewSubstatus("runtimeSettings[0]", StatusSuccess, 0, "ok")}, r[0].Status.Substatus)
+
+	// errors with substatus keep their code
+	ewc := vmextension.NewErrorWithClarificationPtr(errorutil.CommandExecution_failureExitCode, fmt.Errorf("1 of 2 runtime settings failed"))
+	require.Nil(t, reportErrorStatus(ctx, fakeEnv, 1, StatusError, cmdEnable, ewc,
+		NewSubstatus("runtimeSettings[0]", StatusSuccess, 0, "ok"),
+		NewSubstatus("runtimeSettings[1]", StatusError, errorutil.CommandExecution_failureExitCode, "failed")))
+	b, err = ioutil.ReadFile(filepath.Join(tmpDir, "1.status"))
+	require.Nil(t, err)
+	require.Nil(t, json.Unmarshal(b, &r))
+	require.Equal(t, StatusError, r[0].Status.Status)
+	require.Equal(t, errorutil.CommandExecution_failureExitCode, r[0].Status.Code)
+	require.Contains(t, r[0].Status.FormattedMessage.Message, "1 of 2 runtime settings failed")
+	require.Len(t, r[0].Status.Substatus, 2)
+	require.Equal(t, StatusError, r[0].Status.Substatus[1].Status)
+}
+
 func Test_reportStatus_checksIfShouldBeReported(t *testing.T) {
 	for _, c := range cmds {
 		tmpDir, err := ioutil.TempDir("", "status-"+c.name)
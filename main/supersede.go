@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"syscall"
+	"time"
+
+	vmextension "github.com/Azure/azure-extension-platform/vmextension"
+	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
+	"github.com/Azure/custom-script-extension-linux/pkg/seqnum"
+	"github.com/Azure/custom-script-extension-linux/pkg/state"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// What enable does with the command of another sequence number which still
+// runs, see publicSettings.OnNewSequenceNumber.
+const (
+	// onNewSeqNumSupersede terminates the running command.
+	onNewSeqNumSupersede = "supersede"
+	// onNewSeqNumQueue waits for the running command to complete.
+	onNewSeqNumQueue = "queue"
+
+	defaultSupersedeSignal = "SIGTERM"
+)
+
+var (
+	// supersedeSignals are the signals which may terminate a superseded
+	// command, by name.
+	supersedeSignals = map[string]syscall.Signal{
+		"SIGTERM": syscall.SIGTERM,
+		"SIGINT":  syscall.SIGINT,
+		"SIGHUP":  syscall.SIGHUP,
+		"SIGQUIT": syscall.SIGQUIT,
+		"SIGKILL": syscall.SIGKILL,
+		"SIGUSR1": syscall.SIGUSR1,
+		"SIGUSR2": syscall.SIGUSR2,
+	}
+
+	// terminateGracePeriod is how long a superseded or disabled command may
+	// take to exit after the signal before it is killed.
+	terminateGracePeriod = 30 * time.Second
+
+	// terminatePollInterval is how often enable or disable checks whether the
+	// terminated command exited.
+	terminatePollInterval = 100 * time.Millisecond
+)
+
+// supersedeSettingsOf returns whether a running command of another sequence
+// number is superseded, and with which signal, according to the first
+// runtime settings block.
+func supersedeSettingsOf(pub []map[string]interface{}) (supersede bool, sig syscall.Signal) {
+	sig = supersedeSignals[defaultSupersedeSignal]
+	if len(pub) == 0 {
+		return true, sig
+	}
+	if name, _ := pub[0]["supersedeSignal"].(string); supersedeSignals[name] != 0 {
+		sig = supersedeSignals[name]
+	}
+	policy, _ := pub[0]["onNewSequenceNumber"].(string)
+	return policy != onNewSeqNumQueue, sig
+}
+
+// supersededExecution returns the state of the sequence number whose command
+// enable of seqNum must terminate according to the settings pub, and the
+// signal to send, or nil. Only a new sequence number, newer than the most
+// recent one processed, supersedes the command of an older one; a repeated or
+// stale enable doesn't.
+func supersededExecution(ctx log.Logger, pub []map[string]interface{}, seqNum int) (*state.State, syscall.Signal) {
+	supersede, sig := supersedeSettingsOf(pub)
+	if !supersede {
+		return nil, sig
+	}
+	if last, ok, err := seqnum.Get(instanceMostRecentSequence()); err != nil {
+		ctx.Log("event", "could not check sequence number, not superseding", "error", err)
+		return nil, sig
+	} else if ok && seqNum <= last {
+		return nil, sig
+	}
+	return runningExecution(ctx, seqNum), sig
+}
+
+// queuedExecution returns the state of the sequence number whose command
+// enable of seqNum waits for according to the settings pub, or nil.
+func queuedExecution(ctx log.Logger, pub []map[string]interface{}, seqNum int) *state.State {
+	if supersede, _ := supersedeSettingsOf(pub); supersede {
+		return nil
+	}
+	return runningExecution(ctx, seqNum)
+}
+
+// runningExecution returns the state of a sequence number of the handled
+// extension instance older than seqNum whose command still runs, or nil.
+func runningExecution(ctx log.Logger, seqNum int) *state.State {
+	for _, st := range runningExecutions(ctx) {
+		if st.SeqNum < seqNum {
+			return st
+		}
+	}
+	return nil
+}
+
+// runningExecutions returns the states of the sequence numbers of the handled
+// extension instance whose command still runs.
+func runningExecutions(ctx log.Logger) []*state.State {
+	dir := filepath.Join(dataDir, stateDir)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	re := regexp.MustCompile(instanceFileRegex(stateFileSuffix))
+	var running []*state.State
+	for _, f := range files {
+		m := re.FindStringSubmatch(f.Name())
+		if m == nil {
+			continue
+		}
+		seq, err := strconv.Atoi(m[1])
+		if err != nil {
+			continue
+		}
+		st, err := state.Read(filepath.Join(dir, f.Name()))
+		if err != nil {
+			ctx.Log("event", "could not read state", "seq", seq, "error", err)
+			continue
+		}
+		if st != nil && st.Phase == state.Executing && st.Pid != 0 && st.BootID == bootID() && processGroupAlive(st.Pid) {
+			running = append(running, st)
+		}
+	}
+	return running
+}
+
+// markSuperseding records in the state file of st that seqNum terminates its
+// command, so that its enable doesn't go on with the next runtime settings.
+func markSuperseding(ctx log.Logger, st *state.State, seqNum int) {
+	cur := *st
+	cur.SupersededBy = seqNum
+	if err := state.Write(instanceStatePath(st.SeqNum), cur); err != nil {
+		ctx.Log("event", "could not record superseding sequence number", "seq", st.SeqNum, "error", err)
+	}
+}
+
+// acquireEnableLockBehind takes the enable lock like acquireEnableLock. While
+// the command of queued, if any, still runs, it keeps waiting for it whatever
+// wait is; wait applies from the time it exited.
+func acquireEnableLockBehind(ctx log.Logger, seqNum int, wait time.Duration, queued *state.State) (time.Duration, *lockHolder, error) {
+	var total time.Duration
+	for {
+		waited, holder, err := acquireEnableLock(instanceLockPath(), seqNum, wait)
+		total += waited
+		if err != errLockBusy || queued == nil || !processGroupAlive(queued.Pid) {
+			return total, holder, err
+		}
+		ctx.Log("event", "still queued", "seq", queued.SeqNum, "pid", queued.Pid, "waited", total)
+	}
+}
+
+// terminateProcessGroup sends sig to the process group of pid and waits for
+// it to exit. If it still runs after terminateGracePeriod, it is killed.
+func terminateProcessGroup(ctx log.Logger, pid int, sig syscall.Signal) error {
+	ctx.Log("event", "terminating process group", "pid", pid, "signal", sig)
+	if err := syscall.Kill(-pid, sig); err != nil && err != syscall.ESRCH {
+		return errors.Wrapf(err, "failed to send %v to process group %d", sig, pid)
+	}
+	deadline := time.Now().Add(terminateGracePeriod)
+	for processGroupAlive(pid) {
+		if time.Now().After(deadline) {
+			ctx.Log("event", "killing process group", "pid", pid)
+			if err := syscall.Kill(-pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+				return errors.Wrapf(err, "failed to kill process group %d", pid)
+			}
+			deadline = time.Now().Add(terminateGracePeriod)
+		}
+		time.Sleep(terminatePollInterval)
+	}
+	return nil
+}
+
+// supersededBlockError returns the error reported for a runtime settings
+// block of seqNum which didn't run since superseding superseded it.
+func supersededBlockError(seqNum, superseding int) *vmextension.ErrorWithClarification {
+	return vmextension.NewErrorWithClarificationPtr(errorutil.CommandExecution_superseded,
+		fmt.Errorf("not run since sequence number %d superseded sequence number %d", superseding, seqNum))
+}
+
+// supersededError returns the error reported for the sequence number of st
+// whose command was terminated for seqNum.
+func supersededError(st *state.State, seqNum int) *vmextension.ErrorWithClarification {
+	return vmextension.NewErrorWithClarificationPtr(errorutil.CommandExecution_superseded,
+		fmt.Errorf("the command (pid %d) was terminated since sequence number %d superseded sequence number %d", st.Pid, seqNum, st.SeqNum))
+}
+
+// markTerminated reports the sequence number of st, whose command was
+// terminated, as failed with ewc in its status and state files. It is called
+// once the enable invocation of st released the enable lock, so that nothing
+// overwrites them.
+func markTerminated(ctx *log.Context, hEnv HandlerEnvironment, st *state.State, ewc *vmextension.ErrorWithClarification) {
+	// cmdEnable can't be referred to from enablePre, the fields used by
+	// reportErrorStatus are the same
+	c := cmd{name: "Enable", shouldReportStatus: true}
+	if err := reportErrorStatus(ctx, hEnv, st.SeqNum, StatusError, c, ewc); err != nil {
+		ctx.Log("event", "could not report terminated sequence number", "seq", st.SeqNum, "error", err)
+	}
+	completeTerminated(ctx, st, ewc)
+}
+
+// completeTerminated records the sequence number of st, whose command was
+// terminated, as completed with ewc in its state file.
+func completeTerminated(ctx log.Logger, st *state.State, ewc *vmextension.ErrorWithClarification) {
+	// the state as the enable invocation of st left it
+	cur, err := state.Read(instanceStatePath(st.SeqNum))
+	if err != nil || cur == nil {
+		cur = st
+	}
+	t := newStateTracker(ctx, st.SeqNum)
+	t.state = *cur
+	t.state.Pid = 0
+	t.completed(ewc)
+}
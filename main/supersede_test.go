@@ -0,0 +1,173 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
+	"github.com/Azure/custom-script-extension-linux/pkg/state"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_supersedeSettingsOf(t *testing.T) {
+	supersede, sig := supersedeSettingsOf(nil)
+	require.True(t, supersede)
+	require.Equal(t, syscall.SIGTERM, sig)
+
+	supersede, sig = supersedeSettingsOf([]map[string]interface{}{{"onNewSequenceNumber": "queue", "supersedeSignal": "SIGINT"}})
+	require.False(t, supersede)
+	require.Equal(t, syscall.SIGINT, sig)
+}
+
+func Test_runningExecution(t *testing.T) {
+	setTestDataDir(t)
+	nop := log.NewNopLogger()
+	require.Nil(t, runningExecution(nop, 2), "no state")
+
+	c := startProcessGroup(t, "sleep 30")
+	newStateTracker(nop, 1).executing(c.Process.Pid)
+	require.Nil(t, runningExecution(nop, 1), "the same sequence number")
+	require.Nil(t, runningExecution(nop, 0), "a newer sequence number")
+	st := runningExecution(nop, 2)
+	require.NotNil(t, st)
+	require.Equal(t, 1, st.SeqNum)
+
+	require.Nil(t, terminateProcessGroup(nop, c.Process.Pid, syscall.SIGKILL))
+	require.Nil(t, runningExecution(nop, 2), "exited")
+}
+
+func Test_supersededExecution(t *testing.T) {
+	setTestDataDir(t)
+	setTestMostRecentSequence(t)
+	nop := log.NewNopLogger()
+	c := startProcessGroup(t, "sleep 30")
+	newStateTracker(nop, 5).executing(c.Process.Pid)
+	require.Nil(t, writeToFile(mostRecentSequence, "5"))
+
+	for _, seq := range []int{4, 5} {
+		st, _ := supersededExecution(nop, nil, seq)
+		require.Nil(t, st, "an older or repeated sequence number doesn't supersede")
+	}
+	st, sig := supersededExecution(nop, nil, 6)
+	require.NotNil(t, st)
+	require.Equal(t, 5, st.SeqNum)
+	require.Equal(t, syscall.SIGTERM, sig)
+
+	queue := []map[string]interface{}{{"onNewSequenceNumber": "queue"}}
+	st, _ = supersededExecution(nop, queue, 6)
+	require.Nil(t, st, "queued")
+	st = queuedExecution(nop, queue, 6)
+	require.NotNil(t, st)
+	require.Equal(t, 5, st.SeqNum)
+	require.Nil(t, queuedExecution(nop, nil, 6), "superseded")
+
+	// without mrseq, e.g. after it was lost, only older commands are superseded
+	require.Nil(t, os.Remove(mostRecentSequence))
+	st, _ = supersededExecution(nop, nil, 4)
+	require.Nil(t, st, "an older sequence number doesn't supersede")
+	require.True(t, processGroupAlive(c.Process.Pid))
+}
+
+func Test_terminateProcessGroup(t *testing.T) {
+	c := startProcessGroup(t, "sleep 30")
+	require.Nil(t, terminateProcessGroup(log.NewNopLogger(), c.Process.Pid, syscall.SIGTERM))
+	require.False(t, processGroupAlive(c.Process.Pid))
+}
+
+func Test_terminateProcessGroup_kill(t *testing.T) {
+	defer func(d time.Duration) { terminateGracePeriod = d }(terminateGracePeriod)
+	terminateGracePeriod = 200 * time.Millisecond
+
+	c := startProcessGroup(t, `trap "" TERM; while true; do sleep 0.1; done`)
+	time.Sleep(100 * time.Millisecond) // let the shell set the trap
+	begin := time.Now()
+	require.Nil(t, terminateProcessGroup(log.NewNopLogger(), c.Process.Pid, syscall.SIGTERM))
+	require.False(t, processGroupAlive(c.Process.Pid))
+	require.True(t, time.Since(begin) >= terminateGracePeriod, "killed after the grace period")
+}
+
+func Test_acquireEnableLockBehind(t *testing.T) {
+	defer func(d time.Duration) { lockPollInterval = d }(lockPollInterval)
+	lockPollInterval = 10 * time.Millisecond
+	setTestDataDir(t)
+	nop := log.NewNopLogger()
+	lockFile(t, instanceLockPath())
+
+	c := startProcessGroup(t, "sleep 0.3")
+	queued := &state.State{SeqNum: 1, Phase: state.Executing, Pid: c.Process.Pid}
+	waited, _, err := acquireEnableLockBehind(nop, 2, 50*time.Millisecond, queued)
+	require.Equal(t, errLockBusy, err)
+	require.True(t, waited >= 300*time.Millisecond, "waited for the queued command, not only for the timeout: %v", waited)
+
+	waited, _, err = acquireEnableLockBehind(nop, 2, 50*time.Millisecond, nil)
+	require.Equal(t, errLockBusy, err)
+	require.True(t, waited < 300*time.Millisecond, "%v", waited)
+}
+
+func Test_enableBlocks_superseded(t *testing.T) {
+	setTestDataDir(t)
+	nop := log.NewNopLogger()
+	dir := tempDir(t)
+	st := newStateTracker(nop, 1)
+
+	go func() {
+		for {
+			if running := runningExecution(nop, 2); running != nil {
+				markSuperseding(nop, running, 2)
+				terminateProcessGroup(nop, running.Pid, syscall.SIGTERM)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	_, substatus, ewc := enableBlocks(log.NewContext(nop), dir, []handlerSettings{
+		{publicSettings: publicSettings{CommandToExecute: "sleep 30"}},
+		{publicSettings: publicSettings{CommandToExecute: "echo one"}},
+	}, nil, nil, st)
+	require.NotNil(t, ewc)
+	require.Len(t, substatus, 2)
+	require.Equal(t, errorutil.CommandExecution_superseded, substatus[1].Code)
+	require.Contains(t, substatus[1].FormattedMessage.Message, "sequence number 2 superseded sequence number 1")
+	require.False(t, fileExists(t, filepath.Join(dir, "1", "stdout")), "the next block didn't run")
+	require.Equal(t, 2, requireState(t, 1, state.Executing).SupersededBy)
+}
+
+func Test_markTerminated(t *testing.T) {
+	setTestDataDir(t)
+	hEnv := HandlerEnvironment{}
+	hEnv.HandlerEnvironment.StatusFolder = tempDir(t)
+	ctx := log.NewContext(log.NewNopLogger())
+
+	old := newStateTracker(ctx, 1)
+	old.executing(42)
+	old.exited(-1)
+	old.completed(nil)
+
+	st := &state.State{SeqNum: 1, Phase: state.Executing, Pid: 42}
+	markTerminated(ctx, hEnv, st, supersededError(st, 2))
+	status, err := readStatus(ctx, hEnv, 1)
+	require.Nil(t, err)
+	require.Equal(t, StatusError, status)
+
+	s := requireState(t, 1, state.Completed)
+	require.Equal(t, -1, *s.ExitCode)
+	require.Equal(t, 0, s.Pid)
+	require.Contains(t, s.Error, "sequence number 2 superseded sequence number 1")
+	require.Equal(t, errorutil.CommandExecution_superseded, supersededError(s, 2).ErrorCode)
+}
+
+// startProcessGroup starts the shell command in its own process group, like
+// the command of a sequence number.
+func startProcessGroup(t *testing.T, cmd string) *exec.Cmd {
+	c := exec.Command("/bin/sh", "-c", cmd)
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	require.Nil(t, c.Start())
+	go c.Wait() // reap it, a zombie would keep the process group alive
+	t.Cleanup(func() { syscall.Kill(-c.Process.Pid, syscall.SIGKILL) })
+	return c
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-extension-platform/pkg/extensionpolicysettings"
+	vmextension "github.com/Azure/azure-extension-platform/vmextension"
+	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
+	"github.com/Azure/custom-script-extension-linux/pkg/seqnum"
+	"github.com/Azure/custom-script-extension-linux/pkg/state"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// The triggers which run the command of the most recent sequence number again
+// after its enable, with the files enable downloaded.
+const (
+	// triggerScheduled runs it on the schedule setting, see schedule.go.
+	triggerScheduled = "scheduled"
+	// triggerBoot runs it on each boot with runOnBoot, see boot.go.
+	triggerBoot = "boot"
+)
+
+// maxRunHistory is the number of triggered runs whose output is kept in the
+// history of a sequence number.
+var maxRunHistory = 10
+
+// runResult is the result of a triggered run, saved with its output in the
+// run history.
+type runResult struct {
+	Trigger string    `json:"trigger"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Code    int       `json:"code"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// applyTriggers installs the triggers of cfg for seqNum, and removes the ones
+// cfg doesn't have.
+func applyTriggers(ctx log.Logger, cfg handlerSettings, seqNum int) *vmextension.ErrorWithClarification {
+	if ewc := applySchedule(ctx, cfg, seqNum); ewc != nil {
+		return ewc
+	}
+	return applyRunOnBoot(ctx, cfg, seqNum)
+}
+
+// removeTriggers removes the installed triggers of the handled extension
+// instance, logging failures.
+func removeTriggers(ctx log.Logger) {
+	if err := removeSchedule(); err != nil {
+		ctx.Log("event", "could not remove schedule", "error", err)
+	}
+	if err := removeBootUnit(); err != nil {
+		ctx.Log("event", "could not remove boot unit", "error", err)
+	}
+}
+
+// restoreTriggers installs the triggers of the settings of seqNum again, or
+// removes them, once enable found the sequence number already processed: a
+// disable, or the uninstall of the previous version on an update, may have
+// removed them, and they must run the handler of this version.
+func restoreTriggers(ctx *log.Context, hEnv HandlerEnvironment, seqNum int) {
+	cfgs, ewc := parseAndValidateSettings(ctx, hEnv.HandlerEnvironment.ConfigFolder, seqNum)
+	if ewc != nil {
+		ctx.Log("event", "could not restore triggers", "error", ewc.Err)
+		return
+	}
+	if ewc := applyTriggers(ctx, cfgs[0], seqNum); ewc != nil {
+		ctx.Log("event", "could not restore triggers", "error", ewc.Err)
+	}
+}
+
+// triggeredPre returns the preFunc of a triggered run, which exits without
+// status if the run must not happen: while the extension is disabled, if the
+// trigger belongs to an older sequence number, or if an enable invocation
+// still runs after wait. Otherwise the run holds the enable lock.
+func triggeredPre(wait time.Duration) preFunc {
+	return func(ctx *log.Context, hEnv HandlerEnvironment, seqNum int) error {
+		if _, holder, err := acquireEnableLock(instanceLockPath(), seqNum, wait); err == errLockBusy {
+			ctx.Log("event", "exit", "message", "another invocation runs, skipping this run", "holder", fmt.Sprintf("%+v", holder))
+			os.Exit(0)
+		} else if err != nil {
+			return errors.Wrap(err, "failed to take the enable lock")
+		}
+		if disabled() {
+			ctx.Log("event", "exit", "message", "the extension is disabled")
+			os.Exit(0)
+		}
+		if last, ok, err := seqnum.Get(instanceMostRecentSequence()); err != nil {
+			return errors.Wrap(err, "failed to check sequence number")
+		} else if !ok || last != seqNum {
+			ctx.Log("event", "exit", "message", "the trigger belongs to an older sequence number", "mrseq", last)
+			os.Exit(0)
+		}
+		return nil
+	}
+}
+
+// runTriggered returns the cmdFunc which runs the command of each runtime
+// settings block of seqNum again on trigger, with the files downloaded by its
+// enable, and reports the result of the run in the status of seqNum.
+func runTriggered(trigger string) cmdFunc {
+	return func(ctx *log.Context, h HandlerEnvironment, seqNum int) (string, []SubstatusItem, *vmextension.ErrorWithClarification) {
+		cfgs, ewc := parseAndValidateSettings(ctx, h.HandlerEnvironment.ConfigFolder, seqNum)
+		if ewc != nil {
+			ewc.Err = errors.Wrap(ewc.Err, "failed to get configuration")
+			return "", nil, ewc
+		}
+		eps, policy, ewc := loadExtensionPolicy(ctx, filepath.Join(h.HandlerEnvironment.ConfigFolder, policyFileName))
+		if ewc != nil {
+			return "", nil, ewc
+		}
+
+		// the run doesn't go through the phases of enable
+		setHeartbeatPhase(state.Executing)
+		run := func(ctx *log.Context, dir string, cfg handlerSettings) (string, *vmextension.ErrorWithClarification) {
+			return triggeredRun(ctx, dir, cfg, eps, policy, trigger)
+		}
+		dir := filepath.Join(instanceDownloadDir(), strconv.Itoa(seqNum))
+		if len(cfgs) == 1 {
+			msg, runErr := run(ctx, dir, cfgs[0])
+			return msg, nil, runErr
+		}
+		return runBlocks(ctx, dir, cfgs, run)
+	}
+}
+
+// triggeredRun runs the command of cfg in dir and saves its output in the run
+// history. If the files enable downloaded into dir are gone, e.g. since the
+// previous version was uninstalled on an update, they are downloaded again.
+func triggeredRun(ctx *log.Context, dir string, cfg handlerSettings, eps *extensionpolicysettings.ExtensionPolicySettingsManager[CSEExtensionPolicySettings], policy *CSEExtensionPolicySettings, trigger string) (string, *vmextension.ErrorWithClarification) {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		ctx.Log("event", "the files downloaded by enable are missing, downloading them again")
+		if _, ewc := prepareFiles(ctx, dir, cfg, eps, policy); ewc != nil {
+			return "", ewc
+		}
+	} else if err != nil {
+		return "", vmextension.NewErrorWithClarificationPtr(errorutil.SystemError, errors.Wrap(err, "failed to find the files downloaded by enable"))
+	}
+	begin := time.Now().UTC()
+	runErr := runCmd(ctx, dir, cfg, policy, nil)
+	result := runResult{Trigger: trigger, Start: begin, End: time.Now().UTC()}
+	if runErr != nil {
+		result.Code, result.Error = runErr.ErrorCode, runErr.Error()
+	}
+	if err := saveRunHistory(dir, result); err != nil {
+		ctx.Log("event", "could not save run history", "error", err)
+	}
+	telemetry(trigger+"-run", fmt.Sprintf("code=%d", result.Code), runErr == nil, result.End.Sub(result.Start))
+	return fmt.Sprintf("%s run at %s", trigger, begin.Format(time.RFC3339)) + outputTails(ctx, dir), runErr
+}
+
+// saveRunHistory copies the output of the run in dir, with its result, to a
+// directory named after the start and the trigger of the run in the run
+// history of dir under instanceHistoryDir, and removes the oldest runs beyond
+// maxRunHistory.
+func saveRunHistory(dir string, result runResult) error {
+	rel, err := filepath.Rel(instanceDownloadDir(), dir)
+	if err != nil {
+		return errors.Wrap(err, "failed to find history directory")
+	}
+	hist := filepath.Join(instanceHistoryDir(), rel)
+	runDir := filepath.Join(hist, result.Start.Format("20060102T150405.000Z")+"-"+result.Trigger)
+	if err := os.MkdirAll(runDir, 0700); err != nil {
+		return errors.Wrap(err, "failed to create history directory")
+	}
+	stdout, stderr := logPaths(dir)
+	for _, path := range []string{stdout, stderr} {
+		f, err := openOutput(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return errors.Wrap(err, "failed to read output")
+		}
+		b, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return errors.Wrap(err, "failed to read output")
+		}
+		if err := ioutil.WriteFile(filepath.Join(runDir, filepath.Base(path)), b, 0600); err != nil {
+			return errors.Wrap(err, "failed to save output")
+		}
+	}
+	b, _ := json.Marshal(result)
+	if err := ioutil.WriteFile(filepath.Join(runDir, "result.json"), b, 0600); err != nil {
+		return errors.Wrap(err, "failed to save result")
+	}
+
+	// the names of the runs sort by time
+	runs, err := ioutil.ReadDir(hist)
+	if err != nil {
+		return errors.Wrap(err, "failed to list history")
+	}
+	var names []string
+	for _, r := range runs {
+		if r.IsDir() {
+			names = append(names, r.Name())
+		}
+	}
+	sort.Strings(names)
+	for i := 0; i < len(names)-maxRunHistory; i++ {
+		os.RemoveAll(filepath.Join(hist, names[i]))
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_applyTriggers(t *testing.T) {
+	setTestCronDir(t)
+	calls := setTestSystemctl(t)
+	nop := log.NewNopLogger()
+
+	require.Nil(t, applyTriggers(nop, handlerSettings{publicSettings: publicSettings{Schedule: "@daily", RunOnBoot: true}}, 1))
+	require.True(t, fileExists(t, cronFilePath()))
+	require.True(t, fileExists(t, filepath.Join(systemdUnitDir, bootUnitName())))
+
+	removeTriggers(nop)
+	require.False(t, fileExists(t, cronFilePath()))
+	require.False(t, fileExists(t, filepath.Join(systemdUnitDir, bootUnitName())))
+	require.Equal(t, []string{"daemon-reload", "enable custom-script-boot.service", "disable custom-script-boot.service", "daemon-reload"}, *calls)
+}
+
+func Test_triggeredRun(t *testing.T) {
+	setTestDataDir(t)
+	dir := filepath.Join(dataDir, downloadDir, "3")
+	require.Nil(t, os.MkdirAll(dir, 0700))
+
+	msg, ewc := triggeredRun(log.NewContext(log.NewNopLogger()), dir, handlerSettings{
+		publicSettings: publicSettings{CommandToExecute: "echo hi; exit 2"},
+	}, nil, nil, triggerBoot)
+	require.NotNil(t, ewc)
+	require.Contains(t, msg, "boot run at ")
+	require.Contains(t, msg, "[stdout]\nhi\n")
+
+	runs, err := ioutil.ReadDir(filepath.Join(dataDir, historyDir, "3"))
+	require.Nil(t, err)
+	require.Len(t, runs, 1)
+	require.True(t, strings.HasSuffix(runs[0].Name(), "Z-boot"), runs[0].Name())
+	run := filepath.Join(dataDir, historyDir, "3", runs[0].Name())
+	requireFileContent(t, filepath.Join(run, "stdout"), "hi\n")
+	b, err := ioutil.ReadFile(filepath.Join(run, "result.json"))
+	require.Nil(t, err)
+	var result runResult
+	require.Nil(t, json.Unmarshal(b, &result))
+	require.Equal(t, triggerBoot, result.Trigger)
+	require.Equal(t, errorutil.CommandExecution_failureExitCode, result.Code)
+	require.Contains(t, result.Error, "exit status=2")
+}
+
+func Test_triggeredRun_missingDownloads(t *testing.T) {
+	setTestDataDir(t)
+	dir := filepath.Join(dataDir, downloadDir, "3")
+	msg, ewc := triggeredRun(log.NewContext(log.NewNopLogger()), dir, handlerSettings{
+		publicSettings: publicSettings{CommandToExecute: "cat a.txt", InlineFiles: map[string]inlineFile{"a.txt": {Content: "aGkK"}}},
+	}, nil, nil, triggerScheduled)
+	require.Nil(t, ewc)
+	require.Contains(t, msg, "[stdout]\nhi\n")
+	requireFileContent(t, filepath.Join(dir, "a.txt"), "hi\n")
+}
+
+func Test_saveRunHistory_prunes(t *testing.T) {
+	setTestDataDir(t)
+	dir := filepath.Join(dataDir, downloadDir, "1", "0")
+	require.Nil(t, os.MkdirAll(dir, 0700))
+	begin := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < maxRunHistory+2; i++ {
+		start := begin.Add(time.Duration(i) * time.Hour)
+		require.Nil(t, saveRunHistory(dir, runResult{Trigger: triggerScheduled, Start: start, End: start}))
+	}
+
+	runs, err := ioutil.ReadDir(filepath.Join(dataDir, historyDir, "1", "0"))
+	require.Nil(t, err)
+	require.Len(t, runs, maxRunHistory)
+	require.Equal(t, "20200101T020000.000Z-scheduled", runs[0].Name(), "the oldest runs are removed")
+}
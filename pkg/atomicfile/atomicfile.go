@@ -0,0 +1,56 @@
+// Package atomicfile writes files so that they survive crashes: a reader sees
+// either the previous content of the file or the new one, never a partial
+// write.
+package atomicfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// WriteFile writes data to a temporary file next to path, flushes it to disk
+// and renames it over path with the given mode. The directory is flushed too,
+// so that the rename itself is durable.
+func WriteFile(path string, data []byte, mode os.FileMode) (err error) {
+	dir := filepath.Dir(path)
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "atomicfile: failed to create temporary file")
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	if _, err = f.Write(data); err != nil {
+		return errors.Wrap(err, "atomicfile: failed to write")
+	}
+	if err = f.Chmod(mode); err != nil {
+		return errors.Wrap(err, "atomicfile: failed to chmod")
+	}
+	if err = f.Sync(); err != nil {
+		return errors.Wrap(err, "atomicfile: failed to sync")
+	}
+	if err = f.Close(); err != nil {
+		return errors.Wrap(err, "atomicfile: failed to close")
+	}
+	if err = os.Rename(f.Name(), path); err != nil {
+		return errors.Wrap(err, "atomicfile: failed to rename")
+	}
+	return syncDir(dir)
+}
+
+// syncDir flushes the entries of dir to disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrap(err, "atomicfile: failed to open directory")
+	}
+	defer d.Close()
+	return errors.Wrap(d.Sync(), "atomicfile: failed to sync directory")
+}
@@ -0,0 +1,53 @@
+package atomicfile_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/atomicfile"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	fp := filepath.Join(dir, "file")
+
+	require.Nil(t, atomicfile.WriteFile(fp, []byte("first"), 0600))
+	require.Nil(t, atomicfile.WriteFile(fp, []byte("2nd"), 0640))
+
+	b, err := ioutil.ReadFile(fp)
+	require.Nil(t, err)
+	require.Equal(t, "2nd", string(b))
+	fi, err := os.Stat(fp)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0640), fi.Mode().Perm())
+
+	entries, err := ioutil.ReadDir(dir)
+	require.Nil(t, err)
+	require.Len(t, entries, 1, "no temporary file is left behind")
+}
+
+func TestWriteFile_nonExistingDir(t *testing.T) {
+	err := atomicfile.WriteFile("/non/existing/dir/file", []byte("a"), 0600)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "atomicfile: failed to create temporary file")
+}
+
+func TestWriteFile_overDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	require.Nil(t, os.Mkdir(filepath.Join(dir, "sub"), 0700))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "sub", "x"), nil, 0600))
+
+	err = atomicfile.WriteFile(filepath.Join(dir, "sub"), []byte("a"), 0600)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "atomicfile: failed to rename")
+	entries, err := ioutil.ReadDir(dir)
+	require.Nil(t, err)
+	require.Len(t, entries, 1, "the temporary file is removed")
+}
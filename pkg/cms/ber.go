@@ -0,0 +1,119 @@
+package cms
+
+import (
+	"bytes"
+	"errors"
+)
+
+// berToDER converts the BER encoding in b to DER as far as encoding/asn1 needs
+// it: indefinite lengths are replaced by definite ones. Constructed string
+// encodings are kept, see octetString.
+func berToDER(b []byte) ([]byte, error) {
+	out, rest, err := convertElement(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("cms: trailing data after the content")
+	}
+	return out, nil
+}
+
+// convertElement converts the first element in b and returns the rest.
+func convertElement(b []byte) (out, rest []byte, err error) {
+	if len(b) < 2 {
+		return nil, nil, errors.New("cms: truncated element")
+	}
+	tagLen := 1
+	if b[0]&0x1f == 0x1f { // high tag number form
+		for tagLen < len(b) && b[tagLen]&0x80 != 0 {
+			tagLen++
+		}
+		tagLen++
+	}
+	if tagLen >= len(b) {
+		return nil, nil, errors.New("cms: truncated tag")
+	}
+	tag := b[:tagLen]
+	constructed := b[0]&0x20 != 0
+	b = b[tagLen:]
+
+	var content []byte
+	if b[0] == 0x80 { // indefinite length
+		if !constructed {
+			return nil, nil, errors.New("cms: indefinite length on primitive element")
+		}
+		b = b[1:]
+		var children bytes.Buffer
+		for {
+			if len(b) < 2 {
+				return nil, nil, errors.New("cms: missing end-of-contents")
+			}
+			if b[0] == 0 && b[1] == 0 {
+				b = b[2:]
+				break
+			}
+			var child []byte
+			if child, b, err = convertElement(b); err != nil {
+				return nil, nil, err
+			}
+			children.Write(child)
+		}
+		content = children.Bytes()
+	} else {
+		n, lenLen, err := parseLength(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		b = b[lenLen:]
+		if n > len(b) {
+			return nil, nil, errors.New("cms: element exceeds the data")
+		}
+		content, b = b[:n], b[n:]
+		if constructed {
+			var children bytes.Buffer
+			for c := content; len(c) > 0; {
+				var child []byte
+				if child, c, err = convertElement(c); err != nil {
+					return nil, nil, err
+				}
+				children.Write(child)
+			}
+			content = children.Bytes()
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.Write(tag)
+	buf.Write(encodeLength(len(content)))
+	buf.Write(content)
+	return buf.Bytes(), b, nil
+}
+
+func parseLength(b []byte) (n, lenLen int, _ error) {
+	if b[0]&0x80 == 0 {
+		return int(b[0]), 1, nil
+	}
+	numBytes := int(b[0] & 0x7f)
+	if numBytes == 0 || numBytes > 4 || numBytes >= len(b) {
+		return 0, 0, errors.New("cms: invalid length")
+	}
+	for _, c := range b[1 : 1+numBytes] {
+		n = n<<8 | int(c)
+	}
+	if n < 0 {
+		return 0, 0, errors.New("cms: invalid length")
+	}
+	return n, 1 + numBytes, nil
+}
+
+func encodeLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var l []byte
+	for ; n > 0; n >>= 8 {
+		l = append([]byte{byte(n)}, l...)
+	}
+	return append([]byte{0x80 | byte(len(l))}, l...)
+}
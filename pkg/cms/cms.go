@@ -0,0 +1,341 @@
+// Package cms decrypts PKCS#7/CMS EnvelopedData (RFC 5652) and
+// AuthEnvelopedData (RFC 5083) addressed to an RSA key, as used for the
+// protected settings of extension handlers.
+//
+// Key transport with RSAES-PKCS1-v1_5 and RSAES-OAEP is supported, with the
+// content encrypted with AES-CBC, AES-GCM or DES-EDE3-CBC.
+package cms
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	oidEnvelopedData     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+	oidAuthEnvelopedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 23}
+
+	oidRSAEncryption = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidRSAESOAEP     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 7}
+	oidMGF1          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 8}
+	oidPSpecified    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 9}
+
+	oidSHA1   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+
+	oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidAES128GCM  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 6}
+	oidAES192GCM  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 26}
+	oidAES256GCM  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 46}
+	oidDESEDE3CBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+)
+
+var (
+	// ErrNoRecipient is returned when the content is not addressed to the
+	// given certificate.
+	ErrNoRecipient = errors.New("cms: no recipient matches the certificate")
+	// ErrUnsupported is returned for content types and algorithms which are
+	// not supported.
+	ErrUnsupported = errors.New("cms: unsupported content")
+)
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type envelopedData struct {
+	Version              int
+	OriginatorInfo       asn1.RawValue   `asn1:"optional,tag:0"`
+	RecipientInfos       []asn1.RawValue `asn1:"set"`
+	EncryptedContentInfo encryptedContentInfo
+	UnprotectedAttrs     asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type authEnvelopedData struct {
+	Version              int
+	OriginatorInfo       asn1.RawValue   `asn1:"optional,tag:0"`
+	RecipientInfos       []asn1.RawValue `asn1:"set"`
+	EncryptedContentInfo encryptedContentInfo
+	AuthAttrs            asn1.RawValue `asn1:"optional,tag:1"`
+	MAC                  []byte
+	UnauthAttrs          asn1.RawValue `asn1:"optional,tag:2"`
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+type keyTransRecipientInfo struct {
+	Version                int
+	RID                    asn1.RawValue
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type issuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type oaepParams struct {
+	HashFunc    pkix.AlgorithmIdentifier `asn1:"optional,explicit,tag:0"`
+	MaskGenFunc pkix.AlgorithmIdentifier `asn1:"optional,explicit,tag:1"`
+	PSourceFunc pkix.AlgorithmIdentifier `asn1:"optional,explicit,tag:2"`
+}
+
+type gcmParams struct {
+	Nonce  []byte
+	ICVLen int `asn1:"default:12"`
+}
+
+// Decrypt decrypts the DER (or BER) encoded CMS EnvelopedData or
+// AuthEnvelopedData in der, addressed to cert, with the private key of cert.
+func Decrypt(der []byte, cert *x509.Certificate, key *rsa.PrivateKey) ([]byte, error) {
+	der, err := berToDER(der)
+	if err != nil {
+		return nil, err
+	}
+	var ci contentInfo
+	if rest, err := asn1.Unmarshal(der, &ci); err != nil {
+		return nil, errors.Wrap(err, "cms: failed to parse content info")
+	} else if len(rest) > 0 {
+		return nil, errors.New("cms: trailing data after content info")
+	}
+
+	var (
+		recipients []asn1.RawValue
+		eci        encryptedContentInfo
+		mac        []byte
+		authAttrs  asn1.RawValue
+	)
+	switch {
+	case ci.ContentType.Equal(oidEnvelopedData):
+		var ed envelopedData
+		if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+			return nil, errors.Wrap(err, "cms: failed to parse enveloped data")
+		}
+		recipients, eci = ed.RecipientInfos, ed.EncryptedContentInfo
+	case ci.ContentType.Equal(oidAuthEnvelopedData):
+		var aed authEnvelopedData
+		if _, err := asn1.Unmarshal(ci.Content.Bytes, &aed); err != nil {
+			return nil, errors.Wrap(err, "cms: failed to parse authenticated enveloped data")
+		}
+		recipients, eci, mac, authAttrs = aed.RecipientInfos, aed.EncryptedContentInfo, aed.MAC, aed.AuthAttrs
+	default:
+		return nil, errors.Wrapf(ErrUnsupported, "content type %v", ci.ContentType)
+	}
+
+	cek, err := decryptContentKey(recipients, cert, key)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := octetString(eci.EncryptedContent)
+	if err != nil {
+		return nil, err
+	}
+	return decryptContent(eci.ContentEncryptionAlgorithm, cek, ciphertext, mac, authAttrs)
+}
+
+// decryptContentKey finds the key transport recipient info addressed to cert
+// and decrypts the content encryption key with key.
+func decryptContentKey(recipients []asn1.RawValue, cert *x509.Certificate, key *rsa.PrivateKey) ([]byte, error) {
+	for _, r := range recipients {
+		// other recipient info kinds are context-specific choices
+		if r.Class != asn1.ClassUniversal || r.Tag != asn1.TagSequence {
+			continue
+		}
+		var ktri keyTransRecipientInfo
+		if _, err := asn1.Unmarshal(r.FullBytes, &ktri); err != nil {
+			return nil, errors.Wrap(err, "cms: failed to parse recipient info")
+		}
+		if !recipientMatches(ktri.RID, cert) {
+			continue
+		}
+
+		alg := ktri.KeyEncryptionAlgorithm
+		switch {
+		case alg.Algorithm.Equal(oidRSAEncryption):
+			cek, err := rsa.DecryptPKCS1v15(rand.Reader, key, ktri.EncryptedKey)
+			return cek, errors.Wrap(err, "cms: failed to decrypt content encryption key")
+		case alg.Algorithm.Equal(oidRSAESOAEP):
+			opts, err := oaepOptions(alg.Parameters)
+			if err != nil {
+				return nil, err
+			}
+			cek, err := key.Decrypt(rand.Reader, ktri.EncryptedKey, opts)
+			return cek, errors.Wrap(err, "cms: failed to decrypt content encryption key")
+		default:
+			return nil, errors.Wrapf(ErrUnsupported, "key encryption algorithm %v", alg.Algorithm)
+		}
+	}
+	return nil, ErrNoRecipient
+}
+
+// recipientMatches reports whether the recipient identifier (issuer and serial
+// number, or [0] subject key identifier) identifies cert.
+func recipientMatches(rid asn1.RawValue, cert *x509.Certificate) bool {
+	if rid.Class == asn1.ClassContextSpecific && rid.Tag == 0 {
+		return len(cert.SubjectKeyId) > 0 && bytes.Equal(rid.Bytes, cert.SubjectKeyId)
+	}
+	var ias issuerAndSerialNumber
+	if _, err := asn1.Unmarshal(rid.FullBytes, &ias); err != nil {
+		return false
+	}
+	return bytes.Equal(ias.Issuer.FullBytes, cert.RawIssuer) && ias.SerialNumber.Cmp(cert.SerialNumber) == 0
+}
+
+func oaepOptions(params asn1.RawValue) (*rsa.OAEPOptions, error) {
+	// absent fields default to SHA-1 for both the hash and MGF1
+	opts := &rsa.OAEPOptions{Hash: crypto.SHA1, MGFHash: crypto.SHA1}
+	if len(params.FullBytes) == 0 || params.Tag == asn1.TagNull {
+		return opts, nil
+	}
+	var p oaepParams
+	if _, err := asn1.Unmarshal(params.FullBytes, &p); err != nil {
+		return nil, errors.Wrap(err, "cms: failed to parse RSAES-OAEP parameters")
+	}
+	if len(p.PSourceFunc.Algorithm) > 0 {
+		if !p.PSourceFunc.Algorithm.Equal(oidPSpecified) {
+			return nil, errors.Wrapf(ErrUnsupported, "OAEP label source %v", p.PSourceFunc.Algorithm)
+		}
+		if _, err := asn1.Unmarshal(p.PSourceFunc.Parameters.FullBytes, &opts.Label); err != nil {
+			return nil, errors.Wrap(err, "cms: failed to parse OAEP label")
+		}
+	}
+	var err error
+	if len(p.HashFunc.Algorithm) > 0 {
+		if opts.Hash, err = hashFor(p.HashFunc.Algorithm); err != nil {
+			return nil, err
+		}
+	}
+	if len(p.MaskGenFunc.Algorithm) > 0 {
+		if !p.MaskGenFunc.Algorithm.Equal(oidMGF1) {
+			return nil, errors.Wrapf(ErrUnsupported, "mask generation function %v", p.MaskGenFunc.Algorithm)
+		}
+		var mgfHash pkix.AlgorithmIdentifier
+		if _, err := asn1.Unmarshal(p.MaskGenFunc.Parameters.FullBytes, &mgfHash); err != nil {
+			return nil, errors.Wrap(err, "cms: failed to parse MGF1 parameters")
+		}
+		if opts.MGFHash, err = hashFor(mgfHash.Algorithm); err != nil {
+			return nil, err
+		}
+	}
+	return opts, nil
+}
+
+func hashFor(oid asn1.ObjectIdentifier) (crypto.Hash, error) {
+	switch {
+	case oid.Equal(oidSHA1):
+		return crypto.SHA1, nil
+	case oid.Equal(oidSHA256):
+		return crypto.SHA256, nil
+	case oid.Equal(oidSHA384):
+		return crypto.SHA384, nil
+	case oid.Equal(oidSHA512):
+		return crypto.SHA512, nil
+	}
+	return 0, errors.Wrapf(ErrUnsupported, "hash algorithm %v", oid)
+}
+
+func decryptContent(alg pkix.AlgorithmIdentifier, cek, ciphertext, mac []byte, authAttrs asn1.RawValue) ([]byte, error) {
+	switch oid := alg.Algorithm; {
+	case oid.Equal(oidAES128CBC), oid.Equal(oidAES192CBC), oid.Equal(oidAES256CBC):
+		block, err := aes.NewCipher(cek)
+		if err != nil {
+			return nil, errors.Wrap(err, "cms: invalid content encryption key")
+		}
+		return decryptCBC(block, alg.Parameters, ciphertext)
+	case oid.Equal(oidDESEDE3CBC):
+		block, err := des.NewTripleDESCipher(cek)
+		if err != nil {
+			return nil, errors.Wrap(err, "cms: invalid content encryption key")
+		}
+		return decryptCBC(block, alg.Parameters, ciphertext)
+	case oid.Equal(oidAES128GCM), oid.Equal(oidAES192GCM), oid.Equal(oidAES256GCM):
+		if len(authAttrs.FullBytes) > 0 {
+			return nil, errors.Wrap(ErrUnsupported, "authenticated attributes")
+		}
+		var p gcmParams
+		if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &p); err != nil {
+			return nil, errors.Wrap(err, "cms: failed to parse GCM parameters")
+		}
+		block, err := aes.NewCipher(cek)
+		if err != nil {
+			return nil, errors.Wrap(err, "cms: invalid content encryption key")
+		}
+		gcm, err := cipher.NewGCMWithNonceSize(block, len(p.Nonce))
+		if err != nil {
+			return nil, errors.Wrap(err, "cms: invalid GCM parameters")
+		}
+		if p.ICVLen != gcm.Overhead() || len(mac) != p.ICVLen {
+			return nil, errors.Wrapf(ErrUnsupported, "GCM tag length %d", len(mac))
+		}
+		plain, err := gcm.Open(nil, p.Nonce, append(append([]byte{}, ciphertext...), mac...), nil)
+		return plain, errors.Wrap(err, "cms: failed to decrypt content")
+	default:
+		return nil, errors.Wrapf(ErrUnsupported, "content encryption algorithm %v", oid)
+	}
+}
+
+func decryptCBC(block cipher.Block, params asn1.RawValue, ciphertext []byte) ([]byte, error) {
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.FullBytes, &iv); err != nil {
+		return nil, errors.Wrap(err, "cms: failed to parse IV")
+	}
+	bs := block.BlockSize()
+	if len(iv) != bs {
+		return nil, fmt.Errorf("cms: invalid IV length %d", len(iv))
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%bs != 0 {
+		return nil, errors.New("cms: encrypted content is not a multiple of the block size")
+	}
+	plain := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, ciphertext)
+
+	pad := int(plain[len(plain)-1])
+	if pad == 0 || pad > bs || !bytes.Equal(plain[len(plain)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, errors.New("cms: invalid padding, wrong key?")
+	}
+	return plain[:len(plain)-pad], nil
+}
+
+// octetString returns the contents of an implicitly tagged OCTET STRING, which
+// BER allows to be split into a constructed sequence of OCTET STRINGs.
+func octetString(v asn1.RawValue) ([]byte, error) {
+	if !v.IsCompound {
+		return v.Bytes, nil
+	}
+	var out []byte
+	for rest := v.Bytes; len(rest) > 0; {
+		var chunk asn1.RawValue
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &chunk); err != nil {
+			return nil, errors.Wrap(err, "cms: failed to parse encrypted content")
+		}
+		b, err := octetString(chunk)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, b...)
+	}
+	return out, nil
+}
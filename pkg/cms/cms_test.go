@@ -0,0 +1,91 @@
+package cms
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// The testdata files were generated with OpenSSL 3.0, e.g.:
+//
+//	openssl cms -encrypt -binary -aes-256-gcm -outform DER -in plain.json -out aes256gcm.p7m recipient.crt
+
+func TestDecrypt(t *testing.T) {
+	cert, key := recipient(t)
+	plain := readTestFile(t, "plain.json")
+
+	for _, f := range []string{
+		"aes256cbc.p7m",   // openssl smime, RSAES-PKCS1-v1_5
+		"oaep-sha256.p7m", // RSAES-OAEP with SHA-256, AES-128-CBC
+		"aes256gcm.p7m",   // AuthEnvelopedData
+		"des3.p7m",
+		"ber-stream.p7m", // indefinite lengths, chunked encrypted content
+		"ski.p7m",        // recipient identified by subject key identifier
+	} {
+		out, err := Decrypt(readTestFile(t, f), cert, key)
+		require.Nil(t, err, f)
+		require.Equal(t, plain, out, f)
+	}
+}
+
+func TestDecrypt_otherRecipient(t *testing.T) {
+	cert, key := recipient(t)
+	_, err := Decrypt(readTestFile(t, "other.p7m"), cert, key)
+	require.Equal(t, ErrNoRecipient, err)
+}
+
+func TestDecrypt_tampered(t *testing.T) {
+	cert, key := recipient(t)
+
+	b := readTestFile(t, "aes256gcm.p7m")
+	b[len(b)-1] ^= 0xff // last byte of the tag
+	_, err := Decrypt(b, cert, key)
+	require.NotNil(t, err)
+
+	_, err = Decrypt(readTestFile(t, "plain.json"), cert, key)
+	require.NotNil(t, err)
+}
+
+func TestDecrypt_unsupportedContentType(t *testing.T) {
+	cert, key := recipient(t)
+	// ContentInfo with id-data
+	_, err := Decrypt([]byte{0x30, 0x0f, 0x06, 0x09, 0x2a, 0x86, 0x48, 0x86, 0xf7, 0x0d, 0x01, 0x07, 0x01, 0xa0, 0x02, 0x04, 0x00}, cert, key)
+	require.Equal(t, ErrUnsupported, errors.Cause(err))
+}
+
+func TestBerToDER(t *testing.T) {
+	// SEQUENCE (indefinite) { OCTET STRING (constructed, indefinite) { "a", "b" } }
+	ber := []byte{0x30, 0x80, 0x24, 0x80, 0x04, 0x01, 'a', 0x04, 0x01, 'b', 0x00, 0x00, 0x00, 0x00}
+	der, err := berToDER(ber)
+	require.Nil(t, err)
+	require.Equal(t, []byte{0x30, 0x08, 0x24, 0x06, 0x04, 0x01, 'a', 0x04, 0x01, 'b'}, der)
+
+	_, err = berToDER([]byte{0x30, 0x80, 0x04, 0x01, 'a'})
+	require.NotNil(t, err, "missing end-of-contents")
+	_, err = berToDER([]byte{0x04, 0x05, 'a'})
+	require.NotNil(t, err, "truncated")
+	_, err = berToDER([]byte{0x04, 0x01, 'a', 'b'})
+	require.NotNil(t, err, "trailing data")
+}
+
+func recipient(t *testing.T) (*x509.Certificate, *rsa.PrivateKey) {
+	block, _ := pem.Decode(readTestFile(t, "recipient.crt"))
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.Nil(t, err)
+	block, _ = pem.Decode(readTestFile(t, "recipient.prv"))
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	require.Nil(t, err)
+	return cert, key.(*rsa.PrivateKey)
+}
+
+func readTestFile(t *testing.T, name string) []byte {
+	b, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	require.Nil(t, err)
+	return b
+}
@@ -93,6 +93,31 @@ func GetMsiProviderForStorageAccountsWithObjectId(blobUri, objectId string) MsiP
 	}
 }
 
+// GetMsiProviderForResource returns an MsiProvider for the given resource
+// (e.g. https://vault.azure.net) using the user assigned identity with the
+// given client id or object id, or the system assigned identity if both are
+// empty.
+func GetMsiProviderForResource(resource, clientId, objectId string) MsiProvider {
+	msiProvider := msi.NewMsiProvider(httputil.NewSecureHttpClient(httputil.DefaultRetryBehavior))
+	return func() (msi.Msi, error) {
+		var m msi.Msi
+		var err error
+		switch {
+		case clientId != "":
+			m, err = msiProvider.GetMsiUsingClientId(clientId, resource)
+		case objectId != "":
+			m, err = msiProvider.GetMsiUsingObjectId(objectId, resource)
+		default:
+			m, err = msiProvider.GetMsiForResource(resource)
+		}
+		if err != nil {
+			return m, fmt.Errorf("Unable to get managed identity for %s. "+
+				"Please make sure that the managed identity is enabled on the VM or added to it", resource)
+		}
+		return m, nil
+	}
+}
+
 func GetResourceNameFromBlobUri(uri string) string {
 	// TODO: update this function as sovereign cloud blob resource strings become available
 	// resource string for getting MSI for azure storage is still https://storage.azure.com/ for sovereign regions but it is expected to change
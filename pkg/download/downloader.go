@@ -22,6 +22,17 @@ type Downloader interface {
 	GetRequest() (*http.Request, error)
 }
 
+// StatusError is the error of a download which the server answered with a
+// status code other than 200 OK.
+type StatusError struct {
+	StatusCode int
+	msg        string
+}
+
+func (e *StatusError) Error() string {
+	return e.msg
+}
+
 const (
 	MsiDownload404ErrorString     = "please ensure that the blob location in the fileUri setting exists, and the specified Managed Identity has read permissions to the storage blob"
 	MsiDownload403ErrorString     = "please ensure that the specified Managed Identity has read permissions to the storage blob"
@@ -132,5 +143,5 @@ func Download(ctx *log.Context, d Downloader) (int, io.ReadCloser, *vmextension.
 		return resp.StatusCode, nil, nil
 	}
 
-	return resp.StatusCode, nil, vmextension.NewErrorWithClarificationPtr(errClarificationCode, errors.New(errString))
+	return resp.StatusCode, nil, vmextension.NewErrorWithClarificationPtr(errClarificationCode, &StatusError{StatusCode: resp.StatusCode, msg: errString})
 }
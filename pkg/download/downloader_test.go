@@ -59,6 +59,9 @@ func TestDownload_wrapsCommonErrorCodes(t *testing.T) {
 		respCode, _, ewc := download.Download(testctx, download.NewURLDownload(fmt.Sprintf("%s/status/%d", srv.URL, code)))
 		require.NotNil(t, ewc.Err, "not failed for code:%d", code)
 		require.Equal(t, code, respCode)
+		var se *download.StatusError
+		require.True(t, errors.As(ewc.Err, &se))
+		require.Equal(t, code, se.StatusCode)
 		switch respCode {
 		case http.StatusNotFound:
 			require.Equal(t, ewc.ErrorCode, errorutil.FileDownload_doesNotExist)
@@ -2,6 +2,7 @@ package download
 
 import (
 	"os"
+	"syscall"
 
 	"github.com/Azure/azure-extension-platform/vmextension"
 	"github.com/Azure/custom-script-extension-linux/pkg/errorutil"
@@ -12,9 +13,10 @@ import (
 // SaveTo uses given downloader to fetch the resource with retries and saves the
 // given file. Directory of dst is not created by this function. If a file at
 // dst exists, it will be truncated. If a new file is created, mode is used to
-// set the permission bits. Written number of bytes are returned on success.
+// set the permission bits. A symbolic link at dst is not followed. Written
+// number of bytes are returned on success.
 func SaveTo(ctx *log.Context, d []Downloader, dst string, mode os.FileMode) (int64, *vmextension.ErrorWithClarification) {
-	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, mode)
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_TRUNC|os.O_CREATE|syscall.O_NOFOLLOW, mode)
 	if err != nil {
 		return 0, vmextension.NewErrorWithClarificationPtr(errorutil.FileDownload_unknownError, errors.Wrap(err, "failed to open file for writing"))
 
@@ -11,12 +11,15 @@ const (
 
 	Imds_internalMsiError int = -30
 
-	Internal_badConfig               int = -21
-	Internal_couldNotFindCertificate int = -20
+	Internal_certificateExpired            int = -23
+	Internal_certificateThumbprintMismatch int = -22
+	Internal_badConfig                     int = -21
+	Internal_couldNotFindCertificate       int = -20
 
 	Os_FailedToDeleteDataDir int = -50
 	Os_FailedToOpenStdOut    int = -51
 	Os_FailedToOpenStdErr    int = -52
+	Os_FailedToMigrateState  int = -53
 
 	Storage_internalServerError int = -1
 	SystemError                 int = 0 // CRP interprets anything > 0 as user errors
@@ -25,6 +28,10 @@ const (
 	CommandExecution_failedUnknownError      int = 1
 	CommandExecution_failureExitCode         int = 2
 	CommandExecution_interruptedByVmShutdown int = 3
+	CommandExecution_timedOut                int = 4
+	CommandExecution_concurrentEnable        int = 5
+	CommandExecution_superseded              int = 6
+	CommandExecution_disabled                int = 7
 
 	CustomerInput_commandToExecuteSpecifiedInTwoPlaces   int = 20
 	CustomerInput_fileUrisSpecifiedInTwoPlaces           int = 22
@@ -36,6 +43,17 @@ const (
 	CustomerInput_scriptSpecifiedInTwoPlaces             int = 28
 	CustomerInput_commandToExecuteAndScriptBothSpecified int = 29
 	CustomerInput_incompleteStorageCreds                 int = 30
+	CustomerInput_invalidRunAsUser                       int = 31
+	CustomerInput_invalidSignaturePublicKey              int = 32
+	CustomerInput_invalidEnvironmentVariable             int = 33
+	CustomerInput_invalidSecretRef                       int = 34
+	CustomerInput_fileToExecuteAndCommandBothSpecified   int = 35
+	CustomerInput_argumentsWithoutFileToExecute          int = 36
+	CustomerInput_invalidFileToExecute                   int = 37
+	CustomerInput_inlineFilesSpecifiedInTwoPlaces        int = 38
+	CustomerInput_invalidInlineFile                      int = 39
+	CustomerInput_invalidScript                          int = 40
+	CustomerInput_invalidSchedule                        int = 41
 
 	FileDownload_unableToCreateDownloadDirectory int = 50
 	FileDownload_sasExpired                      int = 51
@@ -44,6 +62,8 @@ const (
 	FileDownload_networkingError                 int = 54
 	FileDownload_genericError                    int = 55
 	FileDownload_exceededTimeout                 int = 56
+	FileDownload_signatureMissing                int = 57
+	FileDownload_signatureInvalid                int = 58
 
 	Msi_notFound                    int = 70
 	Msi_doesNotHaveRightPermissions int = 71
@@ -51,6 +71,14 @@ const (
 
 	ExtensionPolicySettings_invalidPolicyFileFormat int = 80
 	ExtensionPolicySettings_policyLoadFailed        int = 81
+	ExtensionPolicySettings_executionNotAllowed     int = 82
+	ExtensionPolicySettings_signatureMissing        int = 83
+	ExtensionPolicySettings_signatureInvalid        int = 84
+
+	SecretProvider_secretNotFound int = 90
+	SecretProvider_accessDenied   int = 91
+	SecretProvider_unavailable    int = 92
+
 	// No Error - used as a placeholder value
 	// when representing an "empty" ErrorWithClarification
 	// or when the error can be treated without the clarification
@@ -0,0 +1,72 @@
+package secrets
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// FileProvider reads each secret from the file named after it in a directory
+// which only the user running the handler (root) can access.
+type FileProvider struct {
+	dir string
+}
+
+// NewFileProvider returns a FileProvider for the secrets in dir. It fails if
+// dir is not a directory owned by the current user without any permissions for
+// group or others.
+func NewFileProvider(dir string) (*FileProvider, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "secrets: failed to access the secrets directory")
+	}
+	if !fi.IsDir() {
+		return nil, errors.Errorf("secrets: %s is not a directory", dir)
+	}
+	if err := checkPrivate(dir, fi); err != nil {
+		return nil, err
+	}
+	return &FileProvider{dir}, nil
+}
+
+// Get returns the content of the file named name in the secrets directory,
+// without a trailing line break.
+func (p *FileProvider) Get(name string) (string, error) {
+	if err := ValidateName(name); err != nil {
+		return "", err
+	}
+	path := filepath.Join(p.dir, name)
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return "", ErrNotFound
+	} else if err != nil {
+		return "", errors.Wrapf(err, "secrets: failed to access secret %q", name)
+	}
+	if !fi.Mode().IsRegular() { // no symbolic links out of the directory
+		return "", errors.Errorf("secrets: secret %q is not a regular file", name)
+	}
+	if err := checkPrivate(path, fi); err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "secrets: failed to read secret %q", name)
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(b), "\n"), "\r"), nil
+}
+
+// checkPrivate returns ErrAccessDenied if path is not owned by the current
+// user or if group or others have any permissions on it.
+func checkPrivate(path string, fi os.FileInfo) error {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Geteuid() {
+		return errors.Wrapf(ErrAccessDenied, "%s is not owned by uid %d", path, os.Geteuid())
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return errors.Wrapf(ErrAccessDenied, "%s is accessible by group or others (mode %04o)", path, fi.Mode().Perm())
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package secrets
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileProvider(t *testing.T) {
+	dir := privateDir(t)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "password"), []byte("s3cr3t\n"), 0600))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "multi-line"), []byte("a\nb"), 0400))
+
+	p, err := NewFileProvider(dir)
+	require.Nil(t, err)
+	v, err := p.Get("password")
+	require.Nil(t, err)
+	require.Equal(t, "s3cr3t", v)
+	v, err = p.Get("multi-line")
+	require.Nil(t, err)
+	require.Equal(t, "a\nb", v)
+
+	_, err = p.Get("missing")
+	require.Equal(t, ErrNotFound, err)
+	_, err = p.Get("../password")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "invalid secret name")
+}
+
+func TestFileProvider_notPrivate(t *testing.T) {
+	dir := privateDir(t)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "readable"), []byte("s3cr3t"), 0644))
+	require.Nil(t, os.Symlink(filepath.Join(dir, "readable"), filepath.Join(dir, "link")))
+
+	p, err := NewFileProvider(dir)
+	require.Nil(t, err)
+	_, err = p.Get("readable")
+	require.Equal(t, ErrAccessDenied, errors.Cause(err))
+	require.NotContains(t, err.Error(), "s3cr3t")
+	_, err = p.Get("link")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "not a regular file")
+
+	require.Nil(t, os.Chmod(dir, 0755))
+	_, err = NewFileProvider(dir)
+	require.Equal(t, ErrAccessDenied, errors.Cause(err))
+
+	_, err = NewFileProvider(filepath.Join(dir, "missing"))
+	require.NotNil(t, err)
+}
+
+func privateDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	require.Nil(t, os.Chmod(dir, 0700))
+	return dir
+}
@@ -0,0 +1,38 @@
+// Package secrets resolves secrets referenced by name in the handler settings
+// from a local or remote secret store, so that their values do not have to be
+// part of the settings.
+//
+// Secret values are never included in the errors returned by the providers.
+package secrets
+
+import (
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrNotFound is returned when the provider has no secret with the name.
+	ErrNotFound = errors.New("secrets: secret not found")
+
+	// ErrAccessDenied is returned when the provider refuses access to the secret.
+	ErrAccessDenied = errors.New("secrets: access to the secret denied")
+)
+
+// nameRegex restricts secret names to what both a file name and a URL path
+// segment can hold as-is.
+var nameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// Provider resolves secrets by name.
+type Provider interface {
+	// Get returns the value of the secret with the given name.
+	Get(name string) (string, error)
+}
+
+// ValidateName returns an error if name can't be the name of a secret.
+func ValidateName(name string) error {
+	if !nameRegex.MatchString(name) {
+		return errors.Errorf("secrets: invalid secret name %q", name)
+	}
+	return nil
+}
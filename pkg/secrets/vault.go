@@ -0,0 +1,123 @@
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	vaultAPIVersion = "7.4"
+
+	// maxVaultResponseSize limits how much of a vault response is read.
+	maxVaultResponseSize = 1024 * 1024
+)
+
+// TokenFunc returns an OAuth access token for the vault.
+type TokenFunc func() (string, error)
+
+// VaultProvider fetches secrets over HTTPS from an Azure Key Vault compatible
+// endpoint, authenticating with a bearer token.
+type VaultProvider struct {
+	url    *url.URL
+	token  TokenFunc
+	client *http.Client
+}
+
+// NewVaultProvider returns a VaultProvider for the vault at the HTTPS URL
+// vaultURL (e.g. https://myvault.vault.azure.net) which gets its access tokens
+// from token.
+func NewVaultProvider(vaultURL string, token TokenFunc) (*VaultProvider, error) {
+	u, err := url.Parse(vaultURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "secrets: invalid vault URL")
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return nil, errors.Errorf("secrets: vault URL %q is not an https URL", vaultURL)
+	}
+	return &VaultProvider{
+		url:   u,
+		token: token,
+		client: &http.Client{
+			Timeout: 60 * time.Second,
+			Transport: &http.Transport{
+				Dial: (&net.Dialer{
+					Timeout:   30 * time.Second,
+					KeepAlive: 30 * time.Second,
+				}).Dial,
+				Proxy:                 http.ProxyFromEnvironment,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ResponseHeaderTimeout: 20 * time.Second,
+			}},
+	}, nil
+}
+
+// Get returns the current version of the secret from the vault.
+func (p *VaultProvider) Get(name string) (string, error) {
+	if err := ValidateName(name); err != nil {
+		return "", err
+	}
+	token, err := p.token()
+	if err != nil {
+		return "", errors.Wrap(err, "secrets: failed to get an access token for the vault")
+	}
+
+	u := *p.url
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/secrets/" + name
+	u.RawQuery = url.Values{"api-version": {vaultAPIVersion}}.Encode()
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", errors.Wrap(err, "secrets: failed to create the vault request")
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "secrets: failed to get secret %q from the vault", name)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", ErrNotFound
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return "", errors.Wrapf(ErrAccessDenied, "vault returned %d for secret %q", resp.StatusCode, name)
+	default:
+		return "", fmt.Errorf("secrets: vault returned %d for secret %q", resp.StatusCode, name)
+	}
+
+	var s struct {
+		Value *string `json:"value"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxVaultResponseSize)).Decode(&s); err != nil {
+		return "", errors.Errorf("secrets: failed to parse the vault response for secret %q", name)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	if s.Value == nil {
+		return "", errors.Errorf("secrets: vault response for secret %q has no value", name)
+	}
+	return *s.Value, nil
+}
+
+// VaultResource returns the resource to request access tokens for to access
+// the vault at vaultURL, which depends on the cloud: the host name without the
+// vault name, e.g. https://vault.azure.net for https://myvault.vault.azure.net.
+func VaultResource(vaultURL string) (string, error) {
+	u, err := url.Parse(vaultURL)
+	if err != nil {
+		return "", errors.Wrap(err, "secrets: invalid vault URL")
+	}
+	i := strings.Index(u.Hostname(), ".")
+	if i < 0 {
+		return "", errors.Errorf("secrets: vault URL %q has no domain", vaultURL)
+	}
+	return "https://" + u.Hostname()[i+1:], nil
+}
@@ -0,0 +1,78 @@
+package secrets
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVaultProvider(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		require.Equal(t, vaultAPIVersion, r.URL.Query().Get("api-version"))
+		switch r.URL.Path {
+		case "/secrets/password":
+			w.Write([]byte(`{"value": "s3cr3t", "id": "https://v/secrets/password/1"}`))
+		case "/secrets/forbidden":
+			w.WriteHeader(http.StatusForbidden)
+		case "/secrets/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/secrets/novalue":
+			w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	p, err := NewVaultProvider(srv.URL+"/", func() (string, error) { return "token", nil })
+	require.Nil(t, err)
+	p.client = srv.Client()
+
+	v, err := p.Get("password")
+	require.Nil(t, err)
+	require.Equal(t, "s3cr3t", v)
+
+	_, err = p.Get("missing")
+	require.Equal(t, ErrNotFound, err)
+	_, err = p.Get("forbidden")
+	require.Equal(t, ErrAccessDenied, pkgerrors.Cause(err))
+	_, err = p.Get("broken")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "vault returned 500")
+	_, err = p.Get("novalue")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "has no value")
+	_, err = p.Get("a/b")
+	require.NotNil(t, err)
+
+	p.token = func() (string, error) { return "", errors.New("no identity") }
+	_, err = p.Get("password")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "no identity")
+}
+
+func TestNewVaultProvider_requiresHTTPS(t *testing.T) {
+	_, err := NewVaultProvider("http://myvault.vault.azure.net", nil)
+	require.NotNil(t, err)
+	_, err = NewVaultProvider("myvault", nil)
+	require.NotNil(t, err)
+}
+
+func TestVaultResource(t *testing.T) {
+	r, err := VaultResource("https://myvault.vault.azure.net/")
+	require.Nil(t, err)
+	require.Equal(t, "https://vault.azure.net", r)
+	r, err = VaultResource("https://myvault.vault.usgovcloudapi.net:443")
+	require.Nil(t, err)
+	require.Equal(t, "https://vault.usgovcloudapi.net", r)
+	_, err = VaultResource("https://localhost")
+	require.NotNil(t, err)
+}
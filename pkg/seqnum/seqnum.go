@@ -9,6 +9,7 @@ import (
 	"os"
 	"strconv"
 
+	"github.com/Azure/custom-script-extension-linux/pkg/atomicfile"
 	"github.com/pkg/errors"
 )
 
@@ -18,23 +19,34 @@ const (
 )
 
 // Set replaces the stored sequence number in file, or creates a new file at
-// path if it does not exist.
+// path if it does not exist. The file is replaced atomically, a crash leaves
+// either the previous or the new number.
 func Set(path string, num int) error {
 	b := []byte(fmt.Sprintf("%v", num))
-	return errors.Wrap(ioutil.WriteFile(path, b, chmod), "seqnum: failed to write")
+	return errors.Wrap(atomicfile.WriteFile(path, b, chmod), "seqnum: failed to write")
 }
 
 // IsSmallerThan returns true if the sequence number stored at path is smaller
 // than the provided num. If no number is stored, returns true and no
 // error.
 func IsSmallerThan(path string, num int) (bool, error) {
+	stored, ok, err := Get(path)
+	if err != nil || !ok {
+		return err == nil, err
+	}
+	return stored < num, nil
+}
+
+// Get returns the sequence number stored at path. If no number is stored,
+// returns false and no error.
+func Get(path string) (int, bool, error) {
 	b, err := ioutil.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return true, nil
+			return 0, false, nil
 		}
-		return false, errors.Wrap(err, "seqnum: failed to read")
+		return 0, false, errors.Wrap(err, "seqnum: failed to read")
 	}
 	stored, err := strconv.Atoi(string(b))
-	return stored < num, errors.Wrapf(err, "seqnum: cannot parse number %q", b)
+	return stored, err == nil, errors.Wrapf(err, "seqnum: cannot parse number %q", b)
 }
@@ -3,6 +3,7 @@ package seqnum_test
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/Azure/custom-script-extension-linux/pkg/seqnum"
@@ -16,10 +17,12 @@ func TestSet_nonExistingDir(t *testing.T) {
 }
 
 func TestSet_writeFail(t *testing.T) {
-	fp := testFile(t, 0500) // remove read permissions // remove write permissions
-	defer os.RemoveAll(fp)
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	require.Nil(t, os.Chmod(dir, 0500)) // remove write permissions of the directory
 
-	err := seqnum.Set(fp, 0)
+	err = seqnum.Set(filepath.Join(dir, "seqnum"), 0)
 	require.NotNil(t, err)
 	require.Contains(t, err.Error(), "seqnum: failed to write")
 }
@@ -108,6 +111,26 @@ func TestIsSmallerThan(t *testing.T) {
 	require.True(t, b, "stored=1 < given=2")
 }
 
+func TestGet(t *testing.T) {
+	fp := testFile(t, 0600)
+	defer os.RemoveAll(fp)
+
+	require.Nil(t, os.Remove(fp))
+	_, ok, err := seqnum.Get(fp)
+	require.Nil(t, err)
+	require.False(t, ok, "no number is stored")
+
+	require.Nil(t, seqnum.Set(fp, 3))
+	n, ok, err := seqnum.Get(fp)
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, 3, n)
+
+	require.Nil(t, ioutil.WriteFile(fp, []byte{'a'}, 0600))
+	_, _, err = seqnum.Get(fp)
+	require.NotNil(t, err)
+}
+
 func testFile(t *testing.T, mode os.FileMode) string {
 	f, err := ioutil.TempFile("", "")
 	require.Nil(t, err, "creating test file failed")
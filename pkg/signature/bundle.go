@@ -0,0 +1,121 @@
+package signature
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// Bundle holds the parts of a Sigstore bundle needed to verify a signature
+// offline. Transparency log entries and timestamps are ignored.
+type Bundle struct {
+	// Signature is the raw signature over the artifact.
+	Signature []byte
+	// Digest is the SHA256 digest of the artifact recorded in the bundle, if any.
+	Digest []byte
+	// Chain is the signing certificate followed by its intermediates, empty if
+	// the artifact was signed with a key.
+	Chain []*x509.Certificate
+}
+
+// sigstoreBundle is the subset of the Sigstore bundle format
+// (application/vnd.dev.sigstore.bundle+json) with a message signature.
+type sigstoreBundle struct {
+	MediaType            string `json:"mediaType"`
+	VerificationMaterial struct {
+		Certificate *struct {
+			RawBytes []byte `json:"rawBytes"`
+		} `json:"certificate"`
+		X509CertificateChain *struct {
+			Certificates []struct {
+				RawBytes []byte `json:"rawBytes"`
+			} `json:"certificates"`
+		} `json:"x509CertificateChain"`
+	} `json:"verificationMaterial"`
+	MessageSignature *struct {
+		MessageDigest *struct {
+			Algorithm string `json:"algorithm"`
+			Digest    []byte `json:"digest"`
+		} `json:"messageDigest"`
+		Signature []byte `json:"signature"`
+	} `json:"messageSignature"`
+	DSSEEnvelope json.RawMessage `json:"dsseEnvelope"`
+
+	// legacy bundle written by "cosign sign-blob --bundle"
+	Base64Signature string `json:"base64Signature"`
+	Cert            string `json:"cert"`
+}
+
+// ParseBundle parses a Sigstore bundle, or the legacy bundle format written by
+// older cosign releases.
+func ParseBundle(b []byte) (*Bundle, error) {
+	var sb sigstoreBundle
+	if err := json.Unmarshal(b, &sb); err != nil {
+		return nil, errors.Wrap(err, "signature: failed to parse bundle")
+	}
+
+	if sb.Base64Signature != "" {
+		sig, err := base64.StdEncoding.DecodeString(sb.Base64Signature)
+		if err != nil {
+			return nil, errors.Wrap(err, "signature: invalid base64Signature in bundle")
+		}
+		out := &Bundle{Signature: sig}
+		if sb.Cert != "" {
+			pemBytes, err := base64.StdEncoding.DecodeString(sb.Cert)
+			if err != nil {
+				pemBytes = []byte(sb.Cert)
+			}
+			if out.Chain, err = ParseCertificates(pemBytes); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+
+	if sb.MessageSignature == nil {
+		if len(sb.DSSEEnvelope) > 0 {
+			return nil, errors.New("signature: bundles with DSSE envelopes are not supported, sign the file as a blob")
+		}
+		return nil, errors.New("signature: bundle has no message signature")
+	}
+	out := &Bundle{Signature: sb.MessageSignature.Signature}
+	if d := sb.MessageSignature.MessageDigest; d != nil {
+		if d.Algorithm != "SHA2_256" {
+			return nil, fmt.Errorf("signature: unsupported bundle digest algorithm %q", d.Algorithm)
+		}
+		out.Digest = d.Digest
+	}
+
+	var raw [][]byte
+	if c := sb.VerificationMaterial.Certificate; c != nil {
+		raw = append(raw, c.RawBytes)
+	} else if c := sb.VerificationMaterial.X509CertificateChain; c != nil {
+		for _, cert := range c.Certificates {
+			raw = append(raw, cert.RawBytes)
+		}
+	}
+	for _, der := range raw {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, errors.Wrap(err, "signature: failed to parse bundle certificate")
+		}
+		out.Chain = append(out.Chain, c)
+	}
+	return out, nil
+}
+
+// VerifyBundle checks that the bundle holds a valid signature over data, see
+// Verify for how the signer is trusted.
+func (v *Verifier) VerifyBundle(data []byte, b *Bundle) error {
+	if b.Digest != nil {
+		if digest := sha256.Sum256(data); !bytes.Equal(digest[:], b.Digest) {
+			return errors.New("signature: file digest does not match the bundle")
+		}
+	}
+	return v.Verify(data, b.Signature, b.Chain)
+}
@@ -0,0 +1,110 @@
+package signature_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"testing"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/signature"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBundle_messageSignature(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	v, err := signature.NewVerifier(publicKeyPEM(t, &key.PublicKey))
+	require.Nil(t, err)
+
+	digest := sha256.Sum256(data)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	require.Nil(t, err)
+	b, err := json.Marshal(map[string]interface{}{
+		"mediaType": "application/vnd.dev.sigstore.bundle.v0.3+json",
+		"verificationMaterial": map[string]interface{}{
+			"publicKey": map[string]string{"hint": "key"},
+		},
+		"messageSignature": map[string]interface{}{
+			"messageDigest": map[string]interface{}{"algorithm": "SHA2_256", "digest": digest[:]},
+			"signature":     sig,
+		},
+	})
+	require.Nil(t, err)
+
+	bundle, err := signature.ParseBundle(b)
+	require.Nil(t, err)
+	require.Equal(t, sig, bundle.Signature)
+	require.Empty(t, bundle.Chain)
+	require.Nil(t, v.VerifyBundle(data, bundle))
+
+	err = v.VerifyBundle([]byte("tampered"), bundle)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "digest does not match")
+}
+
+func TestParseBundle_certificate(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	ca := certificate(t, &x509.Certificate{SerialNumber: big.NewInt(1), IsCA: true, KeyUsage: x509.KeyUsageCertSign}, nil, &caKey.PublicKey, caKey)
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	leaf := certificate(t, &x509.Certificate{SerialNumber: big.NewInt(2), KeyUsage: x509.KeyUsageDigitalSignature}, ca, &leafKey.PublicKey, caKey)
+
+	digest := sha256.Sum256(data)
+	sig, err := ecdsa.SignASN1(rand.Reader, leafKey, digest[:])
+	require.Nil(t, err)
+	b, err := json.Marshal(map[string]interface{}{
+		"verificationMaterial": map[string]interface{}{
+			"certificate": map[string]interface{}{"rawBytes": leaf.Raw},
+		},
+		"messageSignature": map[string]interface{}{"signature": sig},
+	})
+	require.Nil(t, err)
+
+	bundle, err := signature.ParseBundle(b)
+	require.Nil(t, err)
+	require.Len(t, bundle.Chain, 1)
+	v, err := signature.NewVerifier(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}))
+	require.Nil(t, err)
+	require.Nil(t, v.VerifyBundle(data, bundle))
+}
+
+func TestParseBundle_legacy(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	c := certificate(t, &x509.Certificate{SerialNumber: big.NewInt(1)}, nil, &key.PublicKey, key)
+
+	digest := sha256.Sum256(data)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	require.Nil(t, err)
+	b, err := json.Marshal(map[string]string{
+		"base64Signature": base64.StdEncoding.EncodeToString(sig),
+		"cert":            base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})),
+	})
+	require.Nil(t, err)
+
+	bundle, err := signature.ParseBundle(b)
+	require.Nil(t, err)
+	require.Equal(t, sig, bundle.Signature)
+	require.Nil(t, bundle.Digest)
+	require.Len(t, bundle.Chain, 1)
+}
+
+func TestParseBundle_unsupported(t *testing.T) {
+	_, err := signature.ParseBundle([]byte(`{"dsseEnvelope": {"payload": ""}}`))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "DSSE")
+
+	_, err = signature.ParseBundle([]byte(`{"messageSignature": {"messageDigest": {"algorithm": "SHA2_512"}, "signature": ""}}`))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "SHA2_512")
+
+	_, err = signature.ParseBundle([]byte(`not json`))
+	require.NotNil(t, err)
+}
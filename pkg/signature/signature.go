@@ -0,0 +1,169 @@
+// Package signature verifies detached signatures over files against pinned
+// public keys or CA certificates, without any network access.
+package signature
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNoTrustAnchor is returned when no usable key or certificate was found.
+var ErrNoTrustAnchor = errors.New("signature: no public key or certificate found")
+
+// Verifier verifies signatures against a set of pinned public keys and CA
+// certificates.
+type Verifier struct {
+	keys  []crypto.PublicKey
+	roots *x509.CertPool
+}
+
+// NewVerifier parses the PEM encoded trust anchors in b. "PUBLIC KEY" blocks
+// are pinned keys. "CERTIFICATE" blocks are roots if they are CA certificates,
+// otherwise their public keys are pinned directly. If b holds no PEM blocks,
+// it is parsed as a single DER encoded certificate.
+func NewVerifier(b []byte) (*Verifier, error) {
+	var blocks []*pem.Block
+	for rest := b; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		blocks = append(blocks, block)
+	}
+	if len(blocks) == 0 {
+		if _, err := x509.ParseCertificate(b); err != nil {
+			return nil, ErrNoTrustAnchor
+		}
+		blocks = append(blocks, &pem.Block{Type: "CERTIFICATE", Bytes: b})
+	}
+
+	v := &Verifier{roots: x509.NewCertPool()}
+	nRoots := 0
+	for _, block := range blocks {
+		switch block.Type {
+		case "PUBLIC KEY":
+			k, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, errors.Wrap(err, "signature: failed to parse public key")
+			}
+			v.keys = append(v.keys, k)
+		case "RSA PUBLIC KEY":
+			k, err := x509.ParsePKCS1PublicKey(block.Bytes)
+			if err != nil {
+				return nil, errors.Wrap(err, "signature: failed to parse RSA public key")
+			}
+			v.keys = append(v.keys, k)
+		case "CERTIFICATE":
+			c, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, errors.Wrap(err, "signature: failed to parse certificate")
+			}
+			if c.IsCA {
+				v.roots.AddCert(c)
+				nRoots++
+			} else {
+				v.keys = append(v.keys, c.PublicKey)
+			}
+		}
+	}
+	if len(v.keys) == 0 && nRoots == 0 {
+		return nil, ErrNoTrustAnchor
+	}
+	return v, nil
+}
+
+// Verify checks that sig is a valid signature over data. If chain is empty,
+// the signature must have been made with one of the pinned keys. Otherwise
+// chain[0] is the signing certificate, which must chain up to one of the CA
+// certificates, optionally through the rest of chain as intermediates.
+func (v *Verifier) Verify(data, sig []byte, chain []*x509.Certificate) error {
+	if len(chain) > 0 {
+		intermediates := x509.NewCertPool()
+		for _, c := range chain[1:] {
+			intermediates.AddCert(c)
+		}
+		if _, err := chain[0].Verify(x509.VerifyOptions{
+			Roots:         v.roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}); err != nil {
+			return errors.Wrap(err, "signature: signing certificate is not trusted")
+		}
+		return errors.Wrap(VerifyWithKey(chain[0].PublicKey, data, sig), "signature: verification with signing certificate failed")
+	}
+
+	for _, k := range v.keys {
+		if VerifyWithKey(k, data, sig) == nil {
+			return nil
+		}
+	}
+	return errors.New("signature: signature does not match any of the pinned keys")
+}
+
+// VerifyWithKey checks that sig is a signature over the SHA256 digest of data
+// made with the private key of pub. ECDSA (ASN.1), RSA (PKCS#1 v1.5 or PSS) and
+// Ed25519 (over data itself) signatures are supported.
+func VerifyWithKey(pub crypto.PublicKey, data, sig []byte) error {
+	digest := sha256.Sum256(data)
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, digest[:], sig) {
+			return errors.New("invalid ECDSA signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil {
+			return nil
+		}
+		if rsa.VerifyPSS(k, crypto.SHA256, digest[:], sig, nil) == nil {
+			return nil
+		}
+		return errors.New("invalid RSA signature")
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, data, sig) {
+			return errors.New("invalid Ed25519 signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
+
+// DecodeSignature returns the raw signature from the contents of a signature
+// file, which may hold either the raw bytes or their base64 encoding.
+func DecodeSignature(b []byte) []byte {
+	if s, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(b))); err == nil && len(s) > 0 {
+		return s
+	}
+	return b
+}
+
+// ParseCertificates parses the PEM encoded certificates in b.
+func ParseCertificates(b []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for rest := b; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "signature: failed to parse certificate")
+		}
+		certs = append(certs, c)
+	}
+	return certs, nil
+}
@@ -0,0 +1,159 @@
+package signature_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/signature"
+	"github.com/stretchr/testify/require"
+)
+
+var data = []byte(`{"requireSigning": false}`)
+
+func TestNewVerifier_noAnchors(t *testing.T) {
+	_, err := signature.NewVerifier([]byte("not pem"))
+	require.Equal(t, signature.ErrNoTrustAnchor, err)
+}
+
+func TestVerify_ecdsaPublicKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	v, err := signature.NewVerifier(publicKeyPEM(t, &key.PublicKey))
+	require.Nil(t, err)
+
+	digest := sha256.Sum256(data)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	require.Nil(t, err)
+
+	require.Nil(t, v.Verify(data, sig, nil))
+	require.NotNil(t, v.Verify([]byte("tampered"), sig, nil))
+}
+
+func TestVerify_rsaPublicKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	v, err := signature.NewVerifier(publicKeyPEM(t, &key.PublicKey))
+	require.Nil(t, err)
+
+	digest := sha256.Sum256(data)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	require.Nil(t, err)
+	require.Nil(t, v.Verify(data, sig, nil))
+
+	sig, err = rsa.SignPSS(rand.Reader, key, crypto.SHA256, digest[:], nil)
+	require.Nil(t, err)
+	require.Nil(t, v.Verify(data, sig, nil))
+}
+
+func TestVerify_ed25519PublicKey(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	v, err := signature.NewVerifier(publicKeyPEM(t, pub))
+	require.Nil(t, err)
+
+	require.Nil(t, v.Verify(data, ed25519.Sign(priv, data), nil))
+	require.NotNil(t, v.Verify(data, make([]byte, ed25519.SignatureSize), nil))
+}
+
+func TestVerify_wrongKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	v, err := signature.NewVerifier(publicKeyPEM(t, &other.PublicKey))
+	require.Nil(t, err)
+
+	digest := sha256.Sum256(data)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	require.Nil(t, err)
+	err = v.Verify(data, sig, nil)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "does not match any of the pinned keys")
+}
+
+func TestVerify_caChain(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	ca := certificate(t, &x509.Certificate{SerialNumber: big.NewInt(1), IsCA: true, KeyUsage: x509.KeyUsageCertSign}, nil, &caKey.PublicKey, caKey)
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	leaf := certificate(t, &x509.Certificate{SerialNumber: big.NewInt(2), KeyUsage: x509.KeyUsageDigitalSignature}, ca, &leafKey.PublicKey, caKey)
+
+	v, err := signature.NewVerifier(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}))
+	require.Nil(t, err)
+
+	digest := sha256.Sum256(data)
+	sig, err := ecdsa.SignASN1(rand.Reader, leafKey, digest[:])
+	require.Nil(t, err)
+	require.Nil(t, v.Verify(data, sig, []*x509.Certificate{leaf}))
+
+	// a CA root is not a pinned key, a chain is needed
+	require.NotNil(t, v.Verify(data, sig, nil))
+
+	// self-signed leaf not issued by the CA
+	rogueKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	rogue := certificate(t, &x509.Certificate{SerialNumber: big.NewInt(3), KeyUsage: x509.KeyUsageDigitalSignature}, nil, &rogueKey.PublicKey, rogueKey)
+	sig, err = ecdsa.SignASN1(rand.Reader, rogueKey, digest[:])
+	require.Nil(t, err)
+	err = v.Verify(data, sig, []*x509.Certificate{rogue})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "signing certificate is not trusted")
+}
+
+func TestDecodeSignature(t *testing.T) {
+	raw := []byte{0x30, 0x45, 0x02, 0x21}
+	require.Equal(t, raw, signature.DecodeSignature(raw))
+	require.Equal(t, raw, signature.DecodeSignature([]byte(base64.StdEncoding.EncodeToString(raw)+"\n")))
+}
+
+func TestParseCertificates(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	c := certificate(t, &x509.Certificate{SerialNumber: big.NewInt(1)}, nil, &key.PublicKey, key)
+
+	b := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	certs, err := signature.ParseCertificates(b)
+	require.Nil(t, err)
+	require.Len(t, certs, 2)
+
+	certs, err = signature.ParseCertificates([]byte("nothing"))
+	require.Nil(t, err)
+	require.Empty(t, certs)
+}
+
+func publicKeyPEM(t *testing.T, pub crypto.PublicKey) []byte {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	require.Nil(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+// certificate creates a certificate from tmpl issued by parent (self-signed if
+// nil) with the signer key.
+func certificate(t *testing.T, tmpl, parent *x509.Certificate, pub crypto.PublicKey, signer crypto.Signer) *x509.Certificate {
+	tmpl.Subject = pkix.Name{CommonName: tmpl.SerialNumber.String()}
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	tmpl.BasicConstraintsValid = true
+	if parent == nil {
+		parent = tmpl
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, pub, signer)
+	require.Nil(t, err)
+	c, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	return c
+}
@@ -0,0 +1,85 @@
+// Package state persists how far the handler got in processing a sequence
+// number, so that a later run can tell a sequence number which was received
+// or downloaded but never executed from one which completed, and decide to
+// resume or skip it after a crash.
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/atomicfile"
+	"github.com/pkg/errors"
+)
+
+const (
+	// chmod is used to set the mode bits for state files.
+	chmod = os.FileMode(0600)
+)
+
+// Phase is a step in processing a sequence number. The phases follow each
+// other in the order they are declared in.
+type Phase string
+
+const (
+	// Received means that the settings are going to be processed.
+	Received Phase = "received"
+	// PolicyChecked means that the extension policy was loaded.
+	PolicyChecked Phase = "policyChecked"
+	// Downloaded means that the files are downloaded and written.
+	Downloaded Phase = "downloaded"
+	// Executing means that the command was started with State.Pid.
+	Executing Phase = "executing"
+	// Completed means that the result of the sequence number was reported.
+	Completed Phase = "completed"
+)
+
+// State is the progress of a sequence number.
+type State struct {
+	SeqNum int   `json:"seqNum"`
+	Phase  Phase `json:"phase"`
+
+	// Pid is the process id of the command while Executing, valid during the
+	// boot identified by BootID.
+	Pid    int    `json:"pid,omitempty"`
+	BootID string `json:"bootId,omitempty"`
+
+	// ExitCode is the exit code of the command, if it exited.
+	ExitCode *int `json:"exitCode,omitempty"`
+	// Error is the error reported for the sequence number, if it failed.
+	Error string `json:"error,omitempty"`
+	// SupersededBy is the sequence number whose enable terminated the
+	// command, if any.
+	SupersededBy int `json:"supersededBy,omitempty"`
+
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Read returns the state stored at path, or nil and no error if there is none.
+func Read(path string) (*State, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "state: failed to read")
+	}
+	var s State
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, errors.Wrapf(err, "state: cannot parse %s", path)
+	}
+	return &s, nil
+}
+
+// Write atomically replaces the state stored at path with s, stamped with the
+// current time.
+func Write(path string, s State) error {
+	s.UpdatedAt = time.Now().UTC()
+	b, err := json.Marshal(s)
+	if err != nil {
+		return errors.Wrap(err, "state: failed to marshal")
+	}
+	return errors.Wrap(atomicfile.WriteFile(path, b, chmod), "state: failed to write")
+}
@@ -0,0 +1,58 @@
+package state_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/custom-script-extension-linux/pkg/state"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRead_nonExistingFile(t *testing.T) {
+	s, err := state.Read("/non/existing/path")
+	require.Nil(t, err)
+	require.Nil(t, s)
+}
+
+func TestRead_parseError(t *testing.T) {
+	fp := testPath(t)
+	require.Nil(t, ioutil.WriteFile(fp, []byte("{"), 0600))
+	_, err := state.Read(fp)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "state: cannot parse")
+}
+
+func TestWrite(t *testing.T) {
+	fp := testPath(t)
+	code := 3
+	require.Nil(t, state.Write(fp, state.State{SeqNum: 2, Phase: state.Executing, Pid: 42, BootID: "boot"}))
+	require.Nil(t, state.Write(fp, state.State{SeqNum: 2, Phase: state.Completed, ExitCode: &code, Error: "failed"}))
+
+	s, err := state.Read(fp)
+	require.Nil(t, err)
+	require.Equal(t, 2, s.SeqNum)
+	require.Equal(t, state.Completed, s.Phase)
+	require.Equal(t, 0, s.Pid)
+	require.Equal(t, 3, *s.ExitCode)
+	require.Equal(t, "failed", s.Error)
+	require.False(t, s.UpdatedAt.IsZero())
+
+	fi, err := os.Stat(fp)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+}
+
+func TestWrite_fails(t *testing.T) {
+	err := state.Write("/non/existing/dir/state", state.State{})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "state: failed to write")
+}
+
+func testPath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "0.state")
+}